@@ -0,0 +1,417 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	backupManifest   = "backup.json"
+	backupTimeFormat = "20060102-150405"
+
+	backupReasonScheduled = "scheduled"
+	backupReasonRestart   = "restart"
+	backupReasonManual    = "manual"
+	backupReasonRestore   = "pre-restore"
+
+	defaultBackupHourly = 24
+	defaultBackupDaily  = 7
+	defaultBackupWeekly = 4
+)
+
+// BackupConfig configures how often worlds are backed up and how many of the
+// backups are kept. Retention keeps the newest backup of each of the last
+// Hourly hours, Daily days and Weekly weeks. Manual backups are never pruned.
+type BackupConfig struct {
+	Directory string   `json:"directory"`
+	Interval  Duration `json:"interval"`
+	Hourly    int      `json:"hourly"`
+	Daily     int      `json:"daily"`
+	Weekly    int      `json:"weekly"`
+
+	S3 *S3Config `json:"s3"`
+}
+
+// WorldBackup describes a snapshot of a world file and its .bak
+type WorldBackup struct {
+	ID       string
+	World    string
+	Reason   string
+	Created  time.Time
+	Files    []string
+	Size     int64
+	Checksum string
+	Upload   *UploadStatus `json:",omitempty"`
+}
+
+// clone returns a copy of the backup that can be read without holding the
+// BackupManagers lock
+func (wb *WorldBackup) clone() *WorldBackup {
+	c := *wb
+	c.Files = append([]string{}, wb.Files...)
+	if wb.Upload != nil {
+		u := *wb.Upload
+		u.Files = nil
+		c.Upload = &u
+	}
+	return &c
+}
+
+// BackupManager takes and restores snapshots of the world used by a GameServer
+type BackupManager struct {
+	gs     GameServer
+	config BackupConfig
+
+	mu      sync.Mutex
+	backups []*WorldBackup
+
+	// Remote storage
+	remote  *S3Client
+	deletes []string
+	wake    chan struct{}
+
+	close chan struct{}
+}
+
+// NewBackupManager returns a BackupManager for the given GameServer, and loads
+// any backups that already exist in the configured directory
+func NewBackupManager(gs GameServer, c BackupConfig) *BackupManager {
+	if c.Hourly == 0 && c.Daily == 0 && c.Weekly == 0 {
+		c.Hourly = defaultBackupHourly
+		c.Daily = defaultBackupDaily
+		c.Weekly = defaultBackupWeekly
+	}
+
+	b := &BackupManager{
+		gs:      gs,
+		config:  c,
+		backups: make([]*WorldBackup, 0),
+		wake:    make(chan struct{}, 1),
+		close:   make(chan struct{}),
+	}
+
+	if c.S3 != nil {
+		remote, err := NewS3Client(*c.S3)
+		if err != nil {
+			LogError(gs, "Remote backups are disabled: "+err.Error())
+		} else {
+			b.remote = remote
+		}
+	}
+
+	dirs, err := os.ReadDir(c.Directory)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		LogError(gs, "Unable to read backups: "+err.Error())
+	}
+
+	for _, d := range dirs {
+		if !d.IsDir() {
+			continue
+		}
+
+		wb := &WorldBackup{}
+		if err := loadJSON(filepath.Join(c.Directory, d.Name(), backupManifest), wb); err != nil {
+			LogWarning(gs, sprintf("Skipping backup %s: %s", d.Name(), err.Error()))
+			continue
+		}
+		b.backups = append(b.backups, wb)
+	}
+
+	b.sort()
+	return b
+}
+
+// Start begins taking scheduled backups and uploading them to the remote
+// store, if one is configured. Should be run as a goroutine.
+func (b *BackupManager) Start() {
+	go b.uploadLoop()
+
+	if b.config.Interval.Duration <= 0 {
+		LogInfo(b.gs, "Scheduled backups are disabled")
+		return
+	}
+
+	t := time.NewTicker(b.config.Interval.Duration)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-b.close:
+			return
+		case <-t.C:
+			if !b.gs.IsUp() {
+				continue
+			}
+
+			if _, err := b.Snapshot(backupReasonScheduled); err != nil {
+				LogError(b.gs, "Scheduled backup failed: "+err.Error(), b.gs.WSOutput())
+			}
+		}
+	}
+}
+
+// Stop ends scheduled backups
+func (b *BackupManager) Stop() {
+	close(b.close)
+}
+
+// Backups returns the known backups, newest first
+func (b *BackupManager) Backups() []*WorldBackup {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	l := make([]*WorldBackup, 0, len(b.backups))
+	for _, wb := range b.backups {
+		l = append(l, wb.clone())
+	}
+	return l
+}
+
+// Backup returns the backup with the given ID, or nil if there is none
+func (b *BackupManager) Backup(id string) *WorldBackup {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if wb := b.find(id); wb != nil {
+		return wb.clone()
+	}
+	return nil
+}
+
+// find returns the backup with the given ID. Expects b.mu to be held.
+func (b *BackupManager) find(id string) *WorldBackup {
+	for _, wb := range b.backups {
+		if wb.ID == id {
+			return wb
+		}
+	}
+	return nil
+}
+
+// Path returns the path to the world file stored in the given backup
+func (b *BackupManager) Path(wb *WorldBackup) string {
+	return filepath.Join(b.config.Directory, wb.ID, wb.World)
+}
+
+// Snapshot takes a backup of the world. If the server is running the world is
+// saved first, and the files are only copied once Terraria confirms the save.
+func (b *BackupManager) Snapshot(reason string) (*WorldBackup, error) {
+	return b.snapshot(reason, "")
+}
+
+// snapshot takes a backup of the world, and then prunes the backups without
+// touching the one with the given ID
+func (b *BackupManager) snapshot(reason, protect string) (*WorldBackup, error) {
+	world := b.gs.WorldFile()
+	if world == "" {
+		return nil, errors.New("no world file is configured")
+	}
+
+	if b.gs.IsUp() {
+		if err := b.gs.SaveWorld(saveTimeout); err != nil {
+			return nil, err
+		}
+	}
+
+	now := time.Now()
+	wb := &WorldBackup{
+		ID:      now.Format(backupTimeFormat),
+		World:   filepath.Base(world),
+		Reason:  reason,
+		Created: now,
+		Files:   make([]string, 0),
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	dir := filepath.Join(b.config.Directory, wb.ID)
+	for i := 1; ; i++ {
+		if _, err := os.Stat(dir); errors.Is(err, os.ErrNotExist) {
+			break
+		}
+		wb.ID = sprintf("%s-%d", now.Format(backupTimeFormat), i)
+		dir = filepath.Join(b.config.Directory, wb.ID)
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	for _, src := range []string{world, world + ".bak"} {
+		fi, err := os.Stat(src)
+		if errors.Is(err, os.ErrNotExist) && src != world {
+			continue
+		} else if err != nil {
+			os.RemoveAll(dir)
+			return nil, err
+		}
+
+		if err := copyFile(src, filepath.Join(dir, filepath.Base(src))); err != nil {
+			os.RemoveAll(dir)
+			return nil, err
+		}
+		wb.Files = append(wb.Files, filepath.Base(src))
+		wb.Size += fi.Size()
+	}
+
+	sum, err := fileChecksum(filepath.Join(dir, wb.World))
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	wb.Checksum = sum
+
+	if b.remote != nil {
+		wb.Upload = &UploadStatus{State: uploadPending, Updated: now}
+	}
+
+	if err := saveJSON(filepath.Join(dir, backupManifest), wb); err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+
+	b.backups = append(b.backups, wb)
+	b.sort()
+	b.prune(protect)
+
+	LogInfo(b.gs, sprintf("Backed up %s as %s (%s)", wb.World, wb.ID, reason),
+		b.gs.WSOutput())
+	b.wakeUploader()
+	return wb.clone(), nil
+}
+
+// Restore replaces the world with the given backup, which must be of the
+// current world. A running server is stopped, the current world is backed up, the snapshot is swapped in and the
+// server is started again, even if the restore failed.
+func (b *BackupManager) Restore(id string) error {
+	wb := b.Backup(id)
+	if wb == nil {
+		return errors.New("no such backup: " + id)
+	}
+
+	dir := filepath.Join(b.config.Directory, wb.ID)
+	sum, err := fileChecksum(filepath.Join(dir, wb.World))
+	if err != nil {
+		return err
+	}
+
+	if sum != wb.Checksum {
+		return errors.New("backup " + wb.ID + " failed checksum verification")
+	}
+
+	// Backups of other worlds, such as ones rotated out or selected from the
+	// world library, would silently replace the current world
+	if current := filepath.Base(b.gs.WorldFile()); wb.World != current {
+		return errors.New(sprintf("backup %s is of %s, not the current world %s", wb.ID, wb.World, current))
+	}
+
+	wasup := b.gs.IsUp()
+	if wasup {
+		if err := b.gs.Stop(); err != nil {
+			return err
+		}
+	}
+
+	if err := b.restore(wb); err != nil {
+		if wasup {
+			LogError(b.gs, "Restore failed, starting the server again: "+err.Error(), b.gs.WSOutput())
+			if serr := b.gs.Start(); serr != nil {
+				LogError(b.gs, "Unable to start the server again: "+serr.Error(), b.gs.WSOutput())
+			}
+		}
+		return err
+	}
+
+	LogInfo(b.gs, "Restored world from backup "+wb.ID, b.gs.WSOutput())
+
+	if wasup {
+		return b.gs.Start()
+	}
+	return nil
+}
+
+// restore backs up the current world and copies the files of a backup over
+// it. The backup being restored is kept out of the pruning that the new
+// backup causes.
+func (b *BackupManager) restore(wb *WorldBackup) error {
+	if _, err := b.snapshot(backupReasonRestore, wb.ID); err != nil {
+		LogWarning(b.gs, "Unable to back up world before restoring: "+err.Error())
+	}
+
+	dir := filepath.Join(b.config.Directory, wb.ID)
+	world := b.gs.WorldFile()
+	for _, f := range wb.Files {
+		dst := filepath.Join(filepath.Dir(world), f)
+		if f == wb.World {
+			dst = world
+		} else if f == wb.World+".bak" {
+			dst = world + ".bak"
+		}
+
+		if err := copyFile(filepath.Join(dir, f), dst); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sort orders the backups newest first. Expects b.mu to be held.
+func (b *BackupManager) sort() {
+	sort.Slice(b.backups, func(i, j int) bool {
+		return b.backups[i].Created.After(b.backups[j].Created)
+	})
+}
+
+// prune removes the backups that fall outside of the retention rules, other
+// than the one with the ID protect. Expects b.mu to be held and the backups to
+// be sorted.
+func (b *BackupManager) prune(protect string) {
+	keep := map[string]bool{protect: true}
+
+	bucket := func(n int, key func(time.Time) string) {
+		seen := make(map[string]bool)
+		for _, wb := range b.backups {
+			if len(seen) >= n {
+				return
+			}
+
+			k := key(wb.Created)
+			if seen[k] {
+				continue
+			}
+			seen[k] = true
+			keep[wb.ID] = true
+		}
+	}
+
+	bucket(b.config.Hourly, func(t time.Time) string { return t.Format("2006010215") })
+	bucket(b.config.Daily, func(t time.Time) string { return t.Format("20060102") })
+	bucket(b.config.Weekly, func(t time.Time) string {
+		y, w := t.ISOWeek()
+		return sprintf("%d-%d", y, w)
+	})
+
+	kept := make([]*WorldBackup, 0, len(b.backups))
+	for _, wb := range b.backups {
+		if keep[wb.ID] || wb.Reason == backupReasonManual {
+			kept = append(kept, wb)
+			continue
+		}
+
+		LogInfo(b.gs, "Pruning backup "+wb.ID)
+		if err := os.RemoveAll(filepath.Join(b.config.Directory, wb.ID)); err != nil {
+			LogError(b.gs, "Failed to prune backup: "+err.Error())
+			kept = append(kept, wb)
+			continue
+		}
+
+		if b.remote != nil && b.remote.config.SyncRetention {
+			b.deletes = append(b.deletes, wb.ID)
+		}
+	}
+	b.backups = kept
+}
@@ -0,0 +1,419 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	uploadPending  = "pending"
+	uploadRunning  = "uploading"
+	uploadComplete = "uploaded"
+	uploadFailed   = "failed"
+
+	defaultUploadRetries = 5
+	uploadRetryBase      = 30 * time.Second
+	uploadScanInterval   = time.Minute
+)
+
+var errBackupPruned = errors.New("backup was pruned")
+
+// UploadStatus is the state of a backups upload to remote storage
+type UploadStatus struct {
+	State    string
+	Attempts int
+	Error    string `json:",omitempty"`
+	Updated  time.Time
+	Files    map[string]*FileUpload `json:",omitempty"`
+}
+
+// FileUpload records how far the upload of a single file got, so that an
+// interrupted multipart upload can be resumed instead of started over
+type FileUpload struct {
+	UploadID string   `json:",omitempty"`
+	Parts    []s3Part `json:",omitempty"`
+	Done     bool
+}
+
+// uploadLoop uploads pending backups and removes pruned ones from the remote
+// store. Should be run as a goroutine.
+func (b *BackupManager) uploadLoop() {
+	if b.remote == nil {
+		return
+	}
+
+	b.syncRemote()
+
+	t := time.NewTicker(uploadScanInterval)
+	defer t.Stop()
+
+	for {
+		b.processRemote()
+
+		select {
+		case <-b.close:
+			return
+		case <-b.wake:
+		case <-t.C:
+		}
+	}
+}
+
+// wakeUploader nudges the upload loop without blocking
+func (b *BackupManager) wakeUploader() {
+	select {
+	case b.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Upload queues a backup to be uploaded again, resetting its retry count
+func (b *BackupManager) Upload(id string) error {
+	if b.remote == nil {
+		return errors.New("no remote backup target is configured")
+	}
+
+	b.mu.Lock()
+	wb := b.find(id)
+	if wb == nil {
+		b.mu.Unlock()
+		return errors.New("no such backup: " + id)
+	}
+
+	if wb.Upload == nil {
+		wb.Upload = &UploadStatus{}
+	}
+	wb.Upload.State = uploadPending
+	wb.Upload.Attempts = 0
+	wb.Upload.Error = ""
+	b.saveManifest(wb)
+	b.mu.Unlock()
+
+	b.wakeUploader()
+	return nil
+}
+
+// processRemote runs any remote deletions and attempts each upload that is due
+func (b *BackupManager) processRemote() {
+	b.mu.Lock()
+	deletes := b.deletes
+	b.deletes = nil
+	b.mu.Unlock()
+
+	for _, id := range deletes {
+		if err := b.deleteRemote(id); err != nil {
+			LogError(b.gs, sprintf("Unable to remove remote backup %s: %s", id, err.Error()))
+			b.mu.Lock()
+			b.deletes = append(b.deletes, id)
+			b.mu.Unlock()
+		}
+	}
+
+	for _, wb := range b.dueUploads() {
+		err := b.upload(wb)
+
+		b.mu.Lock()
+		if b.pruned(wb) {
+			LogInfo(b.gs, "Stopped uploading pruned backup "+wb.ID)
+			b.mu.Unlock()
+			continue
+		}
+
+		wb.Upload.Updated = time.Now()
+		if err == nil {
+			wb.Upload.State = uploadComplete
+			wb.Upload.Error = ""
+			LogInfo(b.gs, "Uploaded backup "+wb.ID, b.gs.WSOutput())
+		} else {
+			wb.Upload.Error = err.Error()
+			wb.Upload.State = uploadPending
+			if wb.Upload.Attempts >= b.retries() {
+				wb.Upload.State = uploadFailed
+			}
+			LogWarning(b.gs, sprintf("Upload of backup %s failed (attempt %d): %s",
+				wb.ID, wb.Upload.Attempts, err.Error()), b.gs.WSOutput())
+		}
+		b.saveManifest(wb)
+		b.mu.Unlock()
+	}
+}
+
+// dueUploads returns the backups whose next upload attempt is due, and marks
+// them as uploading
+func (b *BackupManager) dueUploads() []*WorldBackup {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	due := make([]*WorldBackup, 0)
+	for _, wb := range b.backups {
+		u := wb.Upload
+		if u == nil || (u.State != uploadPending && u.State != uploadRunning) {
+			continue
+		}
+
+		if u.Attempts > 0 {
+			wait := uploadRetryBase << uint(u.Attempts-1)
+			if now.Sub(u.Updated) < wait {
+				continue
+			}
+		}
+
+		u.State = uploadRunning
+		u.Attempts++
+		u.Updated = now
+		b.saveManifest(wb)
+		due = append(due, wb)
+	}
+	return due
+}
+
+// upload sends the files of a backup to the remote store. Files that have been
+// uploaded already are skipped, and large files resume from their last part.
+// The upload stops with errBackupPruned if the backup is pruned meanwhile.
+func (b *BackupManager) upload(wb *WorldBackup) error {
+	dir := filepath.Join(b.config.Directory, wb.ID)
+
+	for _, f := range wb.Files {
+		b.mu.Lock()
+		if b.pruned(wb) {
+			b.mu.Unlock()
+			return errBackupPruned
+		}
+		if wb.Upload.Files == nil {
+			wb.Upload.Files = make(map[string]*FileUpload)
+		}
+		fu, ok := wb.Upload.Files[f]
+		if !ok {
+			fu = &FileUpload{}
+			wb.Upload.Files[f] = fu
+		}
+		done := fu.Done
+		b.mu.Unlock()
+
+		if done {
+			continue
+		}
+
+		if err := b.uploadFile(wb, fu, filepath.Join(dir, f), wb.ID+"/"+f); err != nil {
+			return err
+		}
+	}
+
+	b.mu.Lock()
+	data, err := os.ReadFile(filepath.Join(dir, backupManifest))
+	if b.pruned(wb) {
+		err = errBackupPruned
+	}
+	b.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return b.remote.PutObject(b.remote.Key(wb.ID+"/"+backupManifest), data)
+}
+
+// uploadFile uploads a single file, using a multipart upload for files larger
+// than a single part. Progress is written to the manifest after every part.
+func (b *BackupManager) uploadFile(wb *WorldBackup, fu *FileUpload, path, name string) error {
+	key := b.remote.Key(name)
+	size := b.remote.config.PartSize
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	if fi.Size() <= size {
+		data, err := io.ReadAll(f)
+		if err != nil {
+			return err
+		}
+		if err := b.remote.PutObject(key, data); err != nil {
+			return err
+		}
+
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		fu.Done = true
+		if !b.saveManifest(wb) {
+			return errBackupPruned
+		}
+		return nil
+	}
+
+	b.mu.Lock()
+	id := fu.UploadID
+	parts := append([]s3Part{}, fu.Parts...)
+	b.mu.Unlock()
+
+	if id == "" {
+		if id, err = b.remote.CreateMultipartUpload(key); err != nil {
+			return err
+		}
+		parts = nil
+
+		b.mu.Lock()
+		fu.UploadID = id
+		fu.Parts = nil
+		kept := b.saveManifest(wb)
+		b.mu.Unlock()
+		if !kept {
+			return b.abortUpload(key, id)
+		}
+	} else {
+		LogInfo(b.gs, sprintf("Resuming upload of %s from part %d", name, len(parts)+1))
+	}
+
+	buf := make([]byte, size)
+	for off := int64(len(parts)) * size; off < fi.Size(); off += size {
+		n, err := f.ReadAt(buf, off)
+		if err != nil && err != io.EOF {
+			return err
+		}
+
+		num := len(parts) + 1
+		etag, err := b.remote.UploadPart(key, id, num, buf[:n])
+		if err != nil {
+			var serr *S3Error
+			if errors.As(err, &serr) && serr.Code == "NoSuchUpload" {
+				b.mu.Lock()
+				fu.UploadID = ""
+				fu.Parts = nil
+				b.saveManifest(wb)
+				b.mu.Unlock()
+			}
+			return err
+		}
+
+		parts = append(parts, s3Part{PartNumber: num, ETag: etag})
+		b.mu.Lock()
+		fu.Parts = append([]s3Part{}, parts...)
+		kept := b.saveManifest(wb)
+		b.mu.Unlock()
+		if !kept {
+			return b.abortUpload(key, id)
+		}
+	}
+
+	if err := b.remote.CompleteMultipartUpload(key, id, parts); err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	fu.Done = true
+	fu.UploadID = ""
+	fu.Parts = nil
+	if !b.saveManifest(wb) {
+		return errBackupPruned
+	}
+	return nil
+}
+
+// abortUpload abandons the multipart upload of a backup that was pruned while
+// it was being uploaded, so that the parts do not linger in the bucket
+func (b *BackupManager) abortUpload(key, id string) error {
+	if err := b.remote.AbortMultipartUpload(key, id); err != nil {
+		LogWarning(b.gs, sprintf("Unable to abort the upload of %s: %s", key, err.Error()))
+	}
+	return errBackupPruned
+}
+
+// deleteRemote removes every object that belongs to a backup
+func (b *BackupManager) deleteRemote(id string) error {
+	keys, err := b.remote.ListObjects(b.remote.Key(id + "/"))
+	if err != nil {
+		return err
+	}
+
+	for _, k := range keys {
+		if err := b.remote.DeleteObject(k); err != nil {
+			return err
+		}
+	}
+
+	LogInfo(b.gs, "Removed remote backup "+id)
+	return nil
+}
+
+// syncRemote removes remote backups that have been pruned locally. Only
+// backups older than the oldest local backup are removed, so that losing the
+// local backups never empties the bucket.
+func (b *BackupManager) syncRemote() {
+	if !b.remote.config.SyncRetention {
+		return
+	}
+
+	b.mu.Lock()
+	if len(b.backups) == 0 {
+		b.mu.Unlock()
+		return
+	}
+	oldest := b.backups[len(b.backups)-1].ID
+	local := make(map[string]bool)
+	for _, wb := range b.backups {
+		local[wb.ID] = true
+	}
+	b.mu.Unlock()
+
+	prefix := b.remote.Key("")
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	keys, err := b.remote.ListObjects(prefix)
+	if err != nil {
+		LogError(b.gs, "Unable to list remote backups: "+err.Error())
+		return
+	}
+
+	remote := make(map[string]bool)
+	for _, k := range keys {
+		id := strings.SplitN(strings.TrimPrefix(k, prefix), "/", 2)[0]
+		if id != "" && !local[id] && id < oldest {
+			remote[id] = true
+		}
+	}
+
+	b.mu.Lock()
+	for id := range remote {
+		b.deletes = append(b.deletes, id)
+	}
+	b.mu.Unlock()
+}
+
+// retries returns the number of upload attempts made before giving up
+func (b *BackupManager) retries() int {
+	if b.remote.config.Retries > 0 {
+		return b.remote.config.Retries
+	}
+	return defaultUploadRetries
+}
+
+// saveManifest writes the backups manifest, and returns false without writing
+// it if the backup has been pruned, since writing it would bring back the
+// directory of the backup. Expects b.mu to be held.
+func (b *BackupManager) saveManifest(wb *WorldBackup) bool {
+	if b.pruned(wb) {
+		return false
+	}
+	if err := saveJSON(filepath.Join(b.config.Directory, wb.ID, backupManifest), wb); err != nil {
+		LogError(b.gs, sprintf("Unable to update backup %s: %s", wb.ID, err.Error()))
+	}
+	return true
+}
+
+// pruned returns true if a backup is no longer kept. Expects b.mu to be held.
+func (b *BackupManager) pruned(wb *WorldBackup) bool {
+	return b.find(wb.ID) != wb
+}
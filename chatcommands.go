@@ -0,0 +1,457 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultChatPrefix     = "!"
+	defaultChatRateLimit  = 5
+	defaultChatRateWindow = 30 * time.Second
+	chatServerName        = "Server"
+)
+
+// Permission levels of chat commands. Players can only run commands at or
+// below their own level.
+const (
+	PermissionPlayer = iota
+	PermissionModerator
+	PermissionAdmin
+)
+
+var permissionNames = map[string]int{
+	"player":    PermissionPlayer,
+	"moderator": PermissionModerator,
+	"admin":     PermissionAdmin,
+}
+
+var (
+	errChatUsage      = errors.New("incorrect usage")
+	errChatPermission = errors.New("you are not allowed to do that")
+)
+
+// ChatConfig configures in-game chat commands. Users are given permission
+// levels by name, and if an IP is given the player must also be connecting
+// from it, as player names are not authenticated. RateLimit is the number of
+// commands that a player may run in each RateWindow.
+type ChatConfig struct {
+	Prefix     string     `json:"prefix"`
+	Users      []ChatUser `json:"users"`
+	Rules      []string   `json:"rules"`
+	RateLimit  int        `json:"rate_limit"`
+	RateWindow Duration   `json:"rate_window"`
+}
+
+// ChatUser gives a player a permission level (player, moderator or admin).
+// Moderators and admins must have an IP, since names are not authenticated.
+type ChatUser struct {
+	Name  string `json:"name"`
+	IP    string `json:"ip,omitempty"`
+	Level string `json:"level"`
+}
+
+// ChatCommand is a command that players can run from chat. Cooldown applies
+// to each player separately, unless Global is set.
+type ChatCommand struct {
+	Name     string
+	Aliases  []string
+	Usage    string
+	Help     string
+	Level    int
+	Cooldown time.Duration
+	Global   bool
+	Run      func(*ChatContext) error
+}
+
+// ChatContext is given to a ChatCommand when it is run
+type ChatContext struct {
+	GS       GameServer
+	Player   string
+	Level    int
+	Command  *ChatCommand
+	Args     []string
+	Commands *ChatCommands
+}
+
+// Reply - Answer the player in chat
+func (c *ChatContext) Reply(msg string) {
+	if err := c.GS.Console().Say(msg); err != nil {
+		LogWarning(c.GS, "Unable to reply to chat command: "+err.Error())
+	}
+}
+
+// ChatCommands dispatches chat messages that start with the command prefix to
+// the registered ChatCommands
+type ChatCommands struct {
+	gs     GameServer
+	config ChatConfig
+
+	mu       sync.Mutex
+	commands map[string]*ChatCommand
+	aliases  map[string]string
+	used     map[string]time.Time   // Cooldowns, by command and player
+	recent   map[string][]time.Time // Rate limits, by player
+	warned   map[string]bool        // Players told that they hit the limit
+}
+
+// NewChatCommands returns a ChatCommands with the built in commands registered
+func NewChatCommands(gs GameServer, c ChatConfig) (*ChatCommands, error) {
+	if c.Prefix == "" {
+		c.Prefix = defaultChatPrefix
+	}
+	if c.RateLimit <= 0 {
+		c.RateLimit = defaultChatRateLimit
+	}
+	if c.RateWindow.Duration <= 0 {
+		c.RateWindow.Duration = defaultChatRateWindow
+	}
+
+	for _, u := range c.Users {
+		level, ok := permissionNames[u.Level]
+		switch {
+		case !ok:
+			return nil, errors.New(sprintf("unknown permission level %q for %s", u.Level, u.Name))
+		case u.IP != "" && net.ParseIP(u.IP) == nil:
+			return nil, errors.New(sprintf("invalid IP %q for %s", u.IP, u.Name))
+		case u.IP == "" && level > PermissionPlayer:
+			// Anyone can join with any name, so a name alone is not enough
+			return nil, errors.New(sprintf("%s needs an IP to be a %s", u.Name, u.Level))
+		}
+	}
+
+	cc := &ChatCommands{
+		gs:       gs,
+		config:   c,
+		commands: make(map[string]*ChatCommand),
+		aliases:  make(map[string]string),
+		used:     make(map[string]time.Time),
+		recent:   make(map[string][]time.Time),
+		warned:   make(map[string]bool),
+	}
+
+	for _, cmd := range builtinChatCommands() {
+		if err := cc.Register(cmd); err != nil {
+			return nil, err
+		}
+	}
+	return cc, nil
+}
+
+// Start handles the chat of the GameServer until the subscription ends
+func (cc *ChatCommands) Start() *Subscription {
+	return cc.gs.Bus().Handle("chat-commands", EventKinds("Chat"), func(ev Event) {
+		chat := ev.(*Chat)
+		if chat.Name == chatServerName || !strings.HasPrefix(chat.Message, cc.config.Prefix) {
+			return
+		}
+		cc.Dispatch(chat.Name, strings.TrimPrefix(chat.Message, cc.config.Prefix))
+	})
+}
+
+// Register - Add a command. Returns an error if the name or an alias is
+// already taken.
+func (cc *ChatCommands) Register(cmd *ChatCommand) error {
+	if cmd.Name == "" || cmd.Run == nil {
+		return errors.New("chat commands need a name and a function")
+	}
+
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	names := append([]string{cmd.Name}, cmd.Aliases...)
+	for _, n := range names {
+		n = strings.ToLower(n)
+		if _, ok := cc.commands[n]; ok {
+			return errors.New(sprintf("chat command %s is already registered", n))
+		}
+		if _, ok := cc.aliases[n]; ok {
+			return errors.New(sprintf("chat command %s is already registered", n))
+		}
+	}
+
+	cc.commands[strings.ToLower(cmd.Name)] = cmd
+	for _, a := range cmd.Aliases {
+		cc.aliases[strings.ToLower(a)] = strings.ToLower(cmd.Name)
+	}
+	return nil
+}
+
+// Commands - Return the commands available at the given permission level,
+// sorted by name
+func (cc *ChatCommands) Commands(level int) []*ChatCommand {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	res := make([]*ChatCommand, 0)
+	for _, cmd := range cc.commands {
+		if cmd.Level <= level {
+			res = append(res, cmd)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+	return res
+}
+
+// Level - Return the permission level of a player
+func (cc *ChatCommands) Level(name string) int {
+	var ip string
+	if p := cc.gs.Player(name); p != nil && p.IP() != nil {
+		ip = p.IP().String()
+	}
+
+	for _, u := range cc.config.Users {
+		if u.Name == name && (u.IP == "" || u.IP == ip) {
+			return permissionNames[u.Level]
+		}
+	}
+	return PermissionPlayer
+}
+
+// Prefix - Return the prefix that commands start with
+func (cc *ChatCommands) Prefix() string {
+	return cc.config.Prefix
+}
+
+// Dispatch - Run a command line (without its prefix) for a player
+func (cc *ChatCommands) Dispatch(player, line string) {
+	fields := strings.Fields(sanitizeConsole(line))
+	if len(fields) == 0 {
+		return
+	}
+
+	name := strings.ToLower(fields[0])
+	ctx := &ChatContext{
+		GS:       cc.gs,
+		Player:   player,
+		Level:    cc.Level(player),
+		Args:     fields[1:],
+		Commands: cc,
+	}
+
+	cc.mu.Lock()
+	if a, ok := cc.aliases[name]; ok {
+		name = a
+	}
+	cmd, ok := cc.commands[name]
+	cc.mu.Unlock()
+
+	if !ok {
+		return
+	}
+	ctx.Command = cmd
+
+	if !cc.allow(player, ctx.Level) {
+		return
+	}
+
+	if ctx.Level < cmd.Level {
+		ctx.Reply(sprintf("%s: %s", player, errChatPermission.Error()))
+		return
+	}
+
+	if wait := cc.cooldown(cmd, player); wait > 0 {
+		ctx.Reply(sprintf("%s: %s%s can be used again in %s", player, cc.config.Prefix,
+			cmd.Name, wait.Round(time.Second)))
+		return
+	}
+
+	LogInfo(cc.gs, sprintf("%s ran chat command: %s", player, line))
+	go func() {
+		switch err := cmd.Run(ctx); err {
+		case nil:
+		case errChatUsage:
+			ctx.Reply(sprintf("Usage: %s%s %s", cc.config.Prefix, cmd.Name, cmd.Usage))
+		default:
+			ctx.Reply(sprintf("%s: %s", player, err.Error()))
+		}
+	}()
+}
+
+// allow applies the rate limit of a player, and warns them the first time
+// that they go over it. Admins are not limited.
+func (cc *ChatCommands) allow(player string, level int) bool {
+	if level >= PermissionAdmin {
+		return true
+	}
+
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	now := time.Now()
+	recent := make([]time.Time, 0)
+	for _, t := range cc.recent[player] {
+		if now.Sub(t) < cc.config.RateWindow.Duration {
+			recent = append(recent, t)
+		}
+	}
+
+	if len(recent) >= cc.config.RateLimit {
+		cc.recent[player] = recent
+		if !cc.warned[player] {
+			cc.warned[player] = true
+			go cc.gs.Console().Say(sprintf("%s: slow down, you are sending commands too quickly", player))
+		}
+		return false
+	}
+
+	cc.recent[player] = append(recent, now)
+	cc.warned[player] = false
+	return true
+}
+
+// cooldown returns how long is left on the cooldown of a command, starting it
+// if there is none
+func (cc *ChatCommands) cooldown(cmd *ChatCommand, player string) time.Duration {
+	if cmd.Cooldown <= 0 {
+		return 0
+	}
+
+	key := cmd.Name + "/" + player
+	if cmd.Global {
+		key = cmd.Name
+	}
+
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	if last, ok := cc.used[key]; ok {
+		if left := cmd.Cooldown - time.Since(last); left > 0 {
+			return left
+		}
+	}
+	cc.used[key] = time.Now()
+	return 0
+}
+
+/*********************/
+/* Built in commands */
+/*********************/
+
+func builtinChatCommands() []*ChatCommand {
+	return []*ChatCommand{
+		{
+			Name:     "help",
+			Aliases:  []string{"commands"},
+			Help:     "List the commands that you can use",
+			Cooldown: 10 * time.Second,
+			Run: func(c *ChatContext) error {
+				names := make([]string, 0)
+				for _, cmd := range c.Commands.Commands(c.Level) {
+					names = append(names, c.Commands.Prefix()+cmd.Name)
+				}
+				c.Reply("Commands: " + strings.Join(names, ", "))
+				return nil
+			},
+		},
+		{
+			Name:     "time",
+			Help:     "Show the time in game",
+			Cooldown: 10 * time.Second,
+			Run: func(c *ChatContext) error {
+				t, err := c.GS.Console().Time()
+				if err != nil {
+					return err
+				}
+				c.Reply("It is " + t.String())
+				return nil
+			},
+		},
+		{
+			Name:     "rules",
+			Help:     "Show the rules of the server",
+			Cooldown: 30 * time.Second,
+			Global:   true,
+			Run: func(c *ChatContext) error {
+				rules := c.Commands.config.Rules
+				if len(rules) == 0 {
+					c.Reply("There are no rules set. Be nice!")
+					return nil
+				}
+				for i, r := range rules {
+					c.Reply(sprintf("%d. %s", i+1, r))
+				}
+				return nil
+			},
+		},
+		{
+			Name:     "restart",
+			Help:     "Restart the server",
+			Level:    PermissionAdmin,
+			Cooldown: 5 * time.Minute,
+			Global:   true,
+			Run: func(c *ChatContext) error {
+				c.Reply(sprintf("%s is restarting the server. Be right back!", c.Player))
+				LogWarning(c.GS, c.Player+" restarted the server from chat", c.GS.WSOutput())
+				return c.GS.Restart()
+			},
+		},
+	}
+}
+
+// RegisterSessionCommands - Add the commands that use the play sessions kept
+// by a DeathTracker
+func (cc *ChatCommands) RegisterSessionCommands(d *DeathTracker) error {
+	seen := &ChatCommand{
+		Name:     "seen",
+		Usage:    "<name>",
+		Help:     "Show when a player was last online",
+		Cooldown: 10 * time.Second,
+		Run: func(c *ChatContext) error {
+			if len(c.Args) == 0 {
+				return errChatUsage
+			}
+
+			name := strings.Join(c.Args, " ")
+			if c.GS.Player(name) != nil {
+				c.Reply(name + " is online now")
+				return nil
+			}
+
+			sessions := d.Sessions(name)
+			if len(sessions) == 0 {
+				c.Reply("I have never seen " + name)
+				return nil
+			}
+
+			last := sessions[len(sessions)-1]
+			c.Reply(sprintf("%s was last seen %s ago", name,
+				time.Since(last.Seen).Round(time.Minute)))
+			return nil
+		},
+	}
+
+	playtime := &ChatCommand{
+		Name:     "playtime",
+		Usage:    "[name]",
+		Help:     "Show how long a player has played for",
+		Cooldown: 10 * time.Second,
+		Run: func(c *ChatContext) error {
+			name := c.Player
+			if len(c.Args) > 0 {
+				name = strings.Join(c.Args, " ")
+			}
+
+			var total time.Duration
+			sessions := d.Sessions(name)
+			for _, s := range sessions {
+				total += s.Duration()
+			}
+
+			c.Reply(sprintf("%s has played for %s over %d sessions", name,
+				total.Round(time.Minute), len(sessions)))
+			return nil
+		},
+	}
+
+	for _, cmd := range []*ChatCommand{seen, playtime} {
+		if err := cc.Register(cmd); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -1,14 +1,20 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
 	"net"
+	"os"
+	"path/filepath"
 	"strconv"
+	"time"
 )
 
 const (
 	defaultPort        = 8080
 	defaultMaxCommands = 500
+	defaultConfigFile  = "terracontrol.json"
+	defaultDataDir     = "data"
 )
 
 // Configuration -
@@ -18,6 +24,67 @@ type Configuration struct {
 
 	hostname  string
 	uriprefix string
+
+	DataDir    string           `json:"datadir"`
+	Backups    BackupConfig     `json:"backups"`
+	Worlds     WorldConfig      `json:"worlds"`
+	Rotation   RotationConfig   `json:"rotation"`
+	Integrity  IntegrityConfig  `json:"integrity"`
+	Triggers   TriggerConfig    `json:"triggers"`
+	Deaths     DeathConfig      `json:"deaths"`
+	Chat       ChatConfig       `json:"chat"`
+	Votes      VoteConfig       `json:"votes"`
+	Reports    ReportConfig     `json:"reports"`
+	Moderation ModerationConfig `json:"moderation"`
+	Ledger     LedgerConfig     `json:"ledger"`
+	Names      NamePolicy       `json:"names"`
+}
+
+// LoadConfiguration - Read the JSON configuration at the given path. A missing
+// file is not an error, and results in the default configuration.
+func LoadConfiguration(path string) (*Configuration, error) {
+	c := &Configuration{}
+
+	b, err := os.ReadFile(path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		return nil, err
+	default:
+		if err := json.Unmarshal(b, c); err != nil {
+			return nil, err
+		}
+	}
+
+	c.setDefaults()
+	return c, nil
+}
+
+// setDefaults fills in any settings that were left empty
+func (c *Configuration) setDefaults() {
+	if c.DataDir == "" {
+		c.DataDir = defaultDataDir
+	}
+
+	if c.Worlds.Directory == "" {
+		c.Worlds.Directory = "worlds"
+	}
+
+	if c.Worlds.Archive == "" {
+		c.Worlds.Archive = filepath.Join(c.Worlds.Directory, "archive")
+	}
+
+	if c.Backups.Directory == "" {
+		c.Backups.Directory = filepath.Join(c.DataDir, "backups")
+	}
+
+	if c.Triggers.File == "" {
+		c.Triggers.File = defaultTriggerFile
+	}
+
+	if c.Moderation.File == "" {
+		c.Moderation.File = defaultModerationFile
+	}
 }
 
 // Port - Return the port in string form (ex :8080)
@@ -51,3 +118,34 @@ func isPortAvailable(p int) bool {
 	_ = l.Close()
 	return true
 }
+
+// Duration is a time.Duration that is written as a string (ex: "1h30m") in the
+// configuration file
+type Duration struct {
+	time.Duration
+}
+
+// UnmarshalJSON - Parse a duration string
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+
+	if s == "" {
+		d.Duration = 0
+		return nil
+	}
+
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
+}
+
+// MarshalJSON - Write the duration as a string
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	responsePlaying = "playing"
+	responseHelp    = "help"
+)
+
+var (
+	respHelpHeader = regexp.MustCompile("^Available commands:$")
+	respHelpEntry  = regexp.MustCompile("^(\\S+(?: \\S+)*?) ?(?:\\.{2,}|-) ?(.+)$")
+)
+
+// ConsoleResponse is the output of a console command that spans several
+// lines, grouped together once the parser has seen all of it
+type ConsoleResponse struct {
+	Command string
+	Lines   []string
+
+	// Complete is false if the response was cut short, for example by the
+	// console prompt appearing before its footer did
+	Complete bool
+
+	// Filled in for "playing"
+	Players []*PlayerData
+	Count   int
+
+	// Filled in for "help", as command -> description
+	Commands map[string]string
+}
+
+// consoleBlock describes how to recognize a multi-line response. A block
+// opens on its header, or on its first entry if it has no header, and closes
+// on its footer. Blocks without a footer close on the first line that is not
+// one of their entries, or when the console prompt is printed again.
+//
+// Blocks without a header could be opened by anything that looks like one of
+// their entries, including chat, so they are requested: they only open while
+// their command has been sent and not yet answered.
+type consoleBlock struct {
+	command   string
+	requested bool
+	header    *regexp.Regexp
+	entry     *regexp.Regexp
+	footer    *regexp.Regexp
+	add       func(*ConsoleResponse, []string)
+	finish    func(*ConsoleResponse, []string)
+}
+
+var consoleBlocks = []*consoleBlock{
+	{
+		command:   responsePlaying,
+		requested: true,
+		entry:     respPlayer,
+		footer:    respPlayers,
+		add: func(r *ConsoleResponse, m []string) {
+			r.Players = append(r.Players, &PlayerData{Name: m[1], IP: m[2]})
+		},
+		finish: func(r *ConsoleResponse, m []string) {
+			r.Count, _ = strconv.Atoi(m[2])
+		},
+	},
+	{
+		command: responseHelp,
+		header:  respHelpHeader,
+		entry:   respHelpEntry,
+		add: func(r *ConsoleResponse, m []string) {
+			r.Commands[m[1]] = m[2]
+		},
+	},
+}
+
+// ConsoleParser classifies Terraria console output while keeping track of
+// whether it is inside of a multi-line response. Lines that belong to a
+// response are kept out of the single line events, which would otherwise
+// misread them.
+type ConsoleParser struct {
+	block *consoleBlock
+	cur   *ConsoleResponse
+
+	// Requested responses that have not been read yet, and when the last
+	// request for each stops being waited on
+	mu       sync.Mutex
+	pending  map[string]int
+	deadline map[string]time.Time
+}
+
+// NewConsoleParser -
+func NewConsoleParser() *ConsoleParser {
+	return &ConsoleParser{
+		pending:  make(map[string]int),
+		deadline: make(map[string]time.Time),
+	}
+}
+
+// Expect - Note that a command has been sent to Terraria, so that its response
+// is read as one if it has to be requested. Expect must be called before the
+// command is written, and is safe to call while another goroutine parses.
+func (p *ConsoleParser) Expect(cmd string) {
+	f := strings.Fields(cmd)
+	if len(f) == 0 {
+		return
+	}
+
+	for _, b := range consoleBlocks {
+		if b.requested && b.command == f[0] {
+			p.mu.Lock()
+			p.pending[b.command]++
+			p.deadline[b.command] = time.Now().Add(commandTimeout)
+			p.mu.Unlock()
+			return
+		}
+	}
+}
+
+// Parse - Feed a line of output to the parser. Returns the line without the
+// console prompt, any responses that the line completed, and whether the line
+// was part of a response (and so should not be treated as an event).
+func (p *ConsoleParser) Parse(line string) (string, []*ConsoleResponse, bool) {
+	line, prompt := stripPrompt(line)
+	done := make([]*ConsoleResponse, 0)
+
+	// The prompt is printed once a command has finished, so anything that is
+	// still open has ended. That is only expected for blocks without a footer.
+	if prompt && p.cur != nil {
+		done = append(done, p.close(nil, p.block.footer == nil))
+	}
+
+	if p.cur != nil {
+		b := p.block
+		switch {
+		case b.footer != nil && b.footer.MatchString(line):
+			p.cur.Lines = append(p.cur.Lines, line)
+			return line, append(done, p.close(b.footer.FindStringSubmatch(line), true)), true
+
+		case b.entry.MatchString(line):
+			p.cur.Lines = append(p.cur.Lines, line)
+			b.add(p.cur, b.entry.FindStringSubmatch(line))
+			return line, done, true
+
+		case line == "" && b.footer == nil:
+			return line, done, true
+
+		case b.footer == nil:
+			done = append(done, p.close(nil, true))
+
+		default:
+			// A response with a footer was interrupted by unrelated output,
+			// which can happen when the server logs something mid-command.
+			return line, done, false
+		}
+	}
+
+	for _, b := range consoleBlocks {
+		if b.requested && !p.outstanding(b.command) {
+			continue
+		}
+
+		switch {
+		case b.header != nil && b.header.MatchString(line):
+			p.open(b, line)
+			return line, done, true
+
+		case b.header == nil && b.footer != nil && b.footer.MatchString(line):
+			p.open(b, line)
+			return line, append(done, p.close(b.footer.FindStringSubmatch(line), true)), true
+
+		case b.header == nil && b.entry.MatchString(line):
+			p.open(b, line)
+			b.add(p.cur, b.entry.FindStringSubmatch(line))
+			return line, done, true
+		}
+	}
+
+	return line, done, false
+}
+
+// Reset - Drop any partially read response
+func (p *ConsoleParser) Reset() {
+	p.block = nil
+	p.cur = nil
+}
+
+func (p *ConsoleParser) open(b *consoleBlock, line string) {
+	p.block = b
+	p.cur = &ConsoleResponse{
+		Command:  b.command,
+		Lines:    []string{line},
+		Players:  make([]*PlayerData, 0),
+		Count:    -1,
+		Commands: make(map[string]string),
+	}
+}
+
+func (p *ConsoleParser) close(footer []string, complete bool) *ConsoleResponse {
+	r := p.cur
+	r.Complete = complete
+	if footer != nil && p.block.finish != nil {
+		p.block.finish(r, footer)
+	}
+
+	if p.block.requested {
+		p.mu.Lock()
+		if p.pending[r.Command] > 0 {
+			p.pending[r.Command]--
+		}
+		p.mu.Unlock()
+	}
+
+	p.Reset()
+	return r
+}
+
+// outstanding returns true if a requested response has been sent for and not
+// yet read. Requests that Terraria never answered are dropped once they time
+// out.
+func (p *ConsoleParser) outstanding(cmd string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.pending[cmd] > 0 && time.Now().After(p.deadline[cmd]) {
+		p.pending[cmd] = 0
+	}
+	return p.pending[cmd] > 0
+}
+
+// stripPrompt removes the ": " prompt that Terraria prints at the start of a
+// line once it is ready for input. Terraria sometimes throws extras, so just
+// loop until theyre all gone.
+func stripPrompt(line string) (string, bool) {
+	prompt := false
+	for strings.HasPrefix(line, ":") {
+		line = strings.TrimSpace(strings.TrimPrefix(line, ":"))
+		prompt = true
+	}
+	return line, prompt
+}
@@ -0,0 +1,63 @@
+package main
+
+import "testing"
+
+func TestConsoleParserPlaying(t *testing.T) {
+	p := NewConsoleParser()
+	p.Expect("playing")
+
+	lines := []string{
+		": Eve (1.2.3.4:7777)",
+		"Bob Smith (5.6.7.8:7777)",
+		"2 players connected.",
+	}
+
+	var res []*ConsoleResponse
+	for _, l := range lines {
+		_, done, grouped := p.Parse(l)
+		if !grouped {
+			t.Errorf("%q was not read as part of the response", l)
+		}
+		res = append(res, done...)
+	}
+
+	switch {
+	case len(res) != 1:
+		t.Fatalf("got %d responses, expected 1", len(res))
+	case !res[0].Complete || res[0].Count != 2 || len(res[0].Players) != 2:
+		t.Fatalf("got an incomplete response: %+v", res[0])
+	case res[0].Players[0].Name != "Eve" || res[0].Players[1].IP != "5.6.7.8":
+		t.Errorf("misread the players: %s, %s", res[0].Players[0].Name, res[0].Players[1].IP)
+	}
+}
+
+func TestConsoleParserUnrequestedPlaying(t *testing.T) {
+	p := NewConsoleParser()
+
+	// Chat and player lists that nobody asked for are ordinary output
+	for _, l := range []string{"<Eve> buy gold (1.2.3.4:7777)", "Eve (1.2.3.4:7777)", "1 player connected."} {
+		if _, done, grouped := p.Parse(l); grouped || len(done) > 0 {
+			t.Errorf("%q was read as a response", l)
+		}
+	}
+}
+
+func TestConsoleParserChatDuringPlaying(t *testing.T) {
+	p := NewConsoleParser()
+	p.Expect("playing")
+
+	p.Parse("Eve (1.2.3.4:7777)")
+	if _, _, grouped := p.Parse("<Eve> buy gold (1.2.3.4:7777)"); grouped {
+		t.Error("chat was read as part of the response")
+	}
+
+	_, done, _ := p.Parse("1 player connected.")
+	if len(done) != 1 || len(done[0].Players) != 1 || done[0].Players[0].Name != "Eve" {
+		t.Fatalf("chat was added to the player list: %+v", done)
+	}
+
+	// The request has been answered, so the parser stops looking for one
+	if _, _, grouped := p.Parse("Mallory (1.2.3.4:7777)"); grouped {
+		t.Error("a response was read after the request was answered")
+	}
+}
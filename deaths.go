@@ -0,0 +1,459 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	deathStateFile           = "deaths.json"
+	deathCheckInterval       = time.Minute
+	defaultDeathAnnounceTime = "20:00"
+	defaultDeathRetention    = 90 * 24 * time.Hour
+
+	// Players need this much playtime before they are ranked by deaths per
+	// hour, so that a single early death does not top the board
+	minLeaderboardPlaytime = 10 * time.Minute
+)
+
+// DeathConfig configures death tracking. When AnnounceDaily is set, the player
+// with the most deaths that day is announced in chat at AnnounceAt (ex: 20:00).
+// Deaths and sessions older than Retention (90 days by default) are dropped.
+type DeathConfig struct {
+	AnnounceDaily bool     `json:"announce_daily"`
+	AnnounceAt    string   `json:"announce_at"`
+	Retention     Duration `json:"retention"`
+}
+
+// DeathRecord is a single death of a player
+type DeathRecord struct {
+	Player  string
+	Cause   string
+	Time    time.Time
+	Session int
+}
+
+// PlaySession is a stretch of time that a player was connected. Seen is the
+// last time that they were known to be connected, which is used to close
+// sessions that were left open when TerraControl stopped.
+type PlaySession struct {
+	ID     int
+	Player string
+	Start  time.Time
+	End    time.Time
+	Seen   time.Time
+	Deaths int
+}
+
+// Duration returns how long the session has lasted
+func (s *PlaySession) Duration() time.Duration {
+	if s.End.IsZero() {
+		return time.Since(s.Start)
+	}
+	return s.End.Sub(s.Start)
+}
+
+// LeaderboardEntry is a row of a leaderboard
+type LeaderboardEntry struct {
+	Name     string
+	Deaths   int
+	Playtime Duration
+	PerHour  float64
+}
+
+// Leaderboards are the death leaderboards over a period of time
+type Leaderboards struct {
+	Since        time.Time
+	MostDeaths   []*LeaderboardEntry
+	TopCauses    []*LeaderboardEntry
+	DeathsByHour []*LeaderboardEntry
+}
+
+// deathState is what is saved between runs
+type deathState struct {
+	Deaths      []*DeathRecord
+	Sessions    []*PlaySession
+	NextSession int    // ID of the next session, since old ones are dropped
+	Announced   string // Date of the last daily announcement
+}
+
+// DeathTracker records the deaths and play sessions of the players of a
+// GameServer
+type DeathTracker struct {
+	gs     GameServer
+	config DeathConfig
+	state  string
+
+	mu    sync.Mutex
+	data  *deathState
+	dirty bool // Changed since the last save
+	open  map[string]*PlaySession
+	close chan struct{}
+}
+
+// NewDeathTracker returns a DeathTracker and loads the deaths and sessions
+// saved in datadir. Sessions left open by a previous run are closed at the
+// time that their player was last seen.
+func NewDeathTracker(gs GameServer, c DeathConfig, datadir string) (*DeathTracker, error) {
+	if c.AnnounceAt == "" {
+		c.AnnounceAt = defaultDeathAnnounceTime
+	}
+	if _, err := time.Parse(timeOfDayLayout, c.AnnounceAt); err != nil {
+		return nil, errors.New("invalid death announcement time: " + err.Error())
+	}
+	if c.Retention.Duration <= 0 {
+		c.Retention.Duration = defaultDeathRetention
+	}
+
+	d := &DeathTracker{
+		gs:     gs,
+		config: c,
+		state:  filepath.Join(datadir, deathStateFile),
+		data:   &deathState{Deaths: make([]*DeathRecord, 0), Sessions: make([]*PlaySession, 0)},
+		open:   make(map[string]*PlaySession),
+		close:  make(chan struct{}),
+	}
+
+	if err := loadJSON(d.state, d.data); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	for _, s := range d.data.Sessions {
+		if s.End.IsZero() {
+			s.End = s.Seen
+		}
+		if s.ID >= d.data.NextSession {
+			d.data.NextSession = s.ID + 1
+		}
+	}
+	d.expire(time.Now())
+	return d, nil
+}
+
+// Start follows the events of the GameServer until Stop is called
+func (d *DeathTracker) Start() {
+	sub := d.gs.Bus().Subscribe("deaths", 0,
+		EventKinds("PlayerDeath", "PlayerJoined", "PlayerLeft", "PlayerList"))
+	defer d.gs.Bus().Unsubscribe(sub)
+
+	t := time.NewTicker(deathCheckInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-d.close:
+			d.mu.Lock()
+			d.endAll(time.Now())
+			d.mu.Unlock()
+			return
+
+		case ev := <-sub.C:
+			d.handle(ev)
+
+		case now := <-t.C:
+			d.mu.Lock()
+			// Sessions can not outlive the server
+			if !d.gs.IsUp() {
+				d.endAll(now)
+			}
+			d.expire(now)
+			if d.dirty {
+				d.save()
+			}
+			d.mu.Unlock()
+			d.announce(now)
+		}
+	}
+}
+
+// Stop ends death tracking, and closes any open sessions
+func (d *DeathTracker) Stop() {
+	close(d.close)
+}
+
+// Deaths returns the deaths of a player, or of everyone if name is empty,
+// oldest first
+func (d *DeathTracker) Deaths(name string) []*DeathRecord {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	res := make([]*DeathRecord, 0)
+	for _, r := range d.data.Deaths {
+		if name == "" || r.Player == name {
+			res = append(res, r)
+		}
+	}
+	return res
+}
+
+// Sessions returns copies of the play sessions of a player, oldest first
+func (d *DeathTracker) Sessions(name string) []*PlaySession {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	res := make([]*PlaySession, 0)
+	for _, s := range d.data.Sessions {
+		if s.Player == name {
+			c := *s
+			res = append(res, &c)
+		}
+	}
+	return res
+}
+
+// Leaderboards returns the leaderboards for deaths since the given time, or
+// since the oldest death kept, with up to limit entries each. A limit of zero or less returns every entry.
+func (d *DeathTracker) Leaderboards(since time.Time, limit int) *Leaderboards {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	deaths := make(map[string]int)
+	causes := make(map[string]int)
+	for _, r := range d.data.Deaths {
+		if r.Time.Before(since) {
+			continue
+		}
+		deaths[r.Player]++
+		causes[r.Cause]++
+	}
+
+	playtime := make(map[string]time.Duration)
+	for _, s := range d.data.Sessions {
+		start := s.Start
+		if start.Before(since) {
+			start = since
+		}
+
+		end := s.End
+		if end.IsZero() {
+			end = time.Now()
+		}
+
+		if end.After(start) {
+			playtime[s.Player] += end.Sub(start)
+		}
+	}
+
+	lb := &Leaderboards{
+		Since:        since,
+		MostDeaths:   make([]*LeaderboardEntry, 0),
+		TopCauses:    make([]*LeaderboardEntry, 0),
+		DeathsByHour: make([]*LeaderboardEntry, 0),
+	}
+
+	for name, n := range deaths {
+		lb.MostDeaths = append(lb.MostDeaths, &LeaderboardEntry{
+			Name:     name,
+			Deaths:   n,
+			Playtime: Duration{playtime[name].Round(time.Second)},
+		})
+
+		if pt := playtime[name]; pt >= minLeaderboardPlaytime {
+			lb.DeathsByHour = append(lb.DeathsByHour, &LeaderboardEntry{
+				Name:     name,
+				Deaths:   n,
+				Playtime: Duration{pt.Round(time.Second)},
+				PerHour:  float64(n) / pt.Hours(),
+			})
+		}
+	}
+
+	for cause, n := range causes {
+		lb.TopCauses = append(lb.TopCauses, &LeaderboardEntry{Name: cause, Deaths: n})
+	}
+
+	sortLeaderboard(lb.MostDeaths, func(e *LeaderboardEntry) float64 { return float64(e.Deaths) })
+	sortLeaderboard(lb.TopCauses, func(e *LeaderboardEntry) float64 { return float64(e.Deaths) })
+	sortLeaderboard(lb.DeathsByHour, func(e *LeaderboardEntry) float64 { return e.PerHour })
+
+	if limit > 0 {
+		lb.MostDeaths = truncateLeaderboard(lb.MostDeaths, limit)
+		lb.TopCauses = truncateLeaderboard(lb.TopCauses, limit)
+		lb.DeathsByHour = truncateLeaderboard(lb.DeathsByHour, limit)
+	}
+	return lb
+}
+
+// handle updates the deaths and sessions from an event. The state is saved
+// when a session starts or ends or a player dies, and otherwise once a minute
+// so that players being seen does not rewrite it on every player list.
+func (d *DeathTracker) handle(ev Event) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := ev.When()
+	changed := false
+	switch ev := ev.(type) {
+	case *PlayerJoined:
+		_, changed = d.begin(ev.Name, now)
+
+	case *PlayerLeft:
+		changed = d.end(ev.Name, now)
+
+	case *PlayerList:
+		listed := make(map[string]bool)
+		for _, p := range ev.Players {
+			listed[p.Name] = true
+			if _, started := d.begin(p.Name, now); started {
+				changed = true
+			}
+		}
+		for name := range d.open {
+			if !listed[name] && d.end(name, now) {
+				changed = true
+			}
+		}
+
+	case *PlayerDeath:
+		s, _ := d.begin(ev.Name, now)
+		s.Deaths++
+		d.data.Deaths = append(d.data.Deaths, &DeathRecord{
+			Player:  ev.Name,
+			Cause:   ev.Cause,
+			Time:    now,
+			Session: s.ID,
+		})
+		changed = true
+	}
+
+	if changed {
+		d.save()
+	}
+}
+
+// begin returns the open session of a player, starting one if there is none,
+// and whether one was started. Expects d.mu to be held.
+func (d *DeathTracker) begin(name string, now time.Time) (*PlaySession, bool) {
+	s, ok := d.open[name]
+	if !ok {
+		if d.data.NextSession < 1 {
+			d.data.NextSession = 1
+		}
+		s = &PlaySession{ID: d.data.NextSession, Player: name, Start: now}
+		d.data.NextSession++
+		d.data.Sessions = append(d.data.Sessions, s)
+		d.open[name] = s
+	}
+	s.Seen = now
+	d.dirty = true
+	return s, !ok
+}
+
+// end closes the open session of a player, returning false if they had none.
+// Expects d.mu to be held.
+func (d *DeathTracker) end(name string, now time.Time) bool {
+	s, ok := d.open[name]
+	if ok {
+		s.End = now
+		s.Seen = now
+		delete(d.open, name)
+	}
+	return ok
+}
+
+// expire drops the deaths and the closed sessions that are older than the
+// retention period. Expects d.mu to be held.
+func (d *DeathTracker) expire(now time.Time) {
+	cutoff := now.Add(-d.config.Retention.Duration)
+
+	deaths := d.data.Deaths[:0]
+	for _, r := range d.data.Deaths {
+		if !r.Time.Before(cutoff) {
+			deaths = append(deaths, r)
+		}
+	}
+
+	sessions := d.data.Sessions[:0]
+	for _, s := range d.data.Sessions {
+		if s.End.IsZero() || !s.End.Before(cutoff) {
+			sessions = append(sessions, s)
+		}
+	}
+
+	if len(deaths) < len(d.data.Deaths) || len(sessions) < len(d.data.Sessions) {
+		d.data.Deaths = deaths
+		d.data.Sessions = sessions
+		d.dirty = true
+	}
+}
+
+// endAll closes every open session. Expects d.mu to be held.
+func (d *DeathTracker) endAll(now time.Time) {
+	if len(d.open) == 0 {
+		return
+	}
+	for name := range d.open {
+		d.end(name, now)
+	}
+	d.save()
+}
+
+// announce names the player with the most deaths today, once a day at the
+// configured time
+func (d *DeathTracker) announce(now time.Time) {
+	if !d.config.AnnounceDaily || !d.gs.IsUp() {
+		return
+	}
+
+	at, _ := time.Parse(timeOfDayLayout, d.config.AnnounceAt)
+	if now.Hour()*60+now.Minute() < at.Hour()*60+at.Minute() {
+		return
+	}
+
+	today := now.Format("2006-01-02")
+	d.mu.Lock()
+	done := d.data.Announced == today
+	d.mu.Unlock()
+	if done {
+		return
+	}
+
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	lb := d.Leaderboards(midnight, 1)
+
+	d.mu.Lock()
+	d.data.Announced = today
+	d.save()
+	d.mu.Unlock()
+
+	if len(lb.MostDeaths) == 0 {
+		return
+	}
+
+	top := lb.MostDeaths[0]
+	msg := sprintf("Today's most frequent visitor to the afterlife is %s, with %d deaths!",
+		top.Name, top.Deaths)
+	if err := d.gs.Console().Say(msg); err != nil {
+		LogWarning(d.gs, "Unable to announce the daily death leader: "+err.Error())
+	}
+}
+
+// save writes the deaths and sessions to disk. Expects d.mu to be held.
+func (d *DeathTracker) save() {
+	if err := saveJSON(d.state, d.data); err != nil {
+		LogError(d.gs, "Unable to save deaths: "+err.Error())
+		return
+	}
+	d.dirty = false
+}
+
+// sortLeaderboard sorts entries by a value, highest first, and then by name
+func sortLeaderboard(e []*LeaderboardEntry, value func(*LeaderboardEntry) float64) {
+	sort.SliceStable(e, func(i, j int) bool {
+		if value(e[i]) != value(e[j]) {
+			return value(e[i]) > value(e[j])
+		}
+		return e[i].Name < e[j].Name
+	})
+}
+
+func truncateLeaderboard(e []*LeaderboardEntry, limit int) []*LeaderboardEntry {
+	if len(e) > limit {
+		return e[:limit]
+	}
+	return e
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const defaultSubscriberBuffer = 64
+
+// Event is a typed event that was parsed from the output of a GameServer
+type Event interface {
+	Kind() string
+	When() time.Time
+	Raw() string
+}
+
+// EventHeader holds the details that every Event shares, and is embedded in
+// each of them
+type EventHeader struct {
+	Time time.Time
+	Line string
+}
+
+// When - Return the time that the event was read
+func (h EventHeader) When() time.Time { return h.Time }
+
+// Raw - Return the output that the event was parsed from
+func (h EventHeader) Raw() string { return h.Line }
+
+func newEventHeader(line string) EventHeader {
+	return EventHeader{Time: time.Now(), Line: line}
+}
+
+// ConnectionAttempt - An IP address has started connecting
+type ConnectionAttempt struct {
+	EventHeader
+	IP string
+}
+
+// PlayerJoined - A player has finished joining
+type PlayerJoined struct {
+	EventHeader
+	Name string
+}
+
+// PlayerLeft - A player has left
+type PlayerLeft struct {
+	EventHeader
+	Name string
+}
+
+// PlayerList - The players that Terraria listed as connected
+type PlayerList struct {
+	EventHeader
+	Players []*PlayerData
+}
+
+// Chat - A player has said something
+type Chat struct {
+	EventHeader
+	Name    string
+	Message string
+}
+
+// Booted - A connection was refused or dropped
+type Booted struct {
+	EventHeader
+	IP     string
+	Reason string
+}
+
+// Banned - A connection was refused because it is banned
+type Banned struct {
+	EventHeader
+	IP     string
+	Reason string
+}
+
+// ServerInfo - The server reported one of its settings (seed, motd, password,
+// version or time)
+type ServerInfo struct {
+	EventHeader
+	Key   string
+	Value string
+}
+
+// WorldSaving - The server is writing its world
+type WorldSaving struct {
+	EventHeader
+	Stage string
+}
+
+// BossSummoned - A boss has awoken
+type BossSummoned struct {
+	EventHeader
+	Boss string
+}
+
+// BossDefeated - A boss has been defeated
+type BossDefeated struct {
+	EventHeader
+	Boss string
+}
+
+// Invasion - An invasion is approaching, has arrived, or has been defeated.
+// Direction is only set while it is approaching.
+type Invasion struct {
+	EventHeader
+	Invasion  string
+	Stage     string
+	Direction string
+}
+
+// WorldEvent - Something has happened to the world, such as a Blood Moon
+// rising or hardmode starting
+type WorldEvent struct {
+	EventHeader
+	Name string
+}
+
+// PlayerDeath - A player has died
+type PlayerDeath struct {
+	EventHeader
+	Name  string
+	Cause string
+}
+
+// PlayerModerated - A player was warned, kicked, banned, reported or noted.
+// These are published by TerraControl rather than parsed from output, and
+// By is whoever was responsible (empty for the server itself).
+type PlayerModerated struct {
+	EventHeader
+	Name   string
+	Action string
+	By     string
+	Reason string
+	Until  time.Time // End of a temporary ban
+}
+
+// ConsoleOutput - Output that did not match any other event
+type ConsoleOutput struct {
+	EventHeader
+}
+
+// Kind - Return the name of the event
+func (ConnectionAttempt) Kind() string { return "ConnectionAttempt" }
+
+// Kind - Return the name of the event
+func (PlayerJoined) Kind() string { return "PlayerJoined" }
+
+// Kind - Return the name of the event
+func (PlayerLeft) Kind() string { return "PlayerLeft" }
+
+// Kind - Return the name of the event
+func (PlayerList) Kind() string { return "PlayerList" }
+
+// Kind - Return the name of the event
+func (Chat) Kind() string { return "Chat" }
+
+// Kind - Return the name of the event
+func (Booted) Kind() string { return "Booted" }
+
+// Kind - Return the name of the event
+func (Banned) Kind() string { return "Banned" }
+
+// Kind - Return the name of the event
+func (ServerInfo) Kind() string { return "ServerInfo" }
+
+// Kind - Return the name of the event
+func (WorldSaving) Kind() string { return "WorldSaving" }
+
+// Kind - Return the name of the event
+func (BossSummoned) Kind() string { return "BossSummoned" }
+
+// Kind - Return the name of the event
+func (BossDefeated) Kind() string { return "BossDefeated" }
+
+// Kind - Return the name of the event
+func (Invasion) Kind() string { return "Invasion" }
+
+// Kind - Return the name of the event
+func (WorldEvent) Kind() string { return "WorldEvent" }
+
+// Kind - Return the name of the event
+func (PlayerDeath) Kind() string { return "PlayerDeath" }
+
+// Kind - Return the name of the event
+func (PlayerModerated) Kind() string { return "PlayerModerated" }
+
+// Kind - Return the name of the event
+func (ConsoleOutput) Kind() string { return "ConsoleOutput" }
+
+// EventFilter decides whether a subscriber receives an event
+type EventFilter func(Event) bool
+
+// EventKinds - Return a filter that accepts the given kinds of event
+func EventKinds(kinds ...string) EventFilter {
+	want := make(map[string]bool)
+	for _, k := range kinds {
+		want[k] = true
+	}
+	return func(e Event) bool { return want[e.Kind()] }
+}
+
+// Subscription is a subscriber to an EventBus. Events are received on C,
+// which is closed once the subscription is removed.
+type Subscription struct {
+	dropped int64 // Accessed atomically, kept first for alignment
+
+	C <-chan Event
+
+	name   string
+	filter EventFilter
+	ch     chan Event
+}
+
+// Dropped - Return the number of events that were dropped because the
+// subscriber was not keeping up
+func (s *Subscription) Dropped() int64 {
+	return atomic.LoadInt64(&s.dropped)
+}
+
+// EventBus delivers the events of a GameServer to any number of subscribers.
+// Delivery never blocks, so a slow subscriber can not hold up the reading of
+// the console. Events that do not fit in a subscribers buffer are dropped for
+// that subscriber.
+type EventBus struct {
+	mu    sync.RWMutex
+	owner Loggable
+	subs  []*Subscription
+}
+
+// NewEventBus -
+func NewEventBus(owner Loggable) *EventBus {
+	return &EventBus{owner: owner, subs: make([]*Subscription, 0)}
+}
+
+// Subscribe - Add a subscriber that receives the events accepted by filter.
+// A nil filter accepts every event, and a size of zero or less uses the
+// default buffer size.
+func (b *EventBus) Subscribe(name string, size int, filter EventFilter) *Subscription {
+	if size <= 0 {
+		size = defaultSubscriberBuffer
+	}
+
+	ch := make(chan Event, size)
+	s := &Subscription{C: ch, name: name, filter: filter, ch: ch}
+
+	b.mu.Lock()
+	b.subs = append(b.subs, s)
+	b.mu.Unlock()
+
+	LogDebug(b.owner, "Event subscriber added: "+name)
+	return s
+}
+
+// Handle - Subscribe and call f for every event that is received, in its own
+// goroutine. The subscriber stops once it is unsubscribed.
+func (b *EventBus) Handle(name string, filter EventFilter, f func(Event)) *Subscription {
+	s := b.Subscribe(name, 0, filter)
+	go func() {
+		for e := range s.C {
+			f(e)
+		}
+	}()
+	return s
+}
+
+// Unsubscribe - Remove a subscriber and close its channel
+func (b *EventBus) Unsubscribe(s *Subscription) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for i, v := range b.subs {
+		if v == s {
+			b.subs = append(b.subs[:i], b.subs[i+1:]...)
+			close(s.ch)
+			LogDebug(b.owner, "Event subscriber removed: "+s.name)
+			return
+		}
+	}
+}
+
+// Publish - Deliver an event to every subscriber that accepts it
+func (b *EventBus) Publish(e Event) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	for _, s := range b.subs {
+		if s.filter != nil && !s.filter(e) {
+			continue
+		}
+
+		select {
+		case s.ch <- e:
+		default:
+			n := atomic.AddInt64(&s.dropped, 1)
+			if n == 1 || n%100 == 0 {
+				LogWarning(b.owner, sprintf("Event subscriber %s is falling behind, %d events dropped",
+					s.name, n))
+			}
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+const defaultEventLogSize = 500
+
+// ServerEvent is an entry in the event log of a GameServer
+type ServerEvent struct {
+	Time    time.Time
+	Kind    string
+	Message string
+}
+
+// EventLog keeps the most recent notable events of a GameServer, such as
+// integrity problems with its world. If a path has been loaded the log is
+// saved there after every change.
+type EventLog struct {
+	mu     sync.Mutex
+	events []*ServerEvent
+	max    int
+	path   string
+}
+
+// NewEventLog returns an empty EventLog that holds up to max events
+func NewEventLog(max int) *EventLog {
+	if max <= 0 {
+		max = defaultEventLogSize
+	}
+	return &EventLog{events: make([]*ServerEvent, 0), max: max}
+}
+
+// Load reads the events saved at path, and saves future events there
+func (l *EventLog) Load(path string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.path = path
+	events := make([]*ServerEvent, 0)
+	if err := loadJSON(path, &events); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	l.events = append(events, l.events...)
+	l.trim()
+	return nil
+}
+
+// Add records an event
+func (l *EventLog) Add(kind, msg string) *ServerEvent {
+	e := &ServerEvent{Time: time.Now(), Kind: kind, Message: msg}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.events = append(l.events, e)
+	l.trim()
+
+	if l.path != "" {
+		if err := saveJSON(l.path, l.events); err != nil {
+			log.Output(1, "Unable to save event log: "+err.Error())
+		}
+	}
+	return e
+}
+
+// Events returns up to n of the most recent events, oldest first. If n is zero
+// every event is returned.
+func (l *EventLog) Events(n int) []*ServerEvent {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if n <= 0 || n > len(l.events) {
+		n = len(l.events)
+	}
+	return append([]*ServerEvent{}, l.events[len(l.events)-n:]...)
+}
+
+// trim drops the oldest events past the maximum. Expects l.mu to be held.
+func (l *EventLog) trim() {
+	if len(l.events) > l.max {
+		l.events = append([]*ServerEvent{}, l.events[len(l.events)-l.max:]...)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"regexp/syntax"
+	"strings"
+)
+
+// literalFilter holds literal text that any match of an events Regexp has to
+// contain. Checking it is far cheaper than running the Regexp, so most events
+// are ruled out for a line without running their Regexp at all.
+type literalFilter struct {
+	prefix   string // Anchored to the start of the line
+	suffix   string // Anchored to the end of the line
+	contains string // Anywhere in the line
+}
+
+// newLiteralFilter works out the literals that a pattern requires. Only the
+// top level of the pattern is looked at, and anything that is not understood
+// results in an empty filter, which lets every line through to the Regexp.
+func newLiteralFilter(pattern string) *literalFilter {
+	f := &literalFilter{}
+
+	re, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil {
+		return f
+	}
+
+	re = re.Simplify()
+	if re.Op != syntax.OpConcat || len(re.Sub) == 0 {
+		return f
+	}
+
+	subs := re.Sub
+	literal := func(r *syntax.Regexp) (string, bool) {
+		if r.Op != syntax.OpLiteral || r.Flags&syntax.FoldCase != 0 {
+			return "", false
+		}
+		return string(r.Rune), true
+	}
+
+	if subs[0].Op == syntax.OpBeginText && len(subs) > 1 {
+		if l, ok := literal(subs[1]); ok {
+			f.prefix = l
+		}
+	}
+
+	if n := len(subs); subs[n-1].Op == syntax.OpEndText && n > 1 {
+		if l, ok := literal(subs[n-2]); ok {
+			f.suffix = l
+		}
+	}
+
+	for _, sub := range subs {
+		if l, ok := literal(sub); ok && len(l) > len(f.contains) {
+			f.contains = l
+		}
+	}
+
+	// Already checked
+	if f.contains == f.prefix || f.contains == f.suffix {
+		f.contains = ""
+	}
+	return f
+}
+
+// allows returns false if the line can not possibly match
+func (f *literalFilter) allows(in string) bool {
+	return strings.HasPrefix(in, f.prefix) &&
+		strings.HasSuffix(in, f.suffix) &&
+		strings.Contains(in, f.contains)
+}
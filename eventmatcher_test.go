@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"testing"
+)
+
+// loadConsoleCorpus reads the recorded console output in testdata
+func loadConsoleCorpus(tb testing.TB) []string {
+	f, err := os.Open("testdata/console.txt")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer f.Close()
+
+	lines := make([]string, 0)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		tb.Fatal(err)
+	}
+	return lines
+}
+
+// matchSequential matches a line the way that events were matched before
+// they were prefiltered: every Regexp is run in turn until one matches, and
+// the one that matched is then run again for its submatches
+func matchSequential(events []*GameEvent, fallback *GameEvent, in string) (*GameEvent, []string) {
+	for _, e := range events {
+		if e.Capture.MatchString(in) {
+			return e, e.Capture.FindStringSubmatch(in)
+		}
+	}
+	return fallback, []string{in}
+}
+
+func TestEventMatchCorpus(t *testing.T) {
+	r := NewTerrariaEventRegistry()
+	events := r.Events()
+	for _, l := range loadConsoleCorpus(t) {
+		want, _ := matchSequential(events, r.fallback, l)
+		if got, _ := r.Match(l); got != want {
+			t.Errorf("%q matched %s, expected %s", l, got.Name(), want.Name())
+		}
+	}
+}
+
+func BenchmarkEventMatch(b *testing.B) {
+	lines := loadConsoleCorpus(b)
+	r := NewTerrariaEventRegistry()
+	events := r.Events()
+
+	b.Run("Sequential", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for _, l := range lines {
+				matchSequential(events, r.fallback, l)
+			}
+		}
+	})
+
+	b.Run("Prefiltered", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for _, l := range lines {
+				r.Match(l)
+			}
+		}
+	})
+}
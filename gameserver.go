@@ -2,11 +2,16 @@ package main
 
 import (
 	"net"
-	"regexp"
+	"time"
+)
+
+const (
+	stopMethodSave   = "exit"
+	stopMethodNoSave = "exit-nosave"
+	stopMethodKilled = "killed"
 )
 
 var gameServers []GameServer
-var illegalNamesRe []*regexp.Regexp
 
 // GameServer - A GameServer describes an interface to a full GameServer
 type GameServer interface {
@@ -19,6 +24,14 @@ type GameServer interface {
 	PasswordLockable
 	Seeded
 	Websocketer
+	WorldSaver
+	WorldSelector
+	EventLogger
+	EventPublisher
+	EventParser
+	NameRestricter
+	Moderated
+	Console() GameConsole
 }
 
 // GameData is a datastructure that represents the current state of a GameServer
@@ -32,6 +45,8 @@ type GameData struct {
 	PlayerCount int
 	Loglevel    int
 	Version     string
+	World       *WorldInfo
+	Events      []*ServerEvent
 }
 
 // OutputSender sends output from a GameServer to a channel
@@ -45,6 +60,7 @@ type Playable interface {
 	Players() []Player
 	NewPlayer(string, string) Player
 	RemovePlayer(string) bool
+	PlayerJoining(string)
 }
 
 // Player - Define a player than can join a server and has various details
@@ -71,6 +87,66 @@ type Server interface {
 	Stop() error
 	Start() error
 	Restart() error
+	Shutdown(bool) (*StopReport, error)
+}
+
+// StopReport describes how a server was brought down. Method is the path that
+// was taken, and is one of exit, exit-nosave or killed.
+type StopReport struct {
+	Method  string
+	Saved   bool
+	Backup  string
+	Elapsed time.Duration
+	Error   string
+}
+
+// EventPublisher is an interface to an object that publishes typed events
+// that other subsystems can subscribe to
+type EventPublisher interface {
+	Bus() *EventBus
+}
+
+// EventParser is an interface to an object that parses its output using an
+// EventRegistry
+type EventParser interface {
+	Events() *EventRegistry
+	SetEvents(*EventRegistry)
+}
+
+// NameRestricter is an interface to an object that keeps a list of names that
+// its players may not use
+type NameRestricter interface {
+	IllegalNames() *IllegalNames
+}
+
+// Moderated is an interface to an object that keeps a ledger of what was done
+// to its players, and a banlist that players can be removed from
+type Moderated interface {
+	Ledger() *ModerationLedger
+	SetLedger(*ModerationLedger)
+	RemoveBan(string) (bool, error)
+}
+
+// EventLogger is an interface to an object that keeps a log of notable events
+type EventLogger interface {
+	EventLog() *EventLog
+}
+
+// WorldSelector is an interface to an object that can change the world that it
+// loads
+type WorldSelector interface {
+	SetWorld(string, *WorldOptions)
+	SelectedWorld() string
+	PendingWorld() *WorldOptions
+}
+
+// WorldSaver is an interface to an object that can save its world to disk and
+// confirm that the save has completed
+type WorldSaver interface {
+	WorldFile() string
+	SaveWorld(time.Duration) error
+	WorldSaving(string)
+	ConfirmWorldSave()
 }
 
 // Websocketer is an object that is able to output to the Guis websocket ub
@@ -108,24 +184,55 @@ type Commandable interface {
 	CommandCount() (int, int)
 }
 
-// SendCommand - Send a command to a Commandable() object
-func SendCommand(s string, cs Commandable) {
-	cs.EnqueueCommand(s)
+// GameConsole is a typed interface to the console commands of a GameServer.
+// Implementations validate and sanitize the arguments they are given.
+type GameConsole interface {
+	Say(string) error
+	Kick(string) error
+	Ban(string) error
+	Password() (string, error)
+	SetPassword(string) (string, error)
+	MOTD() (string, error)
+	SetMOTD(string) (string, error)
+	Time() (*GameTime, error)
+	Dawn() error
+	Noon() error
+	Dusk() error
+	Midnight() error
+	Settle() error
+	Save() error
+	Exit() (*StopReport, error)
+	ExitNoSave() (*StopReport, error)
+	Playing() ([]*PlayerData, error)
+	Help() (map[string]string, error)
+	MaxPlayers() (int, error)
+	Port() (int, error)
+	Seed() (string, error)
+	Version() (string, error)
+	Clear() error
 }
 
-// RegisterIllegalName = Register a name/regex that is not permitted to be used.
-func RegisterIllegalName(re string) {
-	illegalNamesRe = append(illegalNamesRe, regexp.MustCompile(re))
+// GameTime is the time of day in game, on a 24 hour clock
+type GameTime struct {
+	Hour   int
+	Minute int
 }
 
-// IsNameIllegal - Determine if a given name is not permitted to be used
-func IsNameIllegal(s string) bool {
-	for _, re := range illegalNamesRe {
-		if re.MatchString(s) {
-			return true
-		}
+// String - Return the time as Terraria displays it (ex: 4:30 AM)
+func (t *GameTime) String() string {
+	h, ampm := t.Hour%12, "AM"
+	if h == 0 {
+		h = 12
 	}
-	return false
+	if t.Hour >= 12 {
+		ampm = "PM"
+	}
+	return sprintf("%d:%02d %s", h, t.Minute, ampm)
+}
+
+// SendCommand - Send a command to a Commandable() object
+func SendCommand(s string, cs Commandable) {
+	cs.EnqueueCommand(s)
 }
 
 // GamePlayerData returns a playerdata object for a GameServer
@@ -142,8 +249,17 @@ func GamePlayerData(gs GameServer) []*PlayerData {
 
 // GameStatus constructs a new GameData struct from the given GameServer
 func GameStatus(gs GameServer) *GameData {
+	name := "Terraria"
+	wi, err := ReadWorldInfo(gs.WorldFile())
+	if err != nil {
+		LogDebug(gs, "Unable to read world info: "+err.Error())
+		wi = nil
+	} else {
+		name = wi.Name
+	}
+
 	return &GameData{
-		WorldName:   "Terraria",
+		WorldName:   name,
 		Online:      gs.IsUp(),
 		Seed:        gs.Seed(),
 		MOTD:        gs.MOTD(),
@@ -152,15 +268,12 @@ func GameStatus(gs GameServer) *GameData {
 		PlayerCount: len(gs.Players()),
 		Loglevel:    gs.Loglevel(),
 		Version:     gs.Version(),
+		World:       wi,
+		Events:      gs.EventLog().Events(20),
 	}
 }
 
 func init() {
 	// Prepare our application data
 	gameServers = make([]GameServer, 0)
-	illegalNamesRe = make([]*regexp.Regexp, 0)
-
-	// Ban names that can mess with our Regex and confuse players
-	RegisterIllegalName("^(\\s$|^[<>\\[\\]\\(\\)\\|]|[<>\\[\\]\\(\\)\\|]$)")
-	RegisterIllegalName("^([aA]dmin|[sS]ystem|[sS]erver|[sS]uper[aA]dmin)")
 }
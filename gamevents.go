@@ -1,70 +1,195 @@
 package main
 
-import "regexp"
+import (
+	"errors"
+	"regexp"
+	"sort"
+	"sync"
+)
 
-var gameEvents []*GameEvent             // Iteration
-var gameEventsMap map[string]*GameEvent // Reference
+const (
+	eventNone = "EventNone"
 
-func init() {
-	gameEvents = make([]*GameEvent, 0)
-	gameEventsMap = make(map[string]*GameEvent)
-}
+	// Events with a higher priority are matched first. Events of the same
+	// priority are matched in the order that they were registered.
+	EventPriorityHigh    = 100
+	EventPriorityDefault = 0
+	EventPriorityLow     = -100
+)
 
-// gameEventHandler - A function that takes a GameServer, some output and output
-// channel (used as needed) and processes a given gameevent
-type gameEventHandler func(GameServer, *GameEvent, string, chan string)
+// gameEventHandler - A function that takes a GameServer, some output and the
+// submatches of the events Capture, processes a given gameevent and returns the
+// typed Event that it represents
+type gameEventHandler func(GameServer, *GameEvent, string, []string) Event
 
 // GameEvent -
 // TODO: Have GameEvent implement Loggable
 type GameEvent struct {
-	name    string
-	Capture *regexp.Regexp
-	Handler gameEventHandler
+	name     string
+	priority int
+	order    int
+	filter   *literalFilter
+	Capture  *regexp.Regexp
+	Handler  gameEventHandler
 }
 
-// GetEventFromString -
-func GetEventFromString(in string) *GameEvent {
-	for _, e := range gameEvents {
-		if e.Capture.MatchString(in) {
-			return e
+// Name - Return the name that the event was registered with
+func (e *GameEvent) Name() string {
+	return e.name
+}
+
+// Priority - Return the priority that the event was registered with
+func (e *GameEvent) Priority() int {
+	return e.priority
+}
+
+// EventRegistry is a set of GameEvents that output is matched against. Each
+// GameServer owns its own, so that servers with different output (modded or
+// localized servers for example) can be parsed with different rules. Output
+// that matches none of the events goes to the fallback handler.
+type EventRegistry struct {
+	mu       sync.RWMutex
+	events   []*GameEvent
+	fallback *GameEvent
+	count    int
+}
+
+// NewEventRegistry - Return an empty registry that sends everything to the
+// given fallback handler. If fallback is nil, the output is logged as is.
+func NewEventRegistry(fallback gameEventHandler) *EventRegistry {
+	r := &EventRegistry{events: make([]*GameEvent, 0)}
+	r.SetFallback(fallback)
+	return r
+}
+
+// Register - Register a game event using the Regex that is used to detect it.
+// Returns an error if the name or the Regexp is already registered, or if the
+// Regexp does not compile.
+func (r *EventRegistry) Register(n, re string, priority int, f gameEventHandler) error {
+	if n == "" || f == nil {
+		return errors.New("events need a name and a handler")
+	}
+
+	capture, err := regexp.Compile(re)
+	if err != nil {
+		return errors.New(sprintf("invalid expression for %s: %s", n, err.Error()))
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, e := range r.events {
+		if e.name == n {
+			return errors.New(sprintf("event %s is already registered", n))
+		}
+		if e.Capture.String() == re {
+			return errors.New(sprintf("event %s uses the same expression as %s", n, e.name))
 		}
 	}
 
-	return gameEvents[len(gameEvents)-1]
+	r.count++
+	r.events = append(r.events, &GameEvent{
+		name:     n,
+		priority: priority,
+		order:    r.count,
+		filter:   newLiteralFilter(re),
+		Capture:  capture,
+		Handler:  f})
+
+	sort.SliceStable(r.events, func(i, j int) bool {
+		if r.events[i].priority != r.events[j].priority {
+			return r.events[i].priority > r.events[j].priority
+		}
+		return r.events[i].order < r.events[j].order
+	})
+	return nil
 }
 
-// RegisterGameEventHandler - Register a game event using the Regex that is used to detect
-// it. Panic if the Regexp that was provided matches the Regexp of a previously
-// registered GameEvent. Returns the index of the registered event
-func RegisterGameEventHandler(n, re string, f gameEventHandler) int {
-	for _, e := range gameEvents {
-		if e.Capture.String() == re || e.name == n {
-			panic("Cannot register the same event multiple times")
+// mustRegister registers one of the built in events, which are known to be
+// valid. The priority is optional.
+func (r *EventRegistry) mustRegister(n, re string, f gameEventHandler, priority ...int) {
+	p := EventPriorityDefault
+	if len(priority) > 0 {
+		p = priority[0]
+	}
+
+	if err := r.Register(n, re, p, f); err != nil {
+		panic(err)
+	}
+}
+
+// Unregister - Remove the event with the given name
+func (r *EventRegistry) Unregister(n string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for i, e := range r.events {
+		if e.name == n {
+			r.events = append(r.events[:i], r.events[i+1:]...)
+			return nil
 		}
 	}
+	return errors.New(sprintf("event %s is not registered", n))
+}
+
+// SetFallback - Set the handler for output that matches no other event
+func (r *EventRegistry) SetFallback(f gameEventHandler) {
+	if f == nil {
+		f = defaultEventHandler
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
 
-	ge := &GameEvent{
-		name:    n,
-		Capture: regexp.MustCompile(re),
-		Handler: f}
+	r.fallback = &GameEvent{
+		name:     eventNone,
+		priority: EventPriorityLow,
+		filter:   &literalFilter{},
+		Capture:  regexp.MustCompile(".*"),
+		Handler:  f}
+}
 
-	gameEvents = append(gameEvents, ge)
-	gameEventsMap[n] = ge
+// Event - Return the event with the given name, or nil
+func (r *EventRegistry) Event(n string) *GameEvent {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
 
-	return len(gameEvents)
+	for _, e := range r.events {
+		if e.name == n {
+			return e
+		}
+	}
+	return nil
 }
 
-// EventType - Given string and its source GameServer{}, determine the event type
-// that was provided. Returns a -1 if none was found.
-func EventType(s string, gs GameServer) int {
-	for i, ge := range gameEvents {
-		if ge.Capture.MatchString(s) {
-			return i
+// Events - Return the registered events, in the order that they are matched
+func (r *EventRegistry) Events() []*GameEvent {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return append([]*GameEvent{}, r.events...)
+}
+
+// Match - Return the first event that matches the given output along with its
+// submatches, or the fallback event if there is none. Events whose literal
+// text is missing from the output are skipped without running their Regexp,
+// and the Regexp of the others is only run once.
+func (r *EventRegistry) Match(in string) (*GameEvent, []string) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, e := range r.events {
+		if !e.filter.allows(in) {
+			continue
+		}
+		if m := e.Capture.FindStringSubmatch(in); m != nil {
+			return e, m
 		}
 	}
-	return -1
+	return r.fallback, []string{in}
 }
 
-func defaultEventHandler(gs GameServer, e *GameEvent, in string, oc chan string) {
+func defaultEventHandler(gs GameServer, e *GameEvent, in string, m []string) Event {
 	LogOutput(gs, in)
+	return &ConsoleOutput{EventHeader: newEventHeader(in)}
 }
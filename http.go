@@ -2,11 +2,14 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"html/template"
 	"log"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
+	"time"
 )
 
 // https://stackoverflow.com/questions/43601359/how-do-i-serve-css-and-js-in-go
@@ -42,14 +45,16 @@ func serveHTTP(h *ConnHub, gs GameServer, out chan []byte) {
 		LogHTTP(gs, 200, r)
 	})
 
+	// Kicks and bans are recorded as being by ?by=, defaulting to "admin"
 	http.HandleFunc("/api/player/kick/", func(w http.ResponseWriter, r *http.Request) {
 		LogInfo(gs, "Received kick request: "+r.RequestURI)
-		pn := strings.TrimPrefix(r.RequestURI, "/api/player/kick/")
+		u, _ := url.Parse(r.RequestURI)
+		pn := strings.TrimPrefix(u.Path, "/api/player/kick/")
 		rc := 403
 
-		if plr := gs.Player(pn); plr != nil {
-			plr.Kick("Kicked by the internet")
+		if gs.Player(pn) != nil {
 			rc = 200
+			moderateHTTP(gs, moderationKick, pn, r, "Kicked by the internet")
 		} else {
 			rc = 404
 		}
@@ -59,15 +64,13 @@ func serveHTTP(h *ConnHub, gs GameServer, out chan []byte) {
 	})
 
 	http.HandleFunc("/api/player/ban/", func(w http.ResponseWriter, r *http.Request) {
-		pn := strings.TrimPrefix(r.RequestURI, "/api/player/ban/")
-		var (
-			rc  = 403
-			msg = "Banned from the internet"
-		)
+		u, _ := url.Parse(r.RequestURI)
+		pn := strings.TrimPrefix(u.Path, "/api/player/ban/")
+		rc := 403
 
-		if plr := gs.Player(pn); plr != nil {
+		if gs.Player(pn) != nil {
 			rc = 200
-			plr.Ban(msg)
+			moderateHTTP(gs, moderationBan, pn, r, "Banned from the internet")
 		} else {
 			rc = 404
 		}
@@ -83,12 +86,22 @@ func serveHTTP(h *ConnHub, gs GameServer, out chan []byte) {
 
 		if p == "" {
 			w.WriteHeader(200)
-		} else {
-			w.WriteHeader(200)
 			w.Write([]byte(gs.Password()))
-			SendCommand("password "+p, gs)
+			LogHTTP(gs, 200, r)
+			return
 		}
 
+		set, err := gs.Console().SetPassword(p)
+		if err != nil {
+			LogWarning(gs, "Unable to set password: "+err.Error(), out)
+			LogHTTP(gs, 400, r)
+			w.WriteHeader(400)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		w.WriteHeader(200)
+		w.Write([]byte(set))
 		LogHTTP(gs, 200, r)
 	})
 
@@ -100,7 +113,11 @@ func serveHTTP(h *ConnHub, gs GameServer, out chan []byte) {
 		}
 
 		if err := gs.Start(); err != nil {
-			log.Fatal(err)
+			LogError(gs, "Unable to start server: "+err.Error(), out)
+			LogHTTP(gs, 500, r)
+			w.WriteHeader(500)
+			w.Write([]byte(err.Error()))
+			return
 		}
 
 		LogHTTP(gs, 200, r)
@@ -108,15 +125,41 @@ func serveHTTP(h *ConnHub, gs GameServer, out chan []byte) {
 	})
 
 	http.HandleFunc("/api/server/stop/", func(w http.ResponseWriter, r *http.Request) {
-		if gs.IsUp() {
-			LogHTTP(gs, 200, r)
-			go func() { gs.Stop() }()
-			w.WriteHeader(200)
+		u, _ := url.Parse(r.RequestURI)
+		nosave := false
+		switch strings.TrimPrefix(u.Path, "/api/server/stop") {
+		case "/", "":
+		case "/nosave":
+			nosave = true
+		default:
+			LogHTTP(gs, 404, r)
+			w.WriteHeader(404)
 			return
 		}
 
-		LogHTTP(gs, 400, r)
-		w.WriteHeader(400)
+		if !gs.IsUp() {
+			LogHTTP(gs, 400, r)
+			w.WriteHeader(400)
+			return
+		}
+
+		report, err := gs.Shutdown(nosave)
+		if err != nil {
+			LogError(gs, err.Error(), out)
+		}
+
+		json, jerr := json.Marshal(report)
+		if jerr != nil {
+			LogError(gs, jerr.Error())
+			LogHTTP(gs, 500, r)
+			w.WriteHeader(500)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(200)
+		w.Write(json)
+		LogHTTP(gs, 200, r)
 	})
 
 	http.HandleFunc("/api/server/status/", func(w http.ResponseWriter, r *http.Request) {
@@ -143,7 +186,12 @@ func serveHTTP(h *ConnHub, gs GameServer, out chan []byte) {
 	http.HandleFunc("/api/server/say/", func(w http.ResponseWriter, r *http.Request) {
 		LogOutput(gs, "Sending message: "+r.RequestURI)
 		u, _ := url.Parse(r.RequestURI)
-		SendCommand("say "+strings.TrimPrefix(u.Path, "/api/server/say/"), gs)
+		if err := gs.Console().Say(strings.TrimPrefix(u.Path, "/api/server/say/")); err != nil {
+			LogHTTP(gs, 400, r)
+			w.WriteHeader(400)
+			w.Write([]byte(err.Error()))
+			return
+		}
 		LogHTTP(gs, 200, r)
 	})
 
@@ -152,14 +200,24 @@ func serveHTTP(h *ConnHub, gs GameServer, out chan []byte) {
 		m := strings.TrimPrefix(u.Path, "/api/server/motd")
 		m = strings.TrimPrefix(m, "/")
 
-		w.WriteHeader(200)
 		if m == "" {
+			w.WriteHeader(200)
 			w.Write([]byte(gs.MOTD()))
-		} else {
-			SendCommand("motd "+m, gs)
-			SendCommand("motd", gs)
+			LogHTTP(gs, 200, r)
+			return
+		}
+
+		set, err := gs.Console().SetMOTD(m)
+		if err != nil {
+			LogWarning(gs, "Unable to set MOTD: "+err.Error(), out)
+			LogHTTP(gs, 400, r)
+			w.WriteHeader(400)
+			w.Write([]byte(err.Error()))
+			return
 		}
 
+		w.WriteHeader(200)
+		w.Write([]byte(set))
 		LogHTTP(gs, 200, r)
 	})
 
@@ -167,28 +225,39 @@ func serveHTTP(h *ConnHub, gs GameServer, out chan []byte) {
 		LogOutput(gs, "Received time request: "+r.RequestURI)
 		u, _ := url.Parse(r.RequestURI)
 		t := strings.TrimPrefix(u.Path, "/api/server/time")
-		set := ""
+		c := gs.Console()
+		var set func() error
 		switch t {
 		case "/", "":
-			SendCommand("time", gs)
+			now, err := c.Time()
+			if err != nil {
+				LogHTTP(gs, 504, r)
+				w.WriteHeader(504)
+				return
+			}
+			w.WriteHeader(200)
+			w.Write([]byte(now.String()))
+			LogHTTP(gs, 200, r)
 			return
 		case "/dawn":
-			set = "dawn"
+			set = c.Dawn
 		case "/noon":
-			set = "noon"
+			set = c.Noon
 		case "/dusk":
-			set = "dusk"
+			set = c.Dusk
 		case "/midnight":
-			set = "midnight"
+			set = c.Midnight
 		default:
 			LogHTTP(gs, 404, r)
 			w.WriteHeader(404)
 			return
 		}
 
-		if set != "" {
-			SendCommand("say Setting time to "+set, gs)
-			SendCommand(set, gs)
+		c.Say("Setting time to " + strings.TrimPrefix(t, "/"))
+		if err := set(); err != nil {
+			LogHTTP(gs, 500, r)
+			w.WriteHeader(500)
+			return
 		}
 
 		w.WriteHeader(200)
@@ -197,8 +266,47 @@ func serveHTTP(h *ConnHub, gs GameServer, out chan []byte) {
 
 	http.HandleFunc("/api/server/settle/", func(w http.ResponseWriter, r *http.Request) {
 		LogInfo(gs, "Settling liquids", out)
-		SendCommand("settle", gs)
+		gs.Console().Settle()
+		w.WriteHeader(200)
+		LogHTTP(gs, 200, r)
+	})
+
+	http.HandleFunc("/api/world/info/", func(w http.ResponseWriter, r *http.Request) {
+		wi, err := ReadWorldInfo(gs.WorldFile())
+		if err != nil {
+			LogError(gs, "Unable to read world info: "+err.Error())
+			LogHTTP(gs, 404, r)
+			w.WriteHeader(404)
+			return
+		}
+
+		json, err := json.Marshal(wi)
+		if err != nil {
+			LogError(gs, err.Error())
+			LogHTTP(gs, 500, r)
+			w.WriteHeader(500)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(200)
+		w.Write(json)
+		LogHTTP(gs, 200, r)
+	})
+
+	http.HandleFunc("/api/world/map/", func(w http.ResponseWriter, r *http.Request) {
+		scale, _ := strconv.Atoi(r.URL.Query().Get("scale"))
+		b, err := WorldMap(gs.WorldFile(), scale)
+		if err != nil {
+			LogError(gs, "Unable to render world map: "+err.Error())
+			LogHTTP(gs, 404, r)
+			w.WriteHeader(404)
+			return
+		}
+
+		w.Header().Set("Content-Type", "image/png")
+		w.WriteHeader(200)
+		w.Write(b)
 		LogHTTP(gs, 200, r)
 	})
 
@@ -206,3 +314,669 @@ func serveHTTP(h *ConnHub, gs GameServer, out chan []byte) {
 		serveWs(h, w, r)
 	})
 }
+
+// serveBackupHTTP registers the endpoints used to list, download and restore
+// world backups
+func serveBackupHTTP(b *BackupManager, gs GameServer) {
+	http.HandleFunc("/api/backup/list/", func(w http.ResponseWriter, r *http.Request) {
+		json, err := json.Marshal(b.Backups())
+		if err != nil {
+			LogError(gs, err.Error())
+			LogHTTP(gs, 500, r)
+			w.WriteHeader(500)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(200)
+		w.Write(json)
+		LogHTTP(gs, 200, r)
+	})
+
+	http.HandleFunc("/api/backup/create/", func(w http.ResponseWriter, r *http.Request) {
+		wb, err := b.Snapshot(backupReasonManual)
+		if err != nil {
+			LogError(gs, "Backup failed: "+err.Error(), gs.WSOutput())
+			LogHTTP(gs, 500, r)
+			w.WriteHeader(500)
+			return
+		}
+
+		json, _ := json.Marshal(wb)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(200)
+		w.Write(json)
+		LogHTTP(gs, 200, r)
+	})
+
+	http.HandleFunc("/api/backup/download/", func(w http.ResponseWriter, r *http.Request) {
+		u, _ := url.Parse(r.RequestURI)
+		wb := b.Backup(strings.TrimPrefix(u.Path, "/api/backup/download/"))
+		if wb == nil {
+			LogHTTP(gs, 404, r)
+			w.WriteHeader(404)
+			return
+		}
+
+		w.Header().Set("Content-Disposition",
+			sprintf("attachment; filename=\"%s-%s\"", wb.ID, wb.World))
+		http.ServeFile(w, r, b.Path(wb))
+		LogHTTP(gs, 200, r)
+	})
+
+	http.HandleFunc("/api/backup/upload/", func(w http.ResponseWriter, r *http.Request) {
+		u, _ := url.Parse(r.RequestURI)
+		id := strings.TrimPrefix(u.Path, "/api/backup/upload/")
+		if b.Backup(id) == nil {
+			LogHTTP(gs, 404, r)
+			w.WriteHeader(404)
+			return
+		}
+
+		if err := b.Upload(id); err != nil {
+			LogError(gs, err.Error())
+			LogHTTP(gs, 400, r)
+			w.WriteHeader(400)
+			return
+		}
+
+		w.WriteHeader(200)
+		LogHTTP(gs, 200, r)
+	})
+
+	http.HandleFunc("/api/backup/restore/", func(w http.ResponseWriter, r *http.Request) {
+		u, _ := url.Parse(r.RequestURI)
+		id := strings.TrimPrefix(u.Path, "/api/backup/restore/")
+		if b.Backup(id) == nil {
+			LogHTTP(gs, 404, r)
+			w.WriteHeader(404)
+			return
+		}
+
+		if err := b.Restore(id); err != nil {
+			LogError(gs, "Restore failed: "+err.Error(), gs.WSOutput())
+			LogHTTP(gs, 500, r)
+			w.WriteHeader(500)
+			return
+		}
+
+		w.WriteHeader(200)
+		LogHTTP(gs, 200, r)
+	})
+}
+
+// serveWorldHTTP registers the endpoints used to manage the world library
+func serveWorldHTTP(m *WorldManager, gs GameServer) {
+	http.HandleFunc("/api/world/list/", func(w http.ResponseWriter, r *http.Request) {
+		worlds, err := m.Worlds()
+		if err != nil {
+			LogError(gs, "Unable to list worlds: "+err.Error())
+			LogHTTP(gs, 500, r)
+			w.WriteHeader(500)
+			return
+		}
+
+		json, _ := json.Marshal(worlds)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(200)
+		w.Write(json)
+		LogHTTP(gs, 200, r)
+	})
+
+	http.HandleFunc("/api/world/create/", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		name, err := m.Create(WorldOptions{
+			Name:       q.Get("name"),
+			Size:       q.Get("size"),
+			Difficulty: q.Get("difficulty"),
+			Evil:       q.Get("evil"),
+			Seed:       q.Get("seed"),
+		})
+		if err != nil {
+			LogWarning(gs, "Unable to create world: "+err.Error(), gs.WSOutput())
+			LogHTTP(gs, 400, r)
+			w.WriteHeader(400)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		w.WriteHeader(200)
+		w.Write([]byte(name))
+		LogHTTP(gs, 200, r)
+	})
+
+	http.HandleFunc("/api/world/upload/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			LogHTTP(gs, 405, r)
+			w.WriteHeader(405)
+			return
+		}
+
+		f, hdr, err := r.FormFile("world")
+		if err != nil {
+			LogHTTP(gs, 400, r)
+			w.WriteHeader(400)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		defer f.Close()
+
+		if err := m.Upload(hdr.Filename, f); err != nil {
+			LogWarning(gs, "World upload failed: "+err.Error(), gs.WSOutput())
+			LogHTTP(gs, 400, r)
+			w.WriteHeader(400)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		w.WriteHeader(200)
+		LogHTTP(gs, 200, r)
+	})
+
+	worldAction := func(prefix string, f func(string) error) {
+		http.HandleFunc(prefix, func(w http.ResponseWriter, r *http.Request) {
+			u, _ := url.Parse(r.RequestURI)
+			if err := f(strings.TrimPrefix(u.Path, prefix)); err != nil {
+				LogWarning(gs, err.Error(), gs.WSOutput())
+				LogHTTP(gs, 400, r)
+				w.WriteHeader(400)
+				w.Write([]byte(err.Error()))
+				return
+			}
+
+			w.WriteHeader(200)
+			LogHTTP(gs, 200, r)
+		})
+	}
+
+	worldAction("/api/world/select/", m.Select)
+	worldAction("/api/world/delete/", m.Delete)
+	worldAction("/api/world/archive/", func(name string) error {
+		_, err := m.Archive(name)
+		return err
+	})
+}
+
+// serveRotationHTTP registers the endpoints used to view and trigger world
+// rotations
+func serveRotationHTTP(wr *WorldRotator, gs GameServer) {
+	http.HandleFunc("/api/rotation/history/", func(w http.ResponseWriter, r *http.Request) {
+		json, _ := json.Marshal(struct {
+			Next    time.Time
+			History []*RotationRecord
+		}{wr.Next(), wr.History()})
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(200)
+		w.Write(json)
+		LogHTTP(gs, 200, r)
+	})
+
+	http.HandleFunc("/api/rotation/now/", func(w http.ResponseWriter, r *http.Request) {
+		if err := wr.RotateNow(); err != nil {
+			LogWarning(gs, err.Error(), gs.WSOutput())
+			LogHTTP(gs, 400, r)
+			w.WriteHeader(400)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		w.WriteHeader(200)
+		LogHTTP(gs, 200, r)
+	})
+}
+
+// serveIntegrityHTTP registers the endpoints used to view and confirm the
+// restore of a damaged world
+func serveIntegrityHTTP(g *WorldGuard, gs GameServer) {
+	http.HandleFunc("/api/world/check/", func(w http.ResponseWriter, r *http.Request) {
+		res := struct {
+			Valid   bool
+			Error   string
+			Pending string
+		}{Valid: true, Pending: g.Pending()}
+
+		if _, err := ValidateWorldFile(gs.WorldFile()); err != nil {
+			res.Valid = false
+			res.Error = err.Error()
+		}
+
+		json, _ := json.Marshal(res)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(200)
+		w.Write(json)
+		LogHTTP(gs, 200, r)
+	})
+
+	http.HandleFunc("/api/world/recover/", func(w http.ResponseWriter, r *http.Request) {
+		if gs.IsUp() {
+			LogHTTP(gs, 403, r)
+			w.WriteHeader(403)
+			return
+		}
+
+		if err := g.Recover(); err != nil {
+			LogWarning(gs, "Unable to recover world: "+err.Error(), gs.WSOutput())
+			LogHTTP(gs, 400, r)
+			w.WriteHeader(400)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		w.WriteHeader(200)
+		LogHTTP(gs, 200, r)
+	})
+}
+
+// serveTriggerHTTP registers the endpoints used to view, reload and test the
+// user defined triggers
+func serveTriggerHTTP(t *TriggerEngine, gs GameServer) {
+	http.HandleFunc("/api/triggers/", func(w http.ResponseWriter, r *http.Request) {
+		json, _ := json.Marshal(struct {
+			DryRun   bool
+			Triggers []TriggerDefinition
+			History  []*TriggerFiring
+		}{t.config.DryRun, t.Triggers(), t.History()})
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(200)
+		w.Write(json)
+		LogHTTP(gs, 200, r)
+	})
+
+	http.HandleFunc("/api/triggers/reload/", func(w http.ResponseWriter, r *http.Request) {
+		if err := t.Reload(); err != nil {
+			LogWarning(gs, "Unable to reload triggers: "+err.Error(), gs.WSOutput())
+			LogHTTP(gs, 400, r)
+			w.WriteHeader(400)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		w.WriteHeader(200)
+		LogHTTP(gs, 200, r)
+	})
+
+	// Show what would fire for the line given, without running anything
+	http.HandleFunc("/api/triggers/test/", func(w http.ResponseWriter, r *http.Request) {
+		line := r.FormValue("line")
+		if line == "" {
+			LogHTTP(gs, 400, r)
+			w.WriteHeader(400)
+			return
+		}
+
+		json, _ := json.Marshal(t.Test(line))
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(200)
+		w.Write(json)
+		LogHTTP(gs, 200, r)
+	})
+}
+
+// serveProgressionHTTP registers the endpoint used to view the progression of
+// the current world
+func serveProgressionHTTP(p *ProgressionTracker, gs GameServer) {
+	http.HandleFunc("/api/world/progression/", func(w http.ResponseWriter, r *http.Request) {
+		world, steps := p.Progression()
+		json, _ := json.Marshal(struct {
+			World      string
+			Milestones []*ProgressionStep
+			Timeline   []*MilestoneRecord
+		}{world, steps, p.Timeline()})
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(200)
+		w.Write(json)
+		LogHTTP(gs, 200, r)
+	})
+}
+
+// serveDeathHTTP registers the endpoints used to view player deaths and the
+// death leaderboards
+func serveDeathHTTP(d *DeathTracker, gs GameServer) {
+	// Leaderboards cover the given period (ex: ?since=24h), or all time
+	http.HandleFunc("/api/deaths/leaderboard/", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		since := time.Time{}
+		if s := q.Get("since"); s != "" {
+			p, err := time.ParseDuration(s)
+			if err != nil {
+				LogHTTP(gs, 400, r)
+				w.WriteHeader(400)
+				w.Write([]byte(err.Error()))
+				return
+			}
+			since = time.Now().Add(-p)
+		}
+
+		limit := 10
+		if l := q.Get("limit"); l != "" {
+			n, err := strconv.Atoi(l)
+			if err != nil {
+				LogHTTP(gs, 400, r)
+				w.WriteHeader(400)
+				return
+			}
+			limit = n
+		}
+
+		json, _ := json.Marshal(d.Leaderboards(since, limit))
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(200)
+		w.Write(json)
+		LogHTTP(gs, 200, r)
+	})
+
+	http.HandleFunc("/api/deaths/player/", func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, "/api/deaths/player/")
+		if name == "" {
+			LogHTTP(gs, 400, r)
+			w.WriteHeader(400)
+			return
+		}
+
+		json, _ := json.Marshal(struct {
+			Deaths   []*DeathRecord
+			Sessions []*PlaySession
+		}{d.Deaths(name), d.Sessions(name)})
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(200)
+		w.Write(json)
+		LogHTTP(gs, 200, r)
+	})
+}
+
+// serveReportHTTP registers the endpoints used by moderators to work through
+// the report queue. The moderator is given with ?by=, defaulting to "admin".
+func serveReportHTTP(q *ReportQueue, gs GameServer) {
+	// Open reports, or every report with ?all=true
+	http.HandleFunc("/api/reports/list/", func(w http.ResponseWriter, r *http.Request) {
+		all, _ := strconv.ParseBool(r.FormValue("all"))
+		json, _ := json.Marshal(q.Reports(all))
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(200)
+		w.Write(json)
+		LogHTTP(gs, 200, r)
+	})
+
+	http.HandleFunc("/api/reports/file/", func(w http.ResponseWriter, r *http.Request) {
+		rep, err := q.File(r.FormValue("reporter"), r.FormValue("target"), r.FormValue("reason"))
+		if err != nil {
+			LogHTTP(gs, 400, r)
+			w.WriteHeader(400)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		json, _ := json.Marshal(rep)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(200)
+		w.Write(json)
+		LogHTTP(gs, 200, r)
+	})
+
+	reportAction := func(prefix string, f func(int, string, *http.Request) error) {
+		http.HandleFunc(prefix, func(w http.ResponseWriter, r *http.Request) {
+			id, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, prefix))
+			if err != nil {
+				LogHTTP(gs, 400, r)
+				w.WriteHeader(400)
+				return
+			}
+
+			by := r.FormValue("by")
+			if by == "" {
+				by = "admin"
+			}
+
+			if err := f(id, by, r); err != nil {
+				rc := 400
+				if errors.Is(err, errReportNotFound) {
+					rc = 404
+				}
+				LogHTTP(gs, rc, r)
+				w.WriteHeader(rc)
+				w.Write([]byte(err.Error()))
+				return
+			}
+
+			w.WriteHeader(200)
+			LogHTTP(gs, 200, r)
+		})
+	}
+
+	reportAction("/api/reports/claim/", func(id int, by string, _ *http.Request) error {
+		return q.Claim(id, by)
+	})
+	reportAction("/api/reports/resolve/", func(id int, by string, r *http.Request) error {
+		return q.Resolve(id, by, r.FormValue("note"))
+	})
+	reportAction("/api/reports/kick/", func(id int, by string, _ *http.Request) error {
+		return q.Kick(id, by)
+	})
+	reportAction("/api/reports/ban/", func(id int, by string, _ *http.Request) error {
+		return q.Ban(id, by)
+	})
+}
+
+// serveModerationHTTP registers the endpoints used to view the moderation
+// rules and records, and reload the rules
+func serveModerationHTTP(m *ChatModerator, gs GameServer) {
+	http.HandleFunc("/api/moderation/", func(w http.ResponseWriter, r *http.Request) {
+		json, _ := json.Marshal(struct {
+			Rules   ModerationRules
+			Records []*ModerationRecord
+		}{m.Rules(), m.Records()})
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(200)
+		w.Write(json)
+		LogHTTP(gs, 200, r)
+	})
+
+	http.HandleFunc("/api/moderation/reload/", func(w http.ResponseWriter, r *http.Request) {
+		if err := m.Reload(); err != nil {
+			LogWarning(gs, "Unable to reload moderation rules: "+err.Error(), gs.WSOutput())
+			LogHTTP(gs, 400, r)
+			w.WriteHeader(400)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		w.WriteHeader(200)
+		LogHTTP(gs, 200, r)
+	})
+}
+
+// moderateHTTP kicks or bans a player for an API request, announcing it in
+// chat. The reason and moderator are taken from ?reason= and ?by=.
+func moderateHTTP(gs GameServer, action, name string, r *http.Request, reason string) {
+	if rs := r.FormValue("reason"); rs != "" {
+		reason = rs
+	}
+	by := r.FormValue("by")
+	if by == "" {
+		by = "admin"
+	}
+
+	verb := "Kicking"
+	if action == moderationBan {
+		verb = "Banning"
+	}
+
+	gs.Console().Say(sprintf("%s player: \"%s\". %s.", verb, name, reason))
+	if err := moderatePlayer(gs, action, name, by, reason, time.Time{}); err != nil {
+		LogError(gs, sprintf("Unable to %s %s: %s", action, name, err.Error()))
+	}
+}
+
+// serveLedgerHTTP registers the endpoints used to view the moderation history
+// of players, add notes to it, clear strikes and lift bans
+func serveLedgerHTTP(l *ModerationLedger, gs GameServer) {
+	http.HandleFunc("/api/ledger/recent/", func(w http.ResponseWriter, r *http.Request) {
+		limit := defaultLedgerRecent
+		if s := r.FormValue("limit"); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil {
+				LogHTTP(gs, 400, r)
+				w.WriteHeader(400)
+				return
+			}
+			limit = n
+		}
+
+		json, _ := json.Marshal(l.Recent(limit))
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(200)
+		w.Write(json)
+		LogHTTP(gs, 200, r)
+	})
+
+	http.HandleFunc("/api/ledger/player/", func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, "/api/ledger/player/")
+		if name == "" {
+			LogHTTP(gs, 400, r)
+			w.WriteHeader(400)
+			return
+		}
+
+		json, _ := json.Marshal(l.Player(name))
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(200)
+		w.Write(json)
+		LogHTTP(gs, 200, r)
+	})
+
+	ledgerAction := func(prefix string, f func(name, by string, r *http.Request) error) {
+		http.HandleFunc(prefix, func(w http.ResponseWriter, r *http.Request) {
+			by := r.FormValue("by")
+			if by == "" {
+				by = "admin"
+			}
+
+			if err := f(strings.TrimPrefix(r.URL.Path, prefix), by, r); err != nil {
+				LogHTTP(gs, 400, r)
+				w.WriteHeader(400)
+				w.Write([]byte(err.Error()))
+				return
+			}
+
+			w.WriteHeader(200)
+			LogHTTP(gs, 200, r)
+		})
+	}
+
+	// Notes are given with ?text=
+	ledgerAction("/api/ledger/note/", func(name, by string, r *http.Request) error {
+		return l.Note(name, by, r.FormValue("text"))
+	})
+	ledgerAction("/api/ledger/warn/", func(name, by string, r *http.Request) error {
+		return moderatePlayer(gs, moderationWarn, name, by, r.FormValue("reason"), time.Time{})
+	})
+	ledgerAction("/api/ledger/unban/", func(name, by string, _ *http.Request) error {
+		return l.Unban(name, by)
+	})
+	ledgerAction("/api/ledger/pardon/", func(name, by string, _ *http.Request) error {
+		return l.Pardon(name, by)
+	})
+}
+
+// serveNameHTTP registers the endpoints used to view and change the name
+// policy, and to test names against it
+func serveNameHTTP(g *NameGuard, gs GameServer) {
+	// A POST with a JSON policy replaces the policy
+	http.HandleFunc("/api/names/policy/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			var p NamePolicy
+			if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+				LogHTTP(gs, 400, r)
+				w.WriteHeader(400)
+				w.Write([]byte(err.Error()))
+				return
+			}
+
+			if err := g.SetPolicy(p); err != nil {
+				LogWarning(gs, "Unable to set the name policy: "+err.Error(), gs.WSOutput())
+				LogHTTP(gs, 400, r)
+				w.WriteHeader(400)
+				w.Write([]byte(err.Error()))
+				return
+			}
+		}
+
+		json, _ := json.Marshal(g.Policy())
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(200)
+		w.Write(json)
+		LogHTTP(gs, 200, r)
+	})
+
+	// Explain why a name would be rejected (ex: ?name=Adm1n)
+	http.HandleFunc("/api/names/test/", func(w http.ResponseWriter, r *http.Request) {
+		name := r.FormValue("name")
+		if name == "" {
+			LogHTTP(gs, 400, r)
+			w.WriteHeader(400)
+			return
+		}
+
+		json, _ := json.Marshal(g.Check(name))
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(200)
+		w.Write(json)
+		LogHTTP(gs, 200, r)
+	})
+}
+
+// serveIllegalNameHTTP registers the endpoints used to list, add and remove
+// the illegal name rules. Players already online with a name that a new rule
+// matches are listed, and are kicked if ?kick=true.
+func serveIllegalNameHTTP(gs GameServer) {
+	http.HandleFunc("/api/names/illegal/", func(w http.ResponseWriter, r *http.Request) {
+		json, _ := json.Marshal(gs.IllegalNames().Rules())
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(200)
+		w.Write(json)
+		LogHTTP(gs, 200, r)
+	})
+
+	http.HandleFunc("/api/names/add/", func(w http.ResponseWriter, r *http.Request) {
+		rule, err := gs.IllegalNames().Add(r.FormValue("pattern"), r.FormValue("reason"))
+		if err != nil {
+			LogHTTP(gs, 400, r)
+			w.WriteHeader(400)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		LogInfo(gs, "Added illegal name pattern: "+rule.Pattern, gs.WSOutput())
+
+		kick, _ := strconv.ParseBool(r.FormValue("kick"))
+		json, _ := json.Marshal(struct {
+			Rule    *IllegalNameRule
+			Matched []string
+			Kicked  bool
+		}{rule, KickIllegalNames(gs, kick), kick})
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(200)
+		w.Write(json)
+		LogHTTP(gs, 200, r)
+	})
+
+	http.HandleFunc("/api/names/remove/", func(w http.ResponseWriter, r *http.Request) {
+		pattern := r.FormValue("pattern")
+		if err := gs.IllegalNames().Remove(pattern); err != nil {
+			LogHTTP(gs, 404, r)
+			w.WriteHeader(404)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		LogInfo(gs, "Removed illegal name pattern: "+pattern, gs.WSOutput())
+
+		w.WriteHeader(200)
+		LogHTTP(gs, 200, r)
+	})
+}
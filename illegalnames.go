@@ -0,0 +1,193 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultIllegalNameReason = "Name is not allowed"
+
+// IllegalNameRule is an expression that player names may not match
+type IllegalNameRule struct {
+	Pattern string
+	Reason  string
+	Added   time.Time
+
+	re *regexp.Regexp
+}
+
+// IllegalNames is the list of rules that the names of the players of a
+// GameServer may not match. Until a path is loaded it holds the default rules,
+// and once one has been it is saved there after every change.
+type IllegalNames struct {
+	mu    sync.Mutex
+	rules []*IllegalNameRule
+	path  string
+}
+
+// NewIllegalNames returns an IllegalNames with the default rules, which keep
+// out names that can mess with our expressions or that pose as the server
+func NewIllegalNames() *IllegalNames {
+	n := &IllegalNames{rules: make([]*IllegalNameRule, 0)}
+	n.mustAdd("^(\\s$|^[<>\\[\\]\\(\\)\\|]|[<>\\[\\]\\(\\)\\|]$)", "Names can not be blank or wrapped in brackets")
+	n.mustAdd("^([aA]dmin|[sS]ystem|[sS]erver|[sS]uper[aA]dmin)", "Names can not pose as the server")
+	return n
+}
+
+// Load reads the rules saved at path in place of the current rules, and saves
+// future changes there. A missing file keeps the current rules.
+func (n *IllegalNames) Load(path string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.path = path
+	saved := make([]*IllegalNameRule, 0)
+	err := loadJSON(path, &saved)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return nil
+	case err != nil:
+		return err
+	}
+
+	for _, r := range saved {
+		re, err := regexp.Compile(r.Pattern)
+		if err != nil {
+			return errors.New(sprintf("invalid illegal name pattern %q: %s", r.Pattern, err.Error()))
+		}
+		r.re = re
+		if r.Reason == "" {
+			r.Reason = defaultIllegalNameReason
+		}
+	}
+	n.rules = saved
+	return nil
+}
+
+// Rules - Return copies of the rules, in the order that they were added
+func (n *IllegalNames) Rules() []*IllegalNameRule {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	res := make([]*IllegalNameRule, 0, len(n.rules))
+	for _, r := range n.rules {
+		c := *r
+		res = append(res, &c)
+	}
+	return res
+}
+
+// Add - Add a rule, after checking that the pattern compiles and is not
+// already a rule
+func (n *IllegalNames) Add(pattern, reason string) (*IllegalNameRule, error) {
+	if strings.TrimSpace(pattern) == "" {
+		return nil, errEmptyArgument
+	}
+
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, errors.New("invalid pattern: " + err.Error())
+	}
+	if reason = strings.TrimSpace(reason); reason == "" {
+		reason = defaultIllegalNameReason
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	for _, r := range n.rules {
+		if r.Pattern == pattern {
+			return nil, errors.New(sprintf("%q is already an illegal name pattern", pattern))
+		}
+	}
+
+	r := &IllegalNameRule{Pattern: pattern, Reason: reason, Added: time.Now(), re: re}
+	n.rules = append(n.rules, r)
+	if err := n.save(); err != nil {
+		n.rules = n.rules[:len(n.rules)-1]
+		return nil, err
+	}
+
+	c := *r
+	return &c, nil
+}
+
+// Remove - Remove the rule with the given pattern
+func (n *IllegalNames) Remove(pattern string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	for i, r := range n.rules {
+		if r.Pattern != pattern {
+			continue
+		}
+
+		prev := n.rules
+		n.rules = append(append([]*IllegalNameRule{}, n.rules[:i]...), n.rules[i+1:]...)
+		if err := n.save(); err != nil {
+			n.rules = prev
+			return err
+		}
+		return nil
+	}
+	return errors.New(sprintf("%q is not an illegal name pattern", pattern))
+}
+
+// Match - Return a copy of the first rule that a name matches, or nil if the
+// name is allowed
+func (n *IllegalNames) Match(name string) *IllegalNameRule {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	for _, r := range n.rules {
+		if r.re.MatchString(name) {
+			c := *r
+			return &c
+		}
+	}
+	return nil
+}
+
+// mustAdd adds one of the built in rules, which are known to compile
+func (n *IllegalNames) mustAdd(pattern, reason string) {
+	n.rules = append(n.rules, &IllegalNameRule{
+		Pattern: pattern,
+		Reason:  reason,
+		re:      regexp.MustCompile(pattern),
+	})
+}
+
+// save writes the rules to disk, if a path has been loaded. Expects n.mu to
+// be held.
+func (n *IllegalNames) save() error {
+	if n.path == "" {
+		return nil
+	}
+	return saveJSON(n.path, n.rules)
+}
+
+// KickIllegalNames - Check the players that are online against the illegal
+// name rules, returning the names that break them. If kick is set those
+// players are also kicked.
+func KickIllegalNames(gs GameServer, kick bool) []string {
+	names := make([]string, 0)
+	for _, p := range gs.Players() {
+		r := gs.IllegalNames().Match(p.Name())
+		if r == nil {
+			continue
+		}
+
+		names = append(names, p.Name())
+		if !kick {
+			LogWarning(gs, sprintf("%s is online with an illegal name (%s)", p.Name(), r.Pattern),
+				gs.WSOutput())
+			continue
+		}
+		p.Kick(r.Reason)
+	}
+	return names
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const eventKindIntegrity = "integrity"
+
+// IntegrityConfig configures what happens when the world fails its integrity
+// check. By default a valid .bak or backup is restored automatically. With
+// ManualRestore set, the server is not started and the restore is offered
+// through the API instead.
+type IntegrityConfig struct {
+	ManualRestore bool `json:"manualrestore"`
+}
+
+// worldFallback is a copy of the world that can replace a broken world file
+type worldFallback struct {
+	Source      string
+	Description string
+}
+
+// WorldGuard checks the world of a GameServer before it starts, and restores
+// a working copy when the world is damaged
+type WorldGuard struct {
+	gs      GameServer
+	backups *BackupManager
+	config  IntegrityConfig
+
+	mu      sync.Mutex
+	pending *worldFallback
+}
+
+// NewWorldGuard returns a WorldGuard for the given GameServer
+func NewWorldGuard(gs GameServer, b *BackupManager, c IntegrityConfig) *WorldGuard {
+	return &WorldGuard{gs: gs, backups: b, config: c}
+}
+
+// Check validates the world that the server is about to load. It is meant to
+// be registered with OnStart, and returns an error when the server must not
+// be started.
+func (g *WorldGuard) Check() error {
+	path := g.gs.WorldFile()
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		// Terraria generates the world
+		return nil
+	}
+
+	_, err := ValidateWorldFile(path)
+	if err == nil {
+		g.mu.Lock()
+		g.pending = nil
+		g.mu.Unlock()
+		return nil
+	}
+
+	g.incident(sprintf("World %s failed its integrity check: %s", path, err.Error()))
+
+	fb := g.fallback(path)
+	if fb == nil {
+		g.incident("No valid .bak or backup is available, the server will not be started")
+		return errors.New("world is damaged and no fallback is available")
+	}
+
+	if g.config.ManualRestore {
+		g.mu.Lock()
+		g.pending = fb
+		g.mu.Unlock()
+
+		g.incident(sprintf("A restore from %s is available, the server will not be started until it is recovered",
+			fb.Description))
+		return errors.New("world is damaged, recover it before starting")
+	}
+
+	return g.restore(fb)
+}
+
+// Pending returns the description of a restore that is waiting to be
+// confirmed, if there is one
+func (g *WorldGuard) Pending() string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.pending == nil {
+		return ""
+	}
+	return g.pending.Description
+}
+
+// Recover restores the fallback that was offered by the last check
+func (g *WorldGuard) Recover() error {
+	g.mu.Lock()
+	fb := g.pending
+	g.pending = nil
+	g.mu.Unlock()
+
+	if fb == nil {
+		return errors.New("no restore is pending")
+	}
+	return g.restore(fb)
+}
+
+// fallback finds the newest copy of the world that passes the integrity check,
+// trying the .bak first and then the backups of the world
+func (g *WorldGuard) fallback(path string) *worldFallback {
+	if _, err := ValidateWorldFile(path + ".bak"); err == nil {
+		return &worldFallback{Source: path + ".bak", Description: "the world's .bak file"}
+	}
+
+	if g.backups == nil {
+		return nil
+	}
+
+	for _, wb := range g.backups.Backups() {
+		p := g.backups.Path(wb)
+		if wb.World != filepath.Base(path) {
+			continue
+		}
+
+		if sum, err := fileChecksum(p); err != nil || sum != wb.Checksum {
+			continue
+		}
+
+		if _, err := ValidateWorldFile(p); err == nil {
+			return &worldFallback{Source: p, Description: "backup " + wb.ID}
+		}
+	}
+	return nil
+}
+
+// restore moves the damaged world aside and copies the fallback into place
+func (g *WorldGuard) restore(fb *worldFallback) error {
+	path := g.gs.WorldFile()
+	broken := sprintf("%s.damaged-%s", path, time.Now().Format(backupTimeFormat))
+
+	if err := os.Rename(path, broken); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	if err := copyFile(fb.Source, path); err != nil {
+		g.incident("Restore failed: " + err.Error())
+		return err
+	}
+
+	g.incident(sprintf("Restored the world from %s, the damaged file was kept as %s",
+		fb.Description, broken))
+	return nil
+}
+
+// incident records a message in the servers event log and the websocket
+func (g *WorldGuard) incident(m string) {
+	g.gs.EventLog().Add(eventKindIntegrity, m)
+	LogWarning(g.gs, m, g.gs.WSOutput())
+}
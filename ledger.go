@@ -0,0 +1,423 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ledgerStateFile     = "ledger.json"
+	defaultStrikeDecay  = 30 * 24 * time.Hour
+	eventKindLedger     = "ledger"
+	ledgerPolicyActor   = "strike policy"
+	ledgerServerActor   = "server"
+	defaultLedgerRecent = 50
+
+	moderationBan    = "ban"
+	moderationUnban  = "unban"
+	moderationPardon = "pardon"
+	moderationReport = "report"
+	moderationNote   = "note"
+)
+
+// LedgerConfig configures the moderation ledger. Weights gives the strikes
+// that each kind of entry (warn, kick, report...) counts for, and strikes are
+// only counted for Decay. Policy gives the kicks, temporary bans (tempban) or
+// permanent bans (ban) that a number of strikes leads to. It is the only
+// escalation policy, and chat moderation feeds into it with warnings.
+type LedgerConfig struct {
+	Weights map[string]int `json:"weights"`
+	Decay   Duration       `json:"decay"`
+	Policy  []StrikeStep   `json:"policy"`
+}
+
+// StrikeStep is a kick or ban that is applied once a player reaches a number
+// of strikes. Duration is the length of a temporary ban.
+type StrikeStep struct {
+	Strikes  int      `json:"strikes"`
+	Action   string   `json:"action"`
+	Duration Duration `json:"duration,omitempty"`
+}
+
+// LedgerEntry is something that happened to a player, who did it, and when
+type LedgerEntry struct {
+	ID      int
+	Time    time.Time
+	Player  string
+	Action  string
+	By      string
+	Reason  string
+	Strikes int
+	Until   time.Time
+}
+
+// LedgerPlayer is the standing of a player in the ledger. A zero BannedUntil
+// with Banned set is a permanent ban.
+type LedgerPlayer struct {
+	Name        string
+	Strikes     int
+	Banned      bool
+	BannedUntil time.Time
+	Entries     []*LedgerEntry
+}
+
+// ledgerState is what is saved between runs. Bans holds the end of the bans
+// of players, with a zero time for permanent bans.
+type ledgerState struct {
+	Entries []*LedgerEntry
+	Bans    map[string]time.Time
+}
+
+// ModerationLedger keeps the moderation history of every player and applies
+// the strike policy. Everything done through moderatePlayer is recorded before
+// it is published, so that nothing is lost if a subscriber falls behind.
+// Banned players are kicked (or banned, for permanent bans) when they join.
+type ModerationLedger struct {
+	gs     GameServer
+	config LedgerConfig
+	state  string
+
+	mu   sync.Mutex
+	data *ledgerState
+}
+
+// NewModerationLedger returns a ModerationLedger and loads the history saved
+// in datadir
+func NewModerationLedger(gs GameServer, c LedgerConfig, datadir string) (*ModerationLedger, error) {
+	if c.Weights == nil {
+		c.Weights = map[string]int{moderationWarn: 1, moderationKick: 2}
+	}
+	if c.Decay.Duration <= 0 {
+		c.Decay.Duration = defaultStrikeDecay
+	}
+	if c.Policy == nil {
+		c.Policy = []StrikeStep{
+			{Strikes: 3, Action: moderationKick},
+			{Strikes: 6, Action: moderationTempBan, Duration: Duration{24 * time.Hour}},
+			{Strikes: 10, Action: moderationBan},
+		}
+	}
+
+	for _, s := range c.Policy {
+		switch {
+		case s.Action == moderationKick, s.Action == moderationBan:
+		case s.Action == moderationTempBan && s.Duration.Duration > 0:
+		case s.Action == moderationTempBan:
+			return nil, errors.New("temporary bans in the strike policy need a duration")
+		default:
+			return nil, errors.New(sprintf("unknown strike policy action %q", s.Action))
+		}
+	}
+	sort.SliceStable(c.Policy, func(i, j int) bool { return c.Policy[i].Strikes < c.Policy[j].Strikes })
+
+	l := &ModerationLedger{
+		gs:     gs,
+		config: c,
+		state:  filepath.Join(datadir, ledgerStateFile),
+		data:   &ledgerState{Entries: make([]*LedgerEntry, 0), Bans: make(map[string]time.Time)},
+	}
+
+	if err := loadJSON(l.state, l.data); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Start enforces bans on players joining the GameServer until the
+// subscription ends
+func (l *ModerationLedger) Start() *Subscription {
+	return l.gs.Bus().Handle("ledger", EventKinds("PlayerJoined"), l.handle)
+}
+
+// Player - Return the standing and history of a player, oldest first
+func (l *ModerationLedger) Player(name string) *LedgerPlayer {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	p := &LedgerPlayer{Name: name, Strikes: l.strikes(name, time.Now()), Entries: make([]*LedgerEntry, 0)}
+	if until, ok := l.data.Bans[name]; ok && (until.IsZero() || until.After(time.Now())) {
+		p.Banned = true
+		p.BannedUntil = until
+	}
+
+	for _, e := range l.data.Entries {
+		if e.Player == name {
+			c := *e
+			p.Entries = append(p.Entries, &c)
+		}
+	}
+	return p
+}
+
+// Recent - Return copies of up to n of the most recent entries, newest first
+func (l *ModerationLedger) Recent(n int) []*LedgerEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if n <= 0 || n > len(l.data.Entries) {
+		n = len(l.data.Entries)
+	}
+
+	res := make([]*LedgerEntry, 0, n)
+	for i := len(l.data.Entries) - 1; i >= len(l.data.Entries)-n; i-- {
+		c := *l.data.Entries[i]
+		res = append(res, &c)
+	}
+	return res
+}
+
+// Note - Add a free text note to the history of a player
+func (l *ModerationLedger) Note(name, by, text string) error {
+	name, text = strings.TrimSpace(name), strings.TrimSpace(text)
+	if name == "" || text == "" {
+		return errors.New("notes need a player and some text")
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.add(&PlayerModerated{EventHeader: newEventHeader(""), Name: name, Action: moderationNote,
+		By: by, Reason: text})
+	return nil
+}
+
+// Unban - Lift the ban of a player. Permanent bans are also removed from the
+// banlist of the GameServer, and the ban is kept if that fails.
+func (l *ModerationLedger) Unban(name, by string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	until, ok := l.data.Bans[name]
+	if !ok {
+		return errors.New(name + " is not banned")
+	}
+
+	if until.IsZero() {
+		if _, err := l.gs.RemoveBan(name); err != nil {
+			return errors.New("unable to remove " + name + " from the banlist: " + err.Error())
+		}
+	}
+
+	delete(l.data.Bans, name)
+	l.add(&PlayerModerated{EventHeader: newEventHeader(""), Name: name, Action: moderationUnban, By: by})
+	return nil
+}
+
+// Pardon - Clear the strikes of a player, keeping their history and any ban
+func (l *ModerationLedger) Pardon(name, by string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.strikes(name, time.Now()) == 0 {
+		return errors.New(name + " has no strikes")
+	}
+
+	l.add(&PlayerModerated{EventHeader: newEventHeader(""), Name: name, Action: moderationPardon, By: by})
+	return nil
+}
+
+// handle keeps banned players out
+func (l *ModerationLedger) handle(ev Event) {
+	joined := ev.(*PlayerJoined)
+
+	l.mu.Lock()
+	until, banned := l.data.Bans[joined.Name]
+	l.mu.Unlock()
+
+	switch {
+	case !banned:
+	case until.IsZero():
+		LogInfo(l.gs, "Banning "+joined.Name+", who is permanently banned", l.gs.WSOutput())
+		if err := l.gs.Console().Ban(joined.Name); err != nil {
+			LogError(l.gs, "Unable to ban "+joined.Name+": "+err.Error())
+		}
+	case until.After(ev.When()):
+		LogInfo(l.gs, sprintf("Kicking %s, who is banned until %s", joined.Name,
+			until.Format("2006-01-02 15:04")), l.gs.WSOutput())
+		if err := l.gs.Console().Kick(joined.Name); err != nil {
+			LogError(l.gs, "Unable to kick "+joined.Name+": "+err.Error())
+		}
+	}
+}
+
+// record adds a moderation event to the ledger, and applies the strike
+// policy if it took the player to a new step
+func (l *ModerationLedger) record(ev *PlayerModerated) {
+	l.mu.Lock()
+	before := l.strikes(ev.Name, ev.When())
+	l.add(ev)
+	after := l.strikes(ev.Name, ev.When())
+	step := l.escalate(before, after)
+	l.mu.Unlock()
+
+	if step != nil {
+		l.enforce(ev.Name, step, after)
+	}
+}
+
+// add records an event, and any ban that it starts. Expects l.mu to be held.
+func (l *ModerationLedger) add(ev *PlayerModerated) {
+	by := ev.By
+	if by == "" {
+		by = ledgerServerActor
+	}
+
+	e := &LedgerEntry{
+		ID:      len(l.data.Entries) + 1,
+		Time:    ev.When(),
+		Player:  ev.Name,
+		Action:  ev.Action,
+		By:      by,
+		Reason:  ev.Reason,
+		Strikes: l.config.Weights[ev.Action],
+		Until:   ev.Until,
+	}
+
+	// What the policy does is the result of strikes, and is not one itself
+	if by == ledgerPolicyActor {
+		e.Strikes = 0
+	}
+	l.data.Entries = append(l.data.Entries, e)
+
+	switch ev.Action {
+	case moderationBan:
+		l.data.Bans[ev.Name] = time.Time{}
+	case moderationTempBan:
+		// Temporary bans never shorten a longer or permanent one
+		if until, ok := l.data.Bans[ev.Name]; !ok || (!until.IsZero() && until.Before(ev.Until)) {
+			l.data.Bans[ev.Name] = ev.Until
+		}
+	}
+	l.save()
+
+	msg := sprintf("%s: %s by %s", ev.Name, ev.Action, by)
+	if ev.Reason != "" {
+		msg += ": " + ev.Reason
+	}
+	LogInfo(l.gs, "Ledger: "+msg)
+	if ev.Action != moderationNote {
+		l.gs.EventLog().Add(eventKindLedger, msg)
+	}
+}
+
+// strikes returns the strikes that a player has had within the decay period,
+// since they were last pardoned. Expects l.mu to be held.
+func (l *ModerationLedger) strikes(name string, now time.Time) int {
+	n := 0
+	for _, e := range l.data.Entries {
+		switch {
+		case e.Player != name:
+		case e.Action == moderationPardon:
+			n = 0
+		case now.Sub(e.Time) < l.config.Decay.Duration:
+			n += e.Strikes
+		}
+	}
+	return n
+}
+
+// escalate returns the harshest step of the policy that a player reached by
+// going from one number of strikes to another, or nil
+func (l *ModerationLedger) escalate(before, after int) *StrikeStep {
+	var res *StrikeStep
+	for i, s := range l.config.Policy {
+		if before < s.Strikes && after >= s.Strikes {
+			res = &l.config.Policy[i]
+		}
+	}
+	return res
+}
+
+// enforce applies a step of the strike policy to a player
+func (l *ModerationLedger) enforce(name string, step *StrikeStep, strikes int) {
+	reason := sprintf("reached %d strikes", strikes)
+
+	var err error
+	switch step.Action {
+	case moderationKick:
+		if l.gs.Player(name) == nil {
+			return
+		}
+		l.gs.Console().Say(sprintf("%s was kicked for reaching %d strikes", name, strikes))
+		err = moderatePlayer(l.gs, moderationKick, name, ledgerPolicyActor, reason, time.Time{})
+	case moderationBan:
+		l.gs.Console().Say(sprintf("%s was banned for reaching %d strikes", name, strikes))
+		err = moderatePlayer(l.gs, moderationBan, name, ledgerPolicyActor, reason, time.Time{})
+	case moderationTempBan:
+		until := time.Now().Add(step.Duration.Duration)
+		l.gs.Console().Say(sprintf("%s was banned until %s for reaching %d strikes", name,
+			until.Format("15:04"), strikes))
+		err = moderatePlayer(l.gs, moderationTempBan, name, ledgerPolicyActor, reason, until)
+	}
+
+	if err != nil {
+		LogError(l.gs, sprintf("Unable to %s %s: %s", step.Action, name, err.Error()))
+	}
+}
+
+// save writes the ledger to disk. Expects l.mu to be held.
+func (l *ModerationLedger) save() {
+	if err := saveJSON(l.state, l.data); err != nil {
+		LogError(l.gs, "Unable to save the moderation ledger: "+err.Error())
+	}
+}
+
+// moderatePlayer warns, kicks or bans a player, records it in the ledger and
+// publishes it. Temporary bans kick the player, and the ledger keeps them out
+// until the ban ends. Players that are offline can still be banned, and are
+// banned by Terraria when they next join.
+func moderatePlayer(gs GameServer, action, name, by, reason string, until time.Time) error {
+	var err error
+	c := gs.Console()
+	switch action {
+	case moderationWarn:
+		if reason == "" {
+			return errors.New("warnings need a reason")
+		}
+		err = c.Say(sprintf("%s: %s", name, reason))
+	case moderationKick:
+		if gs.Player(name) == nil {
+			return errors.New(name + " is not online")
+		}
+		err = c.Kick(name)
+	case moderationTempBan:
+		if gs.Player(name) != nil {
+			err = c.Kick(name)
+		}
+	case moderationBan:
+		if gs.Player(name) != nil {
+			err = c.Ban(name)
+		}
+	default:
+		return errors.New("unknown moderation action " + action)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	recordModeration(gs, &PlayerModerated{
+		EventHeader: newEventHeader(""),
+		Name:        name,
+		Action:      action,
+		By:          by,
+		Reason:      reason,
+		Until:       until,
+	})
+	return nil
+}
+
+// recordModeration records a moderation event in the ledger of the
+// GameServer, if it has one, and then publishes it for anything that wants to
+// be notified
+func recordModeration(gs GameServer, ev *PlayerModerated) {
+	if l := gs.Ledger(); l != nil {
+		l.record(ev)
+	}
+	gs.Bus().Publish(ev)
+}
@@ -17,6 +17,7 @@ const (
 	infoPrefix    = "INFO"
 	initPrefix    = "INIT"
 	chatPrefix    = "CHAT"
+	eventPrefix   = "EVENT"
 
 	debugLevel   = 2
 	verboseLevel = 2
@@ -125,6 +126,16 @@ func LogChat(l Loggable, m string, chs ...chan []byte) {
 	sendToChans(sprintf("[%s] %s", chatPrefix, m), chs)
 }
 
+// LogEvent logs a game event such as a boss fight or invasion, labeled with the
+// kind of event (ex: [EVENT] (Boss) Eye of Cthulhu has awoken!)
+func LogEvent(l Loggable, kind, m string, chs ...chan []byte) {
+	m = sprintf("[%s] (%s) %s", eventPrefix, kind, m)
+	if l.Loglevel() >= infoLevel {
+		log.Output(1, m)
+	}
+	sendToChans(m, chs)
+}
+
 // LogHTTP logs an HTTP response code and string. Provides formatting for the
 // response, and will output if the loglevel of the object is 1 or greater
 func LogHTTP(l Loggable, rc int, r *http.Request, chs ...chan []byte) {
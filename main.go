@@ -6,19 +6,124 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"syscall"
 )
 
 // Very temporary
 func main() {
+	cfg, err := LoadConfiguration(defaultConfigFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	out := make(chan []byte)
 	hub := NewConnHub(out)
 
 	ts := NewTerrariaServer(out, "D:\\Games\\GOG\\Windows\\Terraria\\TerrariaServer.exe")
 
+	if err := ts.EventLog().Load(filepath.Join(cfg.DataDir, "events.json")); err != nil {
+		LogError(ts, "Unable to load event log: "+err.Error())
+	}
+
+	if err := ts.IllegalNames().Load(filepath.Join(cfg.DataDir, "illegalnames.json")); err != nil {
+		log.Fatal(err)
+	}
+
+	worlds := NewWorldManager(ts, cfg.Worlds, cfg.DataDir)
+	backups := NewBackupManager(ts, cfg.Backups)
+	guard := NewWorldGuard(ts, backups, cfg.Integrity)
+	ts.OnStart(guard.Check)
+	ts.OnRestart(func() {
+		if _, err := backups.Snapshot(backupReasonRestart); err != nil {
+			LogError(ts, "Backup before restart failed: "+err.Error(), out)
+		}
+	})
+
+	rotator, err := NewWorldRotator(ts, worlds, backups, cfg.Rotation, cfg.DataDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	triggers, err := NewTriggerEngine(ts, cfg.Triggers)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	progression, err := NewProgressionTracker(ts, cfg.DataDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	deaths, err := NewDeathTracker(ts, cfg.Deaths, cfg.DataDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Set up first, so that it records everything that the others do
+	ledger, err := NewModerationLedger(ts, cfg.Ledger, cfg.DataDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	ts.SetLedger(ledger)
+	ledger.Start()
+	logGameEvents(ts)
+
+	chat, err := NewChatCommands(ts, cfg.Chat)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := chat.RegisterSessionCommands(deaths); err != nil {
+		log.Fatal(err)
+	}
+	votes, err := NewVoteManager(ts, chat, cfg.Votes)
+	if err != nil {
+		log.Fatal(err)
+	}
+	votes.Watch()
+
+	reports, err := NewReportQueue(ts, cfg.Reports, cfg.DataDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := chat.RegisterReportCommands(reports); err != nil {
+		log.Fatal(err)
+	}
+	reports.Start()
+	chat.Start()
+
+	moderator, err := NewChatModerator(ts, chat, cfg.Moderation, cfg.DataDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	names, err := NewNameGuard(ts, chat, cfg.Names, cfg.DataDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	ts.OnNewPlayer(names.Enforce)
+
 	go hub.Start()
+	go backups.Start()
+	go rotator.Start()
+	go triggers.Start()
+	go progression.Start()
+	go deaths.Start()
+	go moderator.Start()
 
 	serveHTTP(hub, ts, out)
+	serveBackupHTTP(backups, ts)
+	serveWorldHTTP(worlds, ts)
+	serveRotationHTTP(rotator, ts)
+	serveIntegrityHTTP(guard, ts)
+	serveTriggerHTTP(triggers, ts)
+	serveProgressionHTTP(progression, ts)
+	serveDeathHTTP(deaths, ts)
+	serveReportHTTP(reports, ts)
+	serveModerationHTTP(moderator, ts)
+	serveLedgerHTTP(ledger, ts)
+	serveNameHTTP(names, ts)
+	serveIllegalNameHTTP(ts)
 
 	go func() {
 		log.Output(1, "Starting webserver")
@@ -26,8 +131,7 @@ func main() {
 	}()
 
 	if err := ts.Start(); err != nil {
-		log.Output(1, err.Error())
-		os.Exit(1)
+		LogError(ts, "Unable to start Terraria: "+err.Error(), out)
 	}
 
 	log.Output(1, "Completed INIT. Waiting for termination signal")
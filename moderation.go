@@ -0,0 +1,407 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+const (
+	defaultModerationFile    = "moderation.json"
+	moderationStateFile      = "chatmoderation.json"
+	moderationReloadInterval = 5 * time.Second
+	eventKindModeration      = "moderation"
+
+	moderationWarn    = "warn"
+	moderationKick    = "kick"
+	moderationTempBan = "tempban"
+)
+
+// Links are anything with a scheme or www, or a bare domain with a common TLD
+var linkExpression = regexp.MustCompile(
+	`(?i)\b(?:https?://|www\.)[^\s/]+|\b[a-z0-9-]+(?:\.[a-z0-9-]+)*\.(?:com|net|org|gg|io|xyz|ru|me|co|tk|ly)\b`)
+
+// ModerationConfig configures chat moderation. The rules themselves are kept
+// in their own file so that they can be tuned and reloaded while running.
+type ModerationConfig struct {
+	File string `json:"file"`
+}
+
+// ModerationRules are the checks applied to chat. Any field left out of the
+// rules file keeps its default, and checks with a zero count are disabled.
+type ModerationRules struct {
+	Words    []string        `json:"words"`    // Matched as whole words, ignoring case
+	Patterns []string        `json:"patterns"` // Regular expressions
+	Repeat   ModerationLimit `json:"repeat"`   // The same message Count times in Window
+	Flood    ModerationLimit `json:"flood"`    // Count messages in Window
+	Caps     ModerationCaps  `json:"caps"`
+	Links    ModerationLinks `json:"links"`
+}
+
+// ModerationLimit is a number of messages in a window of time
+type ModerationLimit struct {
+	Count  int      `json:"count"`
+	Window Duration `json:"window"`
+}
+
+// ModerationCaps flags messages with at least MinLength letters, of which at
+// least Percent are upper case
+type ModerationCaps struct {
+	MinLength int     `json:"min_length"`
+	Percent   float64 `json:"percent"`
+}
+
+// ModerationLinks flags links, other than to the Allowed domains
+type ModerationLinks struct {
+	Block   bool     `json:"block"`
+	Allowed []string `json:"allowed"`
+}
+
+// ModerationAction is a record of a rule that a player broke
+type ModerationAction struct {
+	Time    time.Time
+	Rule    string
+	Message string
+}
+
+// ModerationRecord is the chat moderation history of a player
+type ModerationRecord struct {
+	Player  string
+	Actions []*ModerationAction
+}
+
+// moderationFilter is a compiled set of ModerationRules
+type moderationFilter struct {
+	rules    ModerationRules
+	words    *regexp.Regexp
+	patterns []*regexp.Regexp
+}
+
+// ChatModerator checks the chat of a GameServer against the moderation rules,
+// and warns players that break them. The rules file is reloaded whenever it
+// changes. Warnings are recorded in the ModerationLedger, whose strike policy
+// decides when players that keep breaking the rules are kicked or banned.
+type ChatModerator struct {
+	gs     GameServer
+	chat   *ChatCommands
+	config ModerationConfig
+	state  string
+
+	mu       sync.Mutex
+	filter   *moderationFilter
+	records  map[string]*ModerationRecord
+	history  map[string][]*ChatLine
+	modified time.Time
+	close    chan struct{}
+}
+
+// defaultModerationRules returns the rules used for anything that the rules
+// file does not set
+func defaultModerationRules() ModerationRules {
+	return ModerationRules{
+		Words:    []string{},
+		Patterns: []string{},
+		Repeat:   ModerationLimit{Count: 3, Window: Duration{30 * time.Second}},
+		Flood:    ModerationLimit{Count: 6, Window: Duration{10 * time.Second}},
+		Caps:     ModerationCaps{MinLength: 12, Percent: 80},
+		Links:    ModerationLinks{Allowed: []string{}},
+	}
+}
+
+// NewChatModerator returns a ChatModerator, loads its rules, and loads the
+// moderation records saved in datadir. A missing rules file is not an error.
+// Players with a moderator permission level or higher are not moderated.
+func NewChatModerator(gs GameServer, cc *ChatCommands, c ModerationConfig, datadir string) (*ChatModerator, error) {
+	if c.File == "" {
+		c.File = defaultModerationFile
+	}
+
+	m := &ChatModerator{
+		gs:      gs,
+		chat:    cc,
+		config:  c,
+		state:   filepath.Join(datadir, moderationStateFile),
+		records: make(map[string]*ModerationRecord),
+		history: make(map[string][]*ChatLine),
+		close:   make(chan struct{}),
+	}
+
+	if err := loadJSON(m.state, &m.records); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	if err := m.Reload(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Start moderates the chat of the GameServer and watches the rules file for
+// changes until Stop is called
+func (m *ChatModerator) Start() {
+	sub := m.gs.Bus().Handle("moderation", EventKinds("Chat"), m.handle)
+	defer m.gs.Bus().Unsubscribe(sub)
+
+	tick := time.NewTicker(moderationReloadInterval)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-m.close:
+			return
+		case <-tick.C:
+			fi, err := os.Stat(m.config.File)
+			if err != nil {
+				continue
+			}
+
+			m.mu.Lock()
+			changed := !fi.ModTime().Equal(m.modified)
+			m.mu.Unlock()
+
+			if changed {
+				if err := m.Reload(); err != nil {
+					LogError(m.gs, "Unable to reload moderation rules, keeping the previous ones: "+
+						err.Error(), m.gs.WSOutput())
+				}
+			}
+		}
+	}
+}
+
+// Stop ends chat moderation
+func (m *ChatModerator) Stop() {
+	close(m.close)
+}
+
+// Reload reads and compiles the rules file. If the rules are invalid the
+// current rules are kept.
+func (m *ChatModerator) Reload() error {
+	var modified time.Time
+	if fi, err := os.Stat(m.config.File); err == nil {
+		modified = fi.ModTime()
+	}
+
+	rules := defaultModerationRules()
+	if err := loadJSON(m.config.File, &rules); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	f, err := compileModerationRules(rules)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	m.filter = f
+	m.modified = modified
+	m.mu.Unlock()
+
+	LogInfo(m.gs, sprintf("Loaded moderation rules from %s (%d words, %d patterns)",
+		m.config.File, len(rules.Words), len(rules.Patterns)))
+	return nil
+}
+
+// Rules returns the moderation rules in use
+func (m *ChatModerator) Rules() ModerationRules {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.filter.rules
+}
+
+// Records returns copies of the moderation records of every player
+func (m *ChatModerator) Records() []*ModerationRecord {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	res := make([]*ModerationRecord, 0, len(m.records))
+	for _, r := range m.records {
+		c := *r
+		c.Actions = append([]*ModerationAction{}, r.Actions...)
+		res = append(res, &c)
+	}
+	return res
+}
+
+// handle checks chat messages against the rules
+func (m *ChatModerator) handle(ev Event) {
+	chat := ev.(*Chat)
+	if chat.Name == chatServerName || m.chat.Level(chat.Name) >= PermissionModerator {
+		return
+	}
+	if rule := m.check(chat.Name, chat.Message, chat.When()); rule != "" {
+		m.strike(chat.Name, rule, chat.Message, chat.When())
+	}
+}
+
+// check returns the rule that a chat message breaks, or an empty string
+func (m *ChatModerator) check(name, msg string, now time.Time) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	f := m.filter
+	rules := f.rules
+
+	// Keep enough history for the longest window
+	window := rules.Repeat.Window.Duration
+	if rules.Flood.Window.Duration > window {
+		window = rules.Flood.Window.Duration
+	}
+
+	history := make([]*ChatLine, 0)
+	for _, l := range m.history[name] {
+		if now.Sub(l.Time) < window {
+			history = append(history, l)
+		}
+	}
+	history = append(history, &ChatLine{Time: now, Name: name, Message: msg})
+	m.history[name] = history
+
+	switch {
+	case f.words != nil && f.words.MatchString(msg):
+		return "language"
+	case f.pattern(msg):
+		return "pattern"
+	case rules.Links.Block && f.link(msg):
+		return "links"
+	case rules.Caps.MinLength > 0 && shouting(msg, rules.Caps):
+		return "caps"
+	case rules.Repeat.Count > 0 && repeats(history, msg, now, rules.Repeat) >= rules.Repeat.Count:
+		return "repeating"
+	case rules.Flood.Count > 0 && within(history, now, rules.Flood.Window.Duration) >= rules.Flood.Count:
+		return "flooding"
+	}
+	return ""
+}
+
+// strike records a broken rule against a player, and warns them. The warning
+// counts towards the strike policy of the ledger.
+func (m *ChatModerator) strike(name, rule, msg string, now time.Time) {
+	m.mu.Lock()
+	r, ok := m.records[name]
+	if !ok {
+		r = &ModerationRecord{Player: name, Actions: make([]*ModerationAction, 0)}
+		m.records[name] = r
+	}
+	r.Actions = append(r.Actions, &ModerationAction{Time: now, Rule: rule, Message: msg})
+
+	// Flood and repeat checks would otherwise strike every following message
+	delete(m.history, name)
+	m.save()
+	m.mu.Unlock()
+
+	logmsg := sprintf("%s broke the %s rule: %s", name, rule, msg)
+	LogEvent(m.gs, "Moderation", logmsg, m.gs.WSOutput())
+	m.gs.EventLog().Add(eventKindModeration, logmsg)
+
+	if err := moderatePlayer(m.gs, moderationWarn, name, eventKindModeration,
+		sprintf("please keep chat friendly, no %s", rule), time.Time{}); err != nil {
+		LogError(m.gs, sprintf("Unable to warn %s: %s", name, err.Error()))
+	}
+}
+
+// save writes the moderation records to disk. Expects m.mu to be held.
+func (m *ChatModerator) save() {
+	if err := saveJSON(m.state, m.records); err != nil {
+		LogError(m.gs, "Unable to save moderation records: "+err.Error())
+	}
+}
+
+// compileModerationRules checks and compiles a set of rules
+func compileModerationRules(rules ModerationRules) (*moderationFilter, error) {
+	f := &moderationFilter{rules: rules, patterns: make([]*regexp.Regexp, 0)}
+
+	// An empty word would match at every word boundary
+	quoted := make([]string, 0, len(rules.Words))
+	for _, w := range rules.Words {
+		if w = strings.TrimSpace(w); w != "" {
+			quoted = append(quoted, regexp.QuoteMeta(w))
+		}
+	}
+	if len(quoted) > 0 {
+		f.words = regexp.MustCompile(`(?i)\b(?:` + strings.Join(quoted, "|") + `)\b`)
+	}
+
+	for _, p := range rules.Patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, errors.New(sprintf("invalid moderation pattern %q: %s", p, err.Error()))
+		}
+		f.patterns = append(f.patterns, re)
+	}
+
+	return f, nil
+}
+
+func (f *moderationFilter) pattern(msg string) bool {
+	for _, re := range f.patterns {
+		if re.MatchString(msg) {
+			return true
+		}
+	}
+	return false
+}
+
+// link returns true if a message has a link to a domain that is not allowed
+func (f *moderationFilter) link(msg string) bool {
+	for _, l := range linkExpression.FindAllString(msg, -1) {
+		host := strings.ToLower(l)
+		host = strings.TrimPrefix(strings.TrimPrefix(host, "http://"), "https://")
+		host = strings.TrimPrefix(host, "www.")
+
+		allowed := false
+		for _, d := range f.rules.Links.Allowed {
+			d = strings.ToLower(d)
+			if host == d || strings.HasSuffix(host, "."+d) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// shouting returns true if too much of a message is in capitals
+func shouting(msg string, c ModerationCaps) bool {
+	letters, upper := 0, 0
+	for _, r := range msg {
+		if unicode.IsLetter(r) {
+			letters++
+			if unicode.IsUpper(r) {
+				upper++
+			}
+		}
+	}
+	return letters >= c.MinLength && float64(upper)*100 >= float64(letters)*c.Percent
+}
+
+// repeats returns how many times a message was sent in the window
+func repeats(history []*ChatLine, msg string, now time.Time, l ModerationLimit) int {
+	n := 0
+	msg = strings.ToLower(strings.TrimSpace(msg))
+	for _, h := range history {
+		if now.Sub(h.Time) < l.Window.Duration && strings.ToLower(strings.TrimSpace(h.Message)) == msg {
+			n++
+		}
+	}
+	return n
+}
+
+// within returns how many messages were sent in the window
+func within(history []*ChatLine, now time.Time, window time.Duration) int {
+	n := 0
+	for _, h := range history {
+		if now.Sub(h.Time) < window {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,466 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+const (
+	namePolicyStateFile      = "names.json"
+	defaultNameMaxLength     = 20
+	defaultNameProtectRecent = 7 * 24 * time.Hour
+	defaultNameReserved      = "admin,administrator,moderator,mod,server,system,owner,staff"
+	namePolicyActor          = "name policy"
+
+	// Shortest skeleton that is looked for among the words of other names, so
+	// that short names and words do not match everything
+	nameContainsMinimum = 4
+
+	nameRuleIllegal       = "illegal"
+	nameRuleLength        = "length"
+	nameRuleCharacters    = "characters"
+	nameRuleWhitespace    = "whitespace"
+	nameRuleReserved      = "reserved"
+	nameRuleImpersonation = "impersonation"
+	nameRuleConfusable    = "confusable"
+
+	nameProtectedStaff  = "staff"
+	nameProtectedConfig = "protected"
+	nameProtectedRecent = "recently seen"
+)
+
+// Characters that render as nothing, or as a blank, but are not format
+// characters or spaces as far as the unicode package is concerned
+const nameInvisibleRunes = "\u00ad\u034f\u115f\u1160\u17b4\u17b5\u180e\u3164\uffa0"
+
+// Letters that look like latin letters, and the leetspeak stand ins for them,
+// folded to the latin letter that they are mistaken for. Letters that are
+// easily confused with each other (i, l, 1, |) all fold to the same letter.
+var nameConfusables = map[rune]string{
+	// Cyrillic
+	'а': "a", 'в': "b", 'е': "e", 'ё': "e", 'к': "k", 'м': "m", 'н': "h", 'о': "o",
+	'р': "p", 'с': "c", 'т': "t", 'у': "y", 'х': "x", 'ѕ': "s", 'і': "l", 'ї': "l",
+	'ј': "j", 'ԁ': "d", 'ԛ': "q", 'ԝ': "w", 'һ': "h", 'ӏ': "l", 'ь': "b",
+	// Greek
+	'α': "a", 'β': "b", 'ε': "e", 'η': "n", 'ι': "l", 'κ': "k", 'ν': "v", 'ο': "o",
+	'ρ': "p", 'τ': "t", 'υ': "u", 'χ': "x", 'ω': "w", 'μ': "u",
+	// Latin lookalikes
+	'ı': "l", 'ɡ': "g", 'ɑ': "a", 'ß': "b", 'ð': "d", 'ø': "o", 'ł': "l", 'ŀ': "l",
+	// Leetspeak and lookalike symbols
+	'0': "o", '1': "l", '!': "l", '|': "l", 'i': "l", '2': "z", '3': "e", '4': "a",
+	'@': "a", '5': "s", '$': "s", '6': "g", '7': "t", '+': "t", '8': "b", '9': "g",
+	'€': "e", '£': "l", '¥': "y",
+}
+
+// Letter pairs that read as a single letter once folded
+var nameConfusablePairs = strings.NewReplacer("rn", "m", "vv", "w", "cl", "d")
+
+// NamePolicy is the set of rules that player names are checked against. The
+// names of staff (chat users at moderator or above), Protected names and
+// players seen within ProtectRecent (off if negative) can not be imitated.
+// Names breaking the policy are kicked when they join, unless WarnOnly is set.
+type NamePolicy struct {
+	MinLength     int      `json:"min_length"`
+	MaxLength     int      `json:"max_length"`
+	ASCIIOnly     bool     `json:"ascii_only"`
+	Pattern       string   `json:"pattern,omitempty"` // Names must match, if set
+	Reserved      []string `json:"reserved"`
+	Protected     []string `json:"protected"`
+	ProtectRecent Duration `json:"protect_recent"`
+	WarnOnly      bool     `json:"warn_only"`
+}
+
+// NameViolation is a rule that a name breaks, and why
+type NameViolation struct {
+	Rule   string
+	Detail string
+}
+
+// NameCheck is the result of checking a name against the policy
+type NameCheck struct {
+	Name       string
+	Skeleton   string
+	Allowed    bool
+	Violations []*NameViolation
+}
+
+// namePolicyState is what is saved between runs. Policy is only set once it
+// has been changed through the API, and then takes the place of the policy in
+// the configuration.
+type namePolicyState struct {
+	Policy *NamePolicy `json:",omitempty"`
+	Seen   map[string]time.Time
+}
+
+// NameGuard checks the names of players joining a GameServer against a
+// NamePolicy, and catches names made to look like those of staff or of other
+// players through lookalike letters, leetspeak, case and whitespace tricks
+type NameGuard struct {
+	gs    GameServer
+	chat  *ChatCommands
+	state string
+
+	mu      sync.Mutex
+	policy  NamePolicy
+	pattern *regexp.Regexp
+	seen    map[string]time.Time
+}
+
+// NewNameGuard returns a NameGuard using the given policy, or the policy saved
+// in datadir if it was changed through the API
+func NewNameGuard(gs GameServer, cc *ChatCommands, p NamePolicy, datadir string) (*NameGuard, error) {
+	g := &NameGuard{
+		gs:    gs,
+		chat:  cc,
+		state: filepath.Join(datadir, namePolicyStateFile),
+		seen:  make(map[string]time.Time),
+	}
+
+	saved := &namePolicyState{Seen: g.seen}
+	if err := loadJSON(g.state, saved); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if saved.Seen != nil {
+		g.seen = saved.Seen
+	}
+	if saved.Policy != nil {
+		p = *saved.Policy
+	}
+
+	if err := g.set(p); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// Enforce checks the name of a player once they are listed as connected, and
+// kicks them if it breaks the policy. Checking then rather than on the join
+// message means that the player can be kicked, and that their IP is known for
+// telling staff apart from someone using their name.
+func (g *NameGuard) Enforce(p Player) {
+	name := p.Name()
+	c := g.Check(name)
+
+	g.mu.Lock()
+	warn := g.policy.WarnOnly
+	if c.Allowed {
+		g.seen[name] = time.Now()
+		g.save()
+	}
+	g.mu.Unlock()
+
+	if c.Allowed {
+		return
+	}
+
+	reasons := make([]string, 0, len(c.Violations))
+	for _, v := range c.Violations {
+		reasons = append(reasons, v.Detail)
+	}
+	msg := sprintf("%s has a name that breaks the name policy: %s", name, strings.Join(reasons, "; "))
+	LogWarning(g.gs, msg, g.gs.WSOutput())
+
+	if warn {
+		return
+	}
+
+	g.gs.Console().Say(sprintf("Kicking player: \"%s\". Name is not allowed.", name))
+	if err := moderatePlayer(g.gs, moderationKick, name, namePolicyActor, strings.Join(reasons, "; "),
+		time.Time{}); err != nil {
+		LogError(g.gs, "Unable to kick "+name+": "+err.Error())
+	}
+}
+
+// Policy - Return the name policy in use
+func (g *NameGuard) Policy() NamePolicy {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.policy
+}
+
+// SetPolicy - Replace the name policy, saving it so that it is used from now
+// on in place of the policy in the configuration
+func (g *NameGuard) SetPolicy(p NamePolicy) error {
+	if err := g.set(p); err != nil {
+		return err
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.save()
+	LogInfo(g.gs, "Updated the name policy", g.gs.WSOutput())
+	return nil
+}
+
+// Check - Check a name against the policy, explaining every rule that it
+// breaks
+func (g *NameGuard) Check(name string) *NameCheck {
+	protected := g.protected(name)
+
+	g.mu.Lock()
+	p := g.policy
+	pattern := g.pattern
+	g.mu.Unlock()
+
+	c := &NameCheck{Name: name, Skeleton: nameSkeleton(name), Violations: make([]*NameViolation, 0)}
+	words := nameWords(name)
+	fail := func(rule, detail string, args ...interface{}) {
+		c.Violations = append(c.Violations, &NameViolation{Rule: rule, Detail: sprintf(detail, args...)})
+	}
+
+	if r := g.gs.IllegalNames().Match(name); r != nil {
+		fail(nameRuleIllegal, "matches the illegal name pattern %s", r.Pattern)
+	}
+
+	length := len([]rune(name))
+	switch {
+	case p.MinLength > 0 && length < p.MinLength:
+		fail(nameRuleLength, "is shorter than %d characters", p.MinLength)
+	case p.MaxLength > 0 && length > p.MaxLength:
+		fail(nameRuleLength, "is longer than %d characters", p.MaxLength)
+	}
+
+	if i := strings.IndexFunc(name, nameInvisible); i >= 0 {
+		fail(nameRuleCharacters, "contains an invisible character (U+%04X)", []rune(name[i:])[0])
+	}
+	if i := strings.IndexFunc(name, unicode.IsControl); i >= 0 {
+		fail(nameRuleCharacters, "contains a control character (U+%04X)", []rune(name[i:])[0])
+	}
+	if i := strings.IndexFunc(name, func(r rune) bool { return r > unicode.MaxASCII }); p.ASCIIOnly && i >= 0 {
+		fail(nameRuleCharacters, "contains a non-ASCII character (%q)", []rune(name[i:])[0])
+	}
+
+	if pattern != nil && !pattern.MatchString(name) {
+		fail(nameRuleCharacters, "does not match the allowed pattern %s", p.Pattern)
+	}
+
+	switch {
+	case strings.TrimSpace(name) != name:
+		fail(nameRuleWhitespace, "starts or ends with whitespace")
+	case strings.Contains(name, "  "):
+		fail(nameRuleWhitespace, "has repeated spaces")
+	case strings.IndexFunc(name, func(r rune) bool { return unicode.IsSpace(r) && r != ' ' }) >= 0:
+		fail(nameRuleWhitespace, "has whitespace other than spaces")
+	}
+
+	for _, w := range p.Reserved {
+		sk := nameSkeleton(w)
+		switch {
+		case sk == "":
+		case sk == c.Skeleton:
+			fail(nameRuleReserved, "is the reserved word %q", w)
+		case len(sk) >= nameContainsMinimum && nameHasWords(words, sk):
+			fail(nameRuleReserved, "contains the reserved word %q", w)
+		}
+	}
+
+	for other, kind := range protected {
+		sk := nameSkeleton(other)
+		switch {
+		case sk == "":
+		case other == name:
+			// Staff can only be impersonated exactly when they have an IP set
+			if kind == nameProtectedStaff {
+				fail(nameRuleImpersonation, "is the name of a member of staff, from another IP address")
+			}
+		case sk == c.Skeleton:
+			fail(nameRuleConfusable, "looks like %s (%s)", other, kind)
+		case kind != nameProtectedRecent && len(sk) >= nameContainsMinimum &&
+			nameHasWords(words, sk):
+			fail(nameRuleConfusable, "contains a lookalike of %s (%s)", other, kind)
+		}
+	}
+
+	c.Allowed = len(c.Violations) == 0
+	return c
+}
+
+// protected returns the names that can not be imitated by the given name,
+// and why. Staff whose name matches exactly are left out unless they have an
+// IP set that the player is not connecting from.
+func (g *NameGuard) protected(name string) map[string]string {
+	names := make(map[string]string)
+
+	g.mu.Lock()
+	if g.policy.ProtectRecent.Duration > 0 {
+		for n, t := range g.seen {
+			if time.Since(t) < g.policy.ProtectRecent.Duration {
+				names[n] = nameProtectedRecent
+			}
+		}
+	}
+	for _, n := range g.policy.Protected {
+		names[n] = nameProtectedConfig
+	}
+	g.mu.Unlock()
+
+	for _, u := range g.chat.config.Users {
+		if permissionNames[u.Level] < PermissionModerator {
+			continue
+		}
+		if u.Name == name && g.chat.Level(name) >= PermissionModerator {
+			delete(names, u.Name)
+			continue
+		}
+		names[u.Name] = nameProtectedStaff
+	}
+	return names
+}
+
+// set checks and compiles a policy, and puts it in place
+func (g *NameGuard) set(p NamePolicy) error {
+	if p.MaxLength <= 0 {
+		p.MaxLength = defaultNameMaxLength
+	}
+	if p.MinLength < 0 || p.MinLength > p.MaxLength {
+		return errors.New("the minimum name length must be between 0 and the maximum")
+	}
+	if p.Reserved == nil {
+		p.Reserved = strings.Split(defaultNameReserved, ",")
+	}
+	if p.Protected == nil {
+		p.Protected = []string{}
+	}
+	if p.ProtectRecent.Duration == 0 {
+		p.ProtectRecent.Duration = defaultNameProtectRecent
+	}
+
+	var re *regexp.Regexp
+	if p.Pattern != "" {
+		var err error
+		if re, err = regexp.Compile(p.Pattern); err != nil {
+			return errors.New("invalid name pattern: " + err.Error())
+		}
+	}
+
+	g.mu.Lock()
+	g.policy = p
+	g.pattern = re
+	g.mu.Unlock()
+	return nil
+}
+
+// save writes the policy and the players seen to disk. Expects g.mu to be
+// held.
+func (g *NameGuard) save() {
+	p := g.policy
+	if err := saveJSON(g.state, &namePolicyState{Policy: &p, Seen: g.seen}); err != nil {
+		LogError(g.gs, "Unable to save the name policy: "+err.Error())
+	}
+}
+
+// nameSkeleton folds a name down to what it looks like, so that names that
+// look alike have the same skeleton. Case, whitespace, punctuation, invisible
+// characters and accents are dropped, full width letters are narrowed, and
+// lookalike letters and leetspeak are folded to the latin letter that they
+// look like.
+func nameSkeleton(name string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(name) {
+		// Full width forms of ASCII
+		if r >= 0xff01 && r <= 0xff5e {
+			r = unicode.ToLower(r - 0xfee0)
+		}
+
+		if s, ok := nameConfusables[r]; ok {
+			b.WriteString(s)
+			continue
+		}
+
+		switch {
+		case unicode.Is(unicode.Mn, r), nameInvisible(r), unicode.IsSpace(r), unicode.IsPunct(r),
+			unicode.IsSymbol(r):
+		case r > unicode.MaxASCII && unicode.IsLetter(r):
+			r = foldAccent(r)
+			if s, ok := nameConfusables[r]; ok {
+				b.WriteString(s)
+			} else {
+				b.WriteRune(r)
+			}
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return nameConfusablePairs.Replace(b.String())
+}
+
+// nameWords splits a name into the skeletons of the words that it is made of.
+// Words are separated by whitespace, punctuation and symbols other than the
+// leetspeak ones, and by changes of case (ex: TheAdmin is The and Admin).
+func nameWords(name string) []string {
+	words := make([]string, 0)
+	word := make([]rune, 0)
+	flush := func() {
+		if sk := nameSkeleton(string(word)); sk != "" {
+			words = append(words, sk)
+		}
+		word = word[:0]
+	}
+
+	rs := []rune(name)
+	for i, r := range rs {
+		_, leet := nameConfusables[r]
+		if !leet && (unicode.IsSpace(r) || nameInvisible(r) || unicode.IsPunct(r) || unicode.IsSymbol(r)) {
+			flush()
+			continue
+		}
+
+		// Split before the capital that starts a word, as in theAdmin,
+		// th3Admin and THEAdmin
+		if len(word) > 0 && unicode.IsUpper(r) {
+			prev := rs[i-1]
+			if !unicode.IsUpper(prev) || (i+1 < len(rs) && unicode.IsLower(rs[i+1])) {
+				flush()
+			}
+		}
+		word = append(word, r)
+	}
+	flush()
+	return words
+}
+
+// nameHasWords returns true if one or more consecutive words of a name have
+// the skeleton sk together, so that a reserved word or a protected name is
+// only found when it is written as whole words, not as part of another word
+func nameHasWords(words []string, sk string) bool {
+	for i := range words {
+		joined := ""
+		for _, w := range words[i:] {
+			joined += w
+			if joined == sk {
+				return true
+			}
+			if len(joined) >= len(sk) {
+				break
+			}
+		}
+	}
+	return false
+}
+
+// foldAccent returns the unaccented form of the common accented latin letters
+func foldAccent(r rune) rune {
+	const (
+		accented = "àáâãäåāăąçćĉċčďđèéêëēĕėęěĝğġģĥħìíîïĩīĭįĵķĺļľñńņňòóôõöōŏőŕŗřśŝşšţťùúûüũūŭůűųŵýÿŷźżž"
+		plain    = "aaaaaaaaacccccddeeeeeeeeegggghhiiiiiiiijklllnnnnoooooooorrrssssttuuuuuuuuuuwyyyzzz"
+	)
+
+	pr := []rune(plain)
+	for i, a := range []rune(accented) {
+		if a == r {
+			return pr[i]
+		}
+	}
+	return r
+}
+
+// nameInvisible returns true for characters that do not show up in a name
+func nameInvisible(r rune) bool {
+	return unicode.Is(unicode.Cf, r) || strings.ContainsRune(nameInvisibleRunes, r)
+}
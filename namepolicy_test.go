@@ -0,0 +1,97 @@
+package main
+
+import "testing"
+
+// nameTestServer is a GameServer with the default illegal names and nobody
+// connected
+type nameTestServer struct {
+	GameServer
+	illegal *IllegalNames
+}
+
+func (s nameTestServer) IllegalNames() *IllegalNames { return s.illegal }
+func (nameTestServer) Player(string) Player          { return nil }
+
+func TestNameSkeleton(t *testing.T) {
+	tests := []struct {
+		name, skeleton string
+	}{
+		{"Bob", "bob"},
+		{"Mira Stone", "mlrastone"},
+		{"m1ra_st0ne", "mlrastone"},
+		{"МIRA", "mlra"},       // Cyrillic М
+		{"Ｍｉｒａ", "mlra"},       // Full width
+		{"Mírá", "mlra"},       // Accents
+		{"Mi\u200bra", "mlra"}, // Zero width space
+		{"4dm!n", "admln"},
+		{"Barn", "bam"},
+	}
+
+	for _, tt := range tests {
+		if got := nameSkeleton(tt.name); got != tt.skeleton {
+			t.Errorf("nameSkeleton(%q) = %q, expected %q", tt.name, got, tt.skeleton)
+		}
+	}
+}
+
+func TestNameCheck(t *testing.T) {
+	cc, err := NewChatCommands(nameTestServer{}, ChatConfig{
+		Users: []ChatUser{{Name: "Mira", IP: "10.0.0.1", Level: "moderator"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	g, err := NewNameGuard(nameTestServer{illegal: NewIllegalNames()}, cc,
+		NamePolicy{Protected: []string{"Notch"}}, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		rule string // Empty if the name must be allowed
+	}{
+		// Ordinary names that contain reserved words or protected names
+		{"Observer", ""},
+		{"Badminton", ""},
+		{"Sysadmin", ""},
+		{"Distaff", ""},
+		{"Modest Mouse", ""},
+		{"Miranda", ""},
+		{"Notchy", ""},
+		{"Bob Smith", ""},
+
+		{"Adm1n", nameRuleReserved},
+		{"The Admin", nameRuleReserved},
+		{"TheAdmin", nameRuleReserved},
+		{"xXModeratorXx", nameRuleReserved},
+		{"Real_Staff", nameRuleReserved},
+		{"Mira", nameRuleImpersonation},
+		{"M1ra", nameRuleConfusable},
+		{"Notch Fan", nameRuleConfusable},
+		{"N0tch", nameRuleConfusable},
+		{" Bob", nameRuleWhitespace},
+		{"Bob\u200b", nameRuleCharacters},
+		{"Server", nameRuleIllegal},
+		{"A Name That Is Far Too Long", nameRuleLength},
+	}
+
+	for _, tt := range tests {
+		c := g.Check(tt.name)
+		if tt.rule == "" {
+			if !c.Allowed {
+				t.Errorf("%q was not allowed: %s", tt.name, c.Violations[0].Detail)
+			}
+			continue
+		}
+
+		found := false
+		for _, v := range c.Violations {
+			found = found || v.Rule == tt.rule
+		}
+		if !found {
+			t.Errorf("%q did not break the %s rule (%d violations)", tt.name, tt.rule, len(c.Violations))
+		}
+	}
+}
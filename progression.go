@@ -0,0 +1,338 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	progressionStateFile     = "progression.json"
+	progressionCheckInterval = time.Minute
+	eventKindProgression     = "progression"
+
+	milestoneSourceEvent = "event"
+	milestoneSourceWorld = "world"
+)
+
+// milestone is a step in the progression of a world. Flag is its key in the
+// Downed flags of a WorldInfo, and Names are the names that Terraria uses when
+// announcing it.
+type milestone struct {
+	Name  string
+	Flag  string
+	Names []string
+}
+
+// The milestones of a world, roughly in the order that they are reached
+var milestones = []milestone{
+	{"King Slime", "King Slime", []string{"King Slime"}},
+	{"Eye of Cthulhu", "Eye of Cthulhu", []string{"Eye of Cthulhu"}},
+	{"Eater of Worlds / Brain of Cthulhu", "Eater of Worlds / Brain of Cthulhu",
+		[]string{"Eater of Worlds", "Brain of Cthulhu"}},
+	{"Goblin Army", "Goblin Army", []string{"Goblin Army"}},
+	{"Queen Bee", "Queen Bee", []string{"Queen Bee"}},
+	{"Skeletron", "Skeletron", []string{"Skeletron"}},
+	{"Hardmode", "", []string{"Hardmode"}},
+	{"Pirate Invasion", "Pirates", []string{"Pirate Invasion"}},
+	{"Frost Legion", "Frost Legion", []string{"Frost Legion"}},
+	{"The Destroyer", "The Destroyer", []string{"The Destroyer"}},
+	{"The Twins", "The Twins", []string{"The Twins"}},
+	{"Skeletron Prime", "Skeletron Prime", []string{"Skeletron Prime"}},
+	{"Plantera", "Plantera", []string{"Plantera"}},
+	{"Golem", "Golem", []string{"Golem"}},
+	{"Duke Fishron", "Duke Fishron", []string{"Duke Fishron"}},
+	{"Mourning Wood", "Mourning Wood", []string{"Mourning Wood"}},
+	{"Pumpking", "Pumpking", []string{"Pumpking"}},
+	{"Everscream", "Everscream", []string{"Everscream"}},
+	{"Santa-NK1", "Santa-NK1", []string{"Santa-NK1"}},
+	{"Ice Queen", "Ice Queen", []string{"Ice Queen"}},
+	{"Martian Madness", "Martian Madness", []string{"Martian Madness"}},
+	{"Lunatic Cultist", "Lunatic Cultist", []string{"Lunatic Cultist"}},
+	{"Solar Pillar", "Solar Pillar", []string{"Solar Pillar"}},
+	{"Vortex Pillar", "Vortex Pillar", []string{"Vortex Pillar"}},
+	{"Nebula Pillar", "Nebula Pillar", []string{"Nebula Pillar"}},
+	{"Stardust Pillar", "Stardust Pillar", []string{"Stardust Pillar"}},
+	{"Moon Lord", "Moon Lord", []string{"Moon Lord"}},
+}
+
+// MilestoneRecord records when a world reached a milestone, and who was online
+// at the time. Milestones found in the world file without having been seen
+// happen have no players, and the time that they were found. Confirmed is set
+// once the world file agrees.
+type MilestoneRecord struct {
+	Name      string
+	Time      time.Time
+	Source    string
+	Online    []string
+	Line      string `json:",omitempty"`
+	Confirmed bool
+}
+
+// WorldProgression is the progression of a single world
+type WorldProgression struct {
+	World      string
+	Milestones []*MilestoneRecord
+}
+
+// ProgressionStep is a milestone along with its record, if it was reached
+type ProgressionStep struct {
+	Name    string
+	Reached bool
+	Record  *MilestoneRecord `json:",omitempty"`
+}
+
+// ProgressionTracker follows the progression of the worlds of a GameServer,
+// from the boss, invasion and hardmode announcements, and from the downed
+// flags of the world file
+type ProgressionTracker struct {
+	gs    GameServer
+	state string
+
+	mu     sync.Mutex
+	worlds map[string]*WorldProgression
+	close  chan struct{}
+}
+
+// NewProgressionTracker returns a ProgressionTracker and loads the timelines
+// that were saved in datadir
+func NewProgressionTracker(gs GameServer, datadir string) (*ProgressionTracker, error) {
+	p := &ProgressionTracker{
+		gs:     gs,
+		state:  filepath.Join(datadir, progressionStateFile),
+		worlds: make(map[string]*WorldProgression),
+		close:  make(chan struct{}),
+	}
+
+	if err := loadJSON(p.state, &p.worlds); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Start follows the events of the GameServer, and checks the world file
+// periodically, until Stop is called
+func (p *ProgressionTracker) Start() {
+	sub := p.gs.Bus().Subscribe("progression", 0,
+		EventKinds("BossDefeated", "Invasion", "WorldEvent"))
+	defer p.gs.Bus().Unsubscribe(sub)
+
+	t := time.NewTicker(progressionCheckInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-p.close:
+			return
+
+		case ev := <-sub.C:
+			var name string
+			switch ev := ev.(type) {
+			case *BossDefeated:
+				name = ev.Boss
+			case *Invasion:
+				if ev.Stage == invasionDefeated {
+					name = ev.Invasion
+				}
+			case *WorldEvent:
+				name = ev.Name
+			}
+
+			if m := findMilestone(name); m != nil {
+				p.reach(m, ev)
+			}
+
+		case <-t.C:
+			p.Check()
+		}
+	}
+}
+
+// Stop ends progression tracking
+func (p *ProgressionTracker) Stop() {
+	close(p.close)
+}
+
+// Progression returns every milestone of the current world, in order, along
+// with whether it has been reached
+func (p *ProgressionTracker) Progression() (string, []*ProgressionStep) {
+	key, _ := p.world()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	reached := make(map[string]*MilestoneRecord)
+	if wp, ok := p.worlds[key]; ok {
+		for _, r := range wp.Milestones {
+			reached[r.Name] = r
+		}
+	}
+
+	steps := make([]*ProgressionStep, 0, len(milestones))
+	for _, m := range milestones {
+		r := reached[m.Name]
+		steps = append(steps, &ProgressionStep{Name: m.Name, Reached: r != nil, Record: r})
+	}
+	return key, steps
+}
+
+// Timeline returns the milestones that the current world has reached, in the
+// order that they were reached
+func (p *ProgressionTracker) Timeline() []*MilestoneRecord {
+	key, _ := p.world()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	wp, ok := p.worlds[key]
+	if !ok {
+		return []*MilestoneRecord{}
+	}
+
+	t := append([]*MilestoneRecord{}, wp.Milestones...)
+	sort.SliceStable(t, func(i, j int) bool { return t[i].Time.Before(t[j].Time) })
+	return t
+}
+
+// Check cross-checks the timeline of the current world against the downed
+// flags of its world file. Milestones that the file has but that were never
+// announced are added, and announced milestones are confirmed.
+func (p *ProgressionTracker) Check() {
+	key, wi := p.world()
+	if wi == nil {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	wp := p.progression(key)
+	changed := false
+	for _, m := range milestones {
+		if !milestoneDowned(m, wi) {
+			continue
+		}
+
+		r := wp.find(m.Name)
+		switch {
+		case r == nil:
+			wp.Milestones = append(wp.Milestones, &MilestoneRecord{
+				Name:      m.Name,
+				Time:      wi.Modified,
+				Source:    milestoneSourceWorld,
+				Online:    []string{},
+				Confirmed: true,
+			})
+			LogInfo(p.gs, "Found milestone in world file: "+m.Name)
+			changed = true
+
+		case !r.Confirmed:
+			r.Confirmed = true
+			changed = true
+		}
+	}
+
+	if changed {
+		p.save()
+	}
+}
+
+// reach records that the current world has reached a milestone
+func (p *ProgressionTracker) reach(m *milestone, ev Event) {
+	key, _ := p.world()
+
+	online := make([]string, 0)
+	for _, plr := range p.gs.Players() {
+		online = append(online, plr.Name())
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	wp := p.progression(key)
+	if wp.find(m.Name) != nil {
+		return
+	}
+
+	wp.Milestones = append(wp.Milestones, &MilestoneRecord{
+		Name:   m.Name,
+		Time:   ev.When(),
+		Source: milestoneSourceEvent,
+		Online: online,
+		Line:   ev.Raw(),
+	})
+	p.save()
+
+	msg := "Milestone reached: " + m.Name
+	LogEvent(p.gs, "Progression", msg, p.gs.WSOutput())
+	p.gs.EventLog().Add(eventKindProgression, msg)
+}
+
+// world returns the key used for the current world, and its header if it can
+// be read. Worlds are keyed by their GUID, falling back to their file name.
+func (p *ProgressionTracker) world() (string, *WorldInfo) {
+	wi, err := ReadWorldInfo(p.gs.WorldFile())
+	switch {
+	case err != nil:
+		return filepath.Base(p.gs.WorldFile()), nil
+	case wi.GUID != "":
+		return wi.GUID, wi
+	default:
+		return filepath.Base(p.gs.WorldFile()), wi
+	}
+}
+
+// progression returns the progression of a world, creating it if needed.
+// Expects p.mu to be held.
+func (p *ProgressionTracker) progression(key string) *WorldProgression {
+	wp, ok := p.worlds[key]
+	if !ok {
+		wp = &WorldProgression{World: key, Milestones: make([]*MilestoneRecord, 0)}
+		p.worlds[key] = wp
+	}
+	return wp
+}
+
+// save writes the timelines to disk. Expects p.mu to be held.
+func (p *ProgressionTracker) save() {
+	if err := saveJSON(p.state, p.worlds); err != nil {
+		LogError(p.gs, "Unable to save progression: "+err.Error())
+	}
+}
+
+func (wp *WorldProgression) find(name string) *MilestoneRecord {
+	for _, r := range wp.Milestones {
+		if r.Name == name {
+			return r
+		}
+	}
+	return nil
+}
+
+// findMilestone returns the milestone that Terraria announces with the given
+// name, or nil
+func findMilestone(name string) *milestone {
+	if name == "" {
+		return nil
+	}
+
+	for i, m := range milestones {
+		for _, n := range m.Names {
+			if n == name {
+				return &milestones[i]
+			}
+		}
+	}
+	return nil
+}
+
+// milestoneDowned returns true if the world file shows the milestone as done
+func milestoneDowned(m milestone, wi *WorldInfo) bool {
+	if m.Name == "Hardmode" {
+		return wi.Hardmode
+	}
+	return m.Flag != "" && wi.Downed[m.Flag]
+}
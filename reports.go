@@ -0,0 +1,348 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	reportStateFile       = "reports.json"
+	defaultReportContext  = 5 * time.Minute
+	defaultReportCooldown = time.Minute
+	eventKindReport       = "report"
+
+	ReportOpen     = "open"
+	ReportClaimed  = "claimed"
+	ReportResolved = "resolved"
+	ReportKicked   = "kicked"
+	ReportBanned   = "banned"
+)
+
+var errReportNotFound = errors.New("no such report")
+
+// ReportConfig configures player reports. Context is how far back the chat
+// attached to a report goes, and Cooldown is how long a player has to wait
+// between reports.
+type ReportConfig struct {
+	Context  Duration `json:"context"`
+	Cooldown Duration `json:"cooldown"`
+}
+
+// ChatLine is a line of chat, kept as context for reports
+type ChatLine struct {
+	Time    time.Time
+	Name    string
+	Message string
+}
+
+// Report is a report filed against a player. IP is the address that the
+// target was connected from when the report was filed, if they were online.
+type Report struct {
+	ID         int
+	Time       time.Time
+	Reporter   string
+	Target     string
+	IP         string
+	Reason     string
+	Context    []*ChatLine
+	Status     string
+	ClaimedBy  string
+	ResolvedBy string
+	Resolution string
+	Resolved   time.Time
+}
+
+// Closed returns true if the report has been dealt with
+func (r *Report) Closed() bool {
+	return r.Status != ReportOpen && r.Status != ReportClaimed
+}
+
+// ReportQueue keeps the reports that players file against each other, for
+// moderators to work through. Recent chat is kept so that it can be attached
+// to new reports.
+type ReportQueue struct {
+	gs     GameServer
+	config ReportConfig
+	state  string
+
+	mu      sync.Mutex
+	reports []*Report
+	chat    []*ChatLine
+	filed   map[string]time.Time
+}
+
+// NewReportQueue returns a ReportQueue and loads the reports saved in datadir
+func NewReportQueue(gs GameServer, c ReportConfig, datadir string) (*ReportQueue, error) {
+	if c.Context.Duration <= 0 {
+		c.Context.Duration = defaultReportContext
+	}
+	if c.Cooldown.Duration <= 0 {
+		c.Cooldown.Duration = defaultReportCooldown
+	}
+
+	q := &ReportQueue{
+		gs:      gs,
+		config:  c,
+		state:   filepath.Join(datadir, reportStateFile),
+		reports: make([]*Report, 0),
+		chat:    make([]*ChatLine, 0),
+		filed:   make(map[string]time.Time),
+	}
+
+	if err := loadJSON(q.state, &q.reports); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	return q, nil
+}
+
+// Start keeps the recent chat of the GameServer until the subscription ends
+func (q *ReportQueue) Start() *Subscription {
+	return q.gs.Bus().Handle("reports", EventKinds("Chat"), func(ev Event) {
+		chat := ev.(*Chat)
+
+		q.mu.Lock()
+		defer q.mu.Unlock()
+
+		q.chat = append(q.chat, &ChatLine{Time: ev.When(), Name: chat.Name, Message: chat.Message})
+		q.trim(ev.When())
+	})
+}
+
+// File - Add a report against a player to the queue, and notify moderators
+func (q *ReportQueue) File(reporter, target, reason string) (*Report, error) {
+	reporter, target, reason = strings.TrimSpace(reporter), strings.TrimSpace(target),
+		strings.TrimSpace(reason)
+	switch {
+	case target == "":
+		return nil, errors.New("reports need a player to report")
+	case reason == "":
+		return nil, errors.New("reports need a reason")
+	case reporter == target:
+		return nil, errors.New("you can not report yourself")
+	}
+
+	var ip string
+	if p := q.gs.Player(target); p != nil && p.IP() != nil {
+		ip = p.IP().String()
+	}
+
+	q.mu.Lock()
+	now := time.Now()
+	if last, ok := q.filed[reporter]; ok && reporter != "" {
+		if left := q.config.Cooldown.Duration - now.Sub(last); left > 0 {
+			q.mu.Unlock()
+			return nil, errors.New(sprintf("you can file another report in %s",
+				left.Round(time.Second)))
+		}
+	}
+	q.filed[reporter] = now
+
+	q.trim(now)
+	r := &Report{
+		ID:       len(q.reports) + 1,
+		Time:     now,
+		Reporter: reporter,
+		Target:   target,
+		IP:       ip,
+		Reason:   reason,
+		Context:  append([]*ChatLine{}, q.chat...),
+		Status:   ReportOpen,
+	}
+	q.reports = append(q.reports, r)
+	q.save()
+	q.mu.Unlock()
+
+	recordModeration(q.gs, &PlayerModerated{
+		EventHeader: newEventHeader(""),
+		Name:        target,
+		Action:      moderationReport,
+		By:          reporter,
+		Reason:      sprintf("report #%d: %s", r.ID, reason),
+	})
+
+	msg := sprintf("Report #%d: %s reported %s: %s", r.ID, reporter, target, reason)
+	LogEvent(q.gs, "Report", msg, q.gs.WSOutput())
+	q.gs.EventLog().Add(eventKindReport, msg)
+	return r, nil
+}
+
+// Reports - Return copies of the reports, newest first. Closed reports are
+// only included if all is set.
+func (q *ReportQueue) Reports(all bool) []*Report {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	res := make([]*Report, 0)
+	for _, r := range q.reports {
+		if all || !r.Closed() {
+			c := *r
+			res = append(res, &c)
+		}
+	}
+	sort.SliceStable(res, func(i, j int) bool { return res[i].ID > res[j].ID })
+	return res
+}
+
+// Report - Return a copy of a report
+func (q *ReportQueue) Report(id int) (*Report, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	r, err := q.find(id)
+	if err != nil {
+		return nil, err
+	}
+	c := *r
+	return &c, nil
+}
+
+// Claim - Mark a report as being handled by a moderator
+func (q *ReportQueue) Claim(id int, by string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	r, err := q.find(id)
+	if err != nil {
+		return err
+	}
+	if r.Closed() {
+		return errors.New(sprintf("report #%d is already %s", id, r.Status))
+	}
+
+	r.Status = ReportClaimed
+	r.ClaimedBy = by
+	q.save()
+	LogInfo(q.gs, sprintf("%s claimed report #%d", by, id), q.gs.WSOutput())
+	return nil
+}
+
+// Resolve - Close a report without acting on it
+func (q *ReportQueue) Resolve(id int, by, note string) error {
+	return q.close(id, ReportResolved, by, note)
+}
+
+// Kick - Kick the target of a report, and close it
+func (q *ReportQueue) Kick(id int, by string) error {
+	r, err := q.Report(id)
+	if err != nil {
+		return err
+	}
+	reason := sprintf("report #%d: %s", id, r.Reason)
+	if err := moderatePlayer(q.gs, moderationKick, r.Target, by, reason, time.Time{}); err != nil {
+		return err
+	}
+	return q.close(id, ReportKicked, by, "")
+}
+
+// Ban - Ban the target of a report, and close it
+func (q *ReportQueue) Ban(id int, by string) error {
+	r, err := q.Report(id)
+	if err != nil {
+		return err
+	}
+
+	reason := sprintf("report #%d: %s", id, r.Reason)
+	if err := moderatePlayer(q.gs, moderationBan, r.Target, by, reason, time.Time{}); err != nil {
+		return err
+	}
+	return q.close(id, ReportBanned, by, "")
+}
+
+// close marks a report as dealt with
+func (q *ReportQueue) close(id int, status, by, note string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	r, err := q.find(id)
+	if err != nil {
+		return err
+	}
+	if r.Closed() {
+		return errors.New(sprintf("report #%d is already %s", id, r.Status))
+	}
+
+	r.Status = status
+	r.ResolvedBy = by
+	r.Resolution = note
+	r.Resolved = time.Now()
+	q.save()
+
+	msg := sprintf("Report #%d against %s %s by %s", id, r.Target, status, by)
+	if note != "" {
+		msg += ": " + note
+	}
+	LogInfo(q.gs, msg, q.gs.WSOutput())
+	q.gs.EventLog().Add(eventKindReport, msg)
+	return nil
+}
+
+// find returns a report by its ID. Expects q.mu to be held.
+func (q *ReportQueue) find(id int) (*Report, error) {
+	if id < 1 || id > len(q.reports) {
+		return nil, errReportNotFound
+	}
+	return q.reports[id-1], nil
+}
+
+// trim drops chat that is too old to be attached to a report. Expects q.mu to
+// be held.
+func (q *ReportQueue) trim(now time.Time) {
+	i := 0
+	for i < len(q.chat) && now.Sub(q.chat[i].Time) > q.config.Context.Duration {
+		i++
+	}
+	q.chat = q.chat[i:]
+}
+
+// save writes the reports to disk. Expects q.mu to be held.
+func (q *ReportQueue) save() {
+	if err := saveJSON(q.state, q.reports); err != nil {
+		LogError(q.gs, "Unable to save reports: "+err.Error())
+	}
+}
+
+// RegisterReportCommands - Add the commands used to file reports from chat
+func (cc *ChatCommands) RegisterReportCommands(q *ReportQueue) error {
+	return cc.Register(&ChatCommand{
+		Name:  "report",
+		Usage: "<name> <reason>",
+		Help:  "Report a player to the moderators",
+		Run: func(c *ChatContext) error {
+			if len(c.Args) < 2 {
+				return errChatUsage
+			}
+
+			target, reason := splitPlayerName(c.GS, c.Args)
+			if target == "" || reason == "" {
+				return errChatUsage
+			}
+
+			r, err := q.File(c.Player, target, reason)
+			if err != nil {
+				return err
+			}
+			c.Reply(sprintf("%s: thanks, your report (#%d) has been sent to the moderators",
+				c.Player, r.ID))
+			return nil
+		},
+	})
+}
+
+// splitPlayerName splits chat command arguments into a player name and the
+// rest of the line. As names can have spaces, the longest name of an online
+// player that the arguments start with is used, falling back to the first
+// argument.
+func splitPlayerName(gs GameServer, args []string) (string, string) {
+	for i := len(args) - 1; i > 0; i-- {
+		name := strings.Join(args[:i], " ")
+		if gs.Player(name) != nil {
+			return name, strings.Join(args[i:], " ")
+		}
+	}
+	return args[0], strings.Join(args[1:], " ")
+}
@@ -0,0 +1,393 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+const (
+	rotationStateFile        = "rotations.json"
+	rotationCheckInterval    = time.Minute
+	defaultRotationCountdown = 5 * time.Minute
+	defaultRotationMOTD      = "Welcome to {{.Name}}! World seed: {{.Seed}}"
+	rotationRetryInterval    = 15 * time.Minute
+	backupReasonRotation     = "rotation"
+)
+
+// Announce the countdown at these times before a rotation
+var rotationWarnings = []time.Duration{
+	30 * time.Minute, 10 * time.Minute, 5 * time.Minute, time.Minute,
+	30 * time.Second, 10 * time.Second,
+}
+
+// RotationConfig configures the automatic rotation of worlds. Templates are
+// used in turn, and their Name may use {{.Number}} and {{.Date}}. A template
+// without a seed gets a random one.
+type RotationConfig struct {
+	Interval  Duration       `json:"interval"`
+	Countdown Duration       `json:"countdown"`
+	MOTD      string         `json:"motd"`
+	Templates []WorldOptions `json:"templates"`
+}
+
+// RotationRecord describes a single rotation
+type RotationRecord struct {
+	Number   int
+	Time     time.Time
+	Previous string
+	Archived string
+	Backup   string
+	World    string
+	Name     string
+	Seed     string
+	Options  WorldOptions
+	Error    string `json:",omitempty"`
+}
+
+// rotationState is the history of rotations that is saved between runs
+type rotationState struct {
+	History []*RotationRecord
+}
+
+// WorldRotator replaces the world of a GameServer with a freshly generated one
+// on a schedule, archiving the old world
+type WorldRotator struct {
+	gs      GameServer
+	worlds  *WorldManager
+	backups *BackupManager
+	config  RotationConfig
+	motd    *template.Template
+	state   string
+	started time.Time
+
+	mu       sync.Mutex
+	running  bool
+	history  []*RotationRecord
+	close    chan struct{}
+	rotateCh chan struct{}
+}
+
+// NewWorldRotator returns a WorldRotator and loads the rotation history
+func NewWorldRotator(gs GameServer, w *WorldManager, b *BackupManager,
+	c RotationConfig, datadir string) (*WorldRotator, error) {
+	if c.Countdown.Duration <= 0 {
+		c.Countdown.Duration = defaultRotationCountdown
+	}
+
+	if c.MOTD == "" {
+		c.MOTD = defaultRotationMOTD
+	}
+
+	motd, err := template.New("motd").Parse(c.MOTD)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range c.Templates {
+		if _, err := template.New("name").Parse(c.Templates[i].Name); err != nil {
+			return nil, err
+		}
+	}
+
+	r := &WorldRotator{
+		gs:       gs,
+		worlds:   w,
+		backups:  b,
+		config:   c,
+		motd:     motd,
+		state:    filepath.Join(datadir, rotationStateFile),
+		started:  time.Now(),
+		history:  make([]*RotationRecord, 0),
+		close:    make(chan struct{}),
+		rotateCh: make(chan struct{}, 1),
+	}
+
+	st := &rotationState{}
+	if err := loadJSON(r.state, st); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if st.History != nil {
+		r.history = st.History
+	}
+
+	return r, nil
+}
+
+// Start runs rotations when they are due or requested. Should be run as a
+// goroutine.
+func (r *WorldRotator) Start() {
+	t := time.NewTicker(rotationCheckInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-r.close:
+			return
+		case <-r.rotateCh:
+		case <-t.C:
+			if next := r.Next(); next.IsZero() || time.Now().Before(next) {
+				continue
+			}
+		}
+
+		if err := r.rotate(); err != nil {
+			LogError(r.gs, "World rotation failed: "+err.Error(), r.gs.WSOutput())
+		}
+	}
+}
+
+// Stop ends scheduled rotations
+func (r *WorldRotator) Stop() {
+	close(r.close)
+}
+
+// RotateNow requests a rotation, which begins with the usual countdown
+func (r *WorldRotator) RotateNow() error {
+	if len(r.config.Templates) == 0 {
+		return errors.New("no rotation templates are configured")
+	}
+
+	select {
+	case r.rotateCh <- struct{}{}:
+		return nil
+	default:
+		return errors.New("a rotation is already queued")
+	}
+}
+
+// Next returns when the next scheduled rotation is due, or the zero time if
+// rotations are not scheduled. Without any successful rotations, the first
+// rotation is due an interval after TerraControl started. Failed rotations
+// are retried, but no sooner than rotationRetryInterval after they failed.
+func (r *WorldRotator) Next() time.Time {
+	if r.config.Interval.Duration <= 0 || len(r.config.Templates) == 0 {
+		return time.Time{}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	next := r.started.Add(r.config.Interval.Duration)
+	if last := r.last(); last != nil {
+		next = last.Time.Add(r.config.Interval.Duration)
+	}
+
+	if n := len(r.history); n > 0 && r.history[n-1].Error != "" {
+		if retry := r.history[n-1].Time.Add(rotationRetryInterval); retry.After(next) {
+			next = retry
+		}
+	}
+	return next
+}
+
+// History returns the rotations that have taken place, oldest first
+func (r *WorldRotator) History() []*RotationRecord {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]*RotationRecord{}, r.history...)
+}
+
+// rotate counts down, backs up and archives the current world, and starts the
+// server with a newly generated one
+func (r *WorldRotator) rotate() error {
+	if len(r.config.Templates) == 0 {
+		return errors.New("no rotation templates are configured")
+	}
+
+	r.mu.Lock()
+	if r.running {
+		r.mu.Unlock()
+		return errors.New("a rotation is already running")
+	}
+	r.running = true
+	num := 1
+	if last := r.last(); last != nil {
+		num = last.Number + 1
+	}
+	r.mu.Unlock()
+
+	defer func() {
+		r.mu.Lock()
+		r.running = false
+		r.mu.Unlock()
+	}()
+
+	opts, err := r.options(num)
+	if err != nil {
+		return err
+	}
+
+	// The world that is running, or that would be loaded if the server is
+	// down, is the one that is replaced
+	wasup := r.gs.IsUp()
+	prev := r.gs.WorldFile()
+	if !wasup {
+		prev = r.gs.SelectedWorld()
+	}
+
+	rec := &RotationRecord{
+		Number:   num,
+		Time:     time.Now(),
+		Previous: r.worlds.local(prev),
+		Options:  opts,
+	}
+
+	if wasup {
+		r.countdown()
+	}
+
+	if wb, err := r.backups.Snapshot(backupReasonRotation); err != nil {
+		LogWarning(r.gs, "Unable to back up world before rotating: "+err.Error(), r.gs.WSOutput())
+	} else {
+		rec.Backup = wb.ID
+	}
+
+	if wasup {
+		if err := r.gs.Stop(); err != nil {
+			return r.record(rec, err)
+		}
+	}
+
+	if rec.Previous != "" {
+		if rec.Archived, err = r.worlds.Archive(rec.Previous); err != nil {
+			return r.record(rec, r.rollback(rec, prev, wasup, err))
+		}
+	} else {
+		LogWarning(r.gs, "The current world is not in the world directory and was not archived")
+	}
+
+	if rec.World, err = r.worlds.Create(opts); err != nil {
+		return r.record(rec, r.rollback(rec, prev, wasup, err))
+	}
+	rec.Name = opts.Name
+
+	if !wasup {
+		LogInfo(r.gs, "Rotated to "+rec.World+", which is generated on the next start",
+			r.gs.WSOutput())
+		return r.record(rec, nil)
+	}
+
+	if err := r.gs.Start(); err != nil {
+		return r.record(rec, r.rollback(rec, prev, wasup, err))
+	}
+
+	rec.Seed = opts.Seed
+	if wi, err := ReadWorldInfo(r.gs.WorldFile()); err == nil {
+		rec.Seed = wi.Seed
+	}
+
+	var b bytes.Buffer
+	if err := r.motd.Execute(&b, rec); err != nil {
+		LogError(r.gs, "Unable to build rotation MOTD: "+err.Error())
+	} else {
+		c := r.gs.Console()
+		if _, err := c.SetMOTD(b.String()); err != nil {
+			LogError(r.gs, "Unable to set rotation MOTD: "+err.Error())
+		}
+		c.Say(b.String())
+	}
+
+	LogInfo(r.gs, sprintf("Rotated to world %s (seed %s)", rec.Name, rec.Seed), r.gs.WSOutput())
+	return r.record(rec, nil)
+}
+
+// countdown announces the rotation in game and waits for the countdown to end
+func (r *WorldRotator) countdown() {
+	end := time.Now().Add(r.config.Countdown.Duration)
+	c := r.gs.Console()
+	c.Say(sprintf("The world will be rotated in %s. Make sure you are somewhere safe!",
+		r.config.Countdown.Duration.Round(time.Second)))
+
+	for _, w := range rotationWarnings {
+		at := end.Add(-w)
+		if w >= r.config.Countdown.Duration || time.Now().After(at) {
+			continue
+		}
+
+		time.Sleep(time.Until(at))
+		c.Say(sprintf("The world will be rotated in %s", w))
+	}
+
+	time.Sleep(time.Until(end))
+	c.Say("Rotating the world now!")
+}
+
+// options picks the template for the given rotation and fills it in
+func (r *WorldRotator) options(num int) (WorldOptions, error) {
+	opts := r.config.Templates[(num-1)%len(r.config.Templates)]
+
+	name, err := template.New("name").Parse(opts.Name)
+	if err != nil {
+		return opts, err
+	}
+
+	var b bytes.Buffer
+	if err := name.Execute(&b, struct {
+		Number int
+		Date   string
+	}{num, time.Now().Format("2006-01-02")}); err != nil {
+		return opts, err
+	}
+	opts.Name = b.String()
+
+	if opts.Seed == "" || strings.ToLower(opts.Seed) == "random" {
+		opts.Seed = strconv.Itoa(rand.Intn(1<<31 - 1))
+	}
+
+	return opts, opts.Validate()
+}
+
+// rollback puts the previous world back after a rotation failed with err, and
+// starts the server again if it was running. It returns err, along with
+// anything that went wrong while rolling back.
+func (r *WorldRotator) rollback(rec *RotationRecord, prev string, wasup bool, err error) error {
+	LogError(r.gs, "World rotation failed, reinstating the previous world: "+err.Error(), r.gs.WSOutput())
+
+	if rerr := r.worlds.Reinstate(prev, rec.Archived); rerr != nil {
+		return errors.New(err.Error() + "; unable to reinstate the previous world: " + rerr.Error())
+	}
+	rec.Archived = ""
+
+	if wasup && !r.gs.IsUp() {
+		if serr := r.gs.Start(); serr != nil {
+			return errors.New(err.Error() + "; unable to start the previous world: " + serr.Error())
+		}
+	}
+	return err
+}
+
+// last returns the most recent rotation that succeeded, or nil. Expects r.mu
+// to be held.
+func (r *WorldRotator) last() *RotationRecord {
+	for i := len(r.history) - 1; i >= 0; i-- {
+		if r.history[i].Error == "" {
+			return r.history[i]
+		}
+	}
+	return nil
+}
+
+// record adds a rotation to the history and saves it
+func (r *WorldRotator) record(rec *RotationRecord, err error) error {
+	if err != nil {
+		rec.Error = err.Error()
+	}
+
+	r.mu.Lock()
+	r.history = append(r.history, rec)
+	serr := saveJSON(r.state, &rotationState{History: r.history})
+	r.mu.Unlock()
+
+	if serr != nil {
+		LogError(r.gs, "Unable to save rotation history: "+serr.Error())
+	}
+	return err
+}
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	s3Algorithm     = "AWS4-HMAC-SHA256"
+	s3DateFormat    = "20060102T150405Z"
+	s3DefaultRegion = "us-east-1"
+	s3MinPartSize   = 5 << 20
+)
+
+// S3Config configures an S3 compatible bucket that backups are uploaded to.
+// Buckets are addressed path style (endpoint/bucket/key), which is what MinIO
+// and most self hosted stores expect. Set VirtualHost to address them as
+// bucket.endpoint/key instead, as AWS prefers.
+type S3Config struct {
+	Endpoint      string `json:"endpoint"`
+	Region        string `json:"region"`
+	Bucket        string `json:"bucket"`
+	Prefix        string `json:"prefix"`
+	AccessKey     string `json:"accesskey"`
+	SecretKey     string `json:"secretkey"`
+	VirtualHost   bool   `json:"virtualhost"`
+	PartSize      int64  `json:"partsize"`
+	Retries       int    `json:"retries"`
+	SyncRetention bool   `json:"syncretention"`
+}
+
+// S3Error is an error response returned by an S3 endpoint
+type S3Error struct {
+	Status  int    `xml:"-"`
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+func (e *S3Error) Error() string {
+	return sprintf("s3: %s: %s (%d)", e.Code, e.Message, e.Status)
+}
+
+// S3Client is a minimal client for S3 compatible object storage. It signs
+// requests using AWS Signature Version 4.
+type S3Client struct {
+	config   S3Config
+	endpoint *url.URL
+	http     *http.Client
+}
+
+// s3Part is a completed part of a multipart upload
+type s3Part struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+// NewS3Client returns a client for the given configuration
+func NewS3Client(c S3Config) (*S3Client, error) {
+	if c.Bucket == "" {
+		return nil, errors.New("s3: no bucket configured")
+	}
+
+	u, err := url.Parse(c.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, errors.New("s3: endpoint must be an http or https URL")
+	}
+
+	if c.Region == "" {
+		c.Region = s3DefaultRegion
+	}
+
+	if c.PartSize < s3MinPartSize {
+		c.PartSize = s3MinPartSize
+	}
+
+	return &S3Client{
+		config:   c,
+		endpoint: u,
+		http:     &http.Client{Timeout: 5 * time.Minute},
+	}, nil
+}
+
+// Key returns the object key for the given name, including the prefix
+func (c *S3Client) Key(name string) string {
+	p := strings.Trim(c.config.Prefix, "/")
+	if p == "" {
+		return name
+	}
+	return p + "/" + name
+}
+
+// PutObject uploads data as a single object
+func (c *S3Client) PutObject(key string, data []byte) error {
+	resp, err := c.do("PUT", key, nil, data)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// DeleteObject removes an object. Deleting an object that does not exist is
+// not an error.
+func (c *S3Client) DeleteObject(key string) error {
+	resp, err := c.do("DELETE", key, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// ListObjects returns the keys of every object that starts with prefix
+func (c *S3Client) ListObjects(prefix string) ([]string, error) {
+	keys := make([]string, 0)
+	token := ""
+
+	for {
+		q := url.Values{}
+		q.Set("list-type", "2")
+		q.Set("prefix", prefix)
+		if token != "" {
+			q.Set("continuation-token", token)
+		}
+
+		resp, err := c.do("GET", "", q, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		var res struct {
+			Contents []struct {
+				Key string `xml:"Key"`
+			} `xml:"Contents"`
+			IsTruncated           bool   `xml:"IsTruncated"`
+			NextContinuationToken string `xml:"NextContinuationToken"`
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&res)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, o := range res.Contents {
+			keys = append(keys, o.Key)
+		}
+
+		if !res.IsTruncated || res.NextContinuationToken == "" {
+			return keys, nil
+		}
+		token = res.NextContinuationToken
+	}
+}
+
+// CreateMultipartUpload starts a multipart upload and returns its ID
+func (c *S3Client) CreateMultipartUpload(key string) (string, error) {
+	q := url.Values{}
+	q.Set("uploads", "")
+
+	resp, err := c.do("POST", key, q, nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var res struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return "", err
+	}
+	return res.UploadID, nil
+}
+
+// UploadPart uploads one part of a multipart upload and returns its ETag
+func (c *S3Client) UploadPart(key, id string, n int, data []byte) (string, error) {
+	q := url.Values{}
+	q.Set("partNumber", strconv.Itoa(n))
+	q.Set("uploadId", id)
+
+	resp, err := c.do("PUT", key, q, data)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	return resp.Header.Get("ETag"), nil
+}
+
+// CompleteMultipartUpload assembles the uploaded parts into the final object
+func (c *S3Client) CompleteMultipartUpload(key, id string, parts []s3Part) error {
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []s3Part `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		return err
+	}
+
+	q := url.Values{}
+	q.Set("uploadId", id)
+
+	resp, err := c.do("POST", key, q, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// S3 may report a failure in the body of a 200 response
+	b, _ := io.ReadAll(resp.Body)
+	if bytes.Contains(b, []byte("<Error>")) {
+		e := &S3Error{Status: resp.StatusCode}
+		xml.Unmarshal(b, e)
+		return e
+	}
+	return nil
+}
+
+// AbortMultipartUpload abandons a multipart upload, removing the parts that
+// were uploaded
+func (c *S3Client) AbortMultipartUpload(key, id string) error {
+	q := url.Values{}
+	q.Set("uploadId", id)
+
+	resp, err := c.do("DELETE", key, q, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// do signs and sends a request. Responses with an error status are returned
+// as an *S3Error.
+func (c *S3Client) do(method, key string, q url.Values, body []byte) (*http.Response, error) {
+	req, err := c.request(method, key, q, body, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		e := &S3Error{Status: resp.StatusCode}
+		if b, _ := io.ReadAll(resp.Body); len(b) > 0 {
+			xml.Unmarshal(b, e)
+		}
+		if e.Code == "" {
+			e.Code = http.StatusText(resp.StatusCode)
+		}
+		return nil, e
+	}
+
+	return resp, nil
+}
+
+// request builds a request for the given object key, signed as of now
+func (c *S3Client) request(method, key string, q url.Values, body []byte, now time.Time) (*http.Request, error) {
+	u := *c.endpoint
+	path := "/" + c.config.Bucket
+	if c.config.VirtualHost {
+		u.Host = c.config.Bucket + "." + u.Host
+		path = ""
+	}
+	if key != "" {
+		path += "/" + key
+	}
+	if path == "" {
+		path = "/"
+	}
+
+	u.Path = path
+	u.RawPath = s3Escape(path, true)
+	u.RawQuery = s3CanonicalQuery(q)
+
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = int64(len(body))
+	c.sign(req, u.RawPath, body, now)
+	return req, nil
+}
+
+// sign adds the AWS Signature Version 4 headers to a request
+func (c *S3Client) sign(req *http.Request, path string, body []byte, now time.Time) {
+	now = now.UTC()
+	date := now.Format(s3DateFormat)
+	day := now.Format("20060102")
+
+	sum := sha256.Sum256(body)
+	payload := hex.EncodeToString(sum[:])
+
+	req.Header.Set("x-amz-date", date)
+	req.Header.Set("x-amz-content-sha256", payload)
+
+	headers := "host;x-amz-content-sha256;x-amz-date"
+	canonical := strings.Join([]string{
+		req.Method,
+		path,
+		req.URL.RawQuery,
+		"host:" + req.URL.Host,
+		"x-amz-content-sha256:" + payload,
+		"x-amz-date:" + date,
+		"",
+		headers,
+		payload,
+	}, "\n")
+
+	scope := day + "/" + c.config.Region + "/s3/aws4_request"
+	csum := sha256.Sum256([]byte(canonical))
+	tosign := strings.Join([]string{
+		s3Algorithm,
+		date,
+		scope,
+		hex.EncodeToString(csum[:]),
+	}, "\n")
+
+	key := s3HMAC([]byte("AWS4"+c.config.SecretKey), day)
+	key = s3HMAC(key, c.config.Region)
+	key = s3HMAC(key, "s3")
+	key = s3HMAC(key, "aws4_request")
+
+	req.Header.Set("Authorization", sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s3Algorithm, c.config.AccessKey, scope, headers,
+		hex.EncodeToString(s3HMAC(key, tosign))))
+}
+
+func s3HMAC(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// s3CanonicalQuery encodes query parameters sorted by key, as required for
+// signing
+func s3CanonicalQuery(q url.Values) string {
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		for _, v := range q[k] {
+			parts = append(parts, s3Escape(k, false)+"="+s3Escape(v, false))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// s3Escape percent-encodes everything except the unreserved characters, and
+// optionally the path separator
+func s3Escape(s string, path bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+		switch {
+		case 'A' <= ch && ch <= 'Z', 'a' <= ch && ch <= 'z', '0' <= ch && ch <= '9',
+			ch == '-', ch == '_', ch == '.', ch == '~':
+			b.WriteByte(ch)
+		case ch == '/' && path:
+			b.WriteByte(ch)
+		default:
+			b.WriteString(sprintf("%%%02X", ch))
+		}
+	}
+	return b.String()
+}
@@ -8,6 +8,66 @@ function resetElement(e) {
 	e.value = null
 }
 
+function renderWorld(w) {
+	var d = document.getElementById("world-details")
+	while (d.lastElementChild) {
+		d.removeChild(d.lastElementChild)
+	}
+
+	var rows = [["No world information available", ""]]
+	if (w) {
+		var downed = Object.entries(w.Downed || {})
+			.filter(([_, v]) => v).map(([k, _]) => k)
+		rows = [
+			["Name: ", w.Name],
+			["Size: ", w.Size + " (" + w.Width + "x" + w.Height + ")"],
+			["Difficulty: ", w.Difficulty],
+			["Evil: ", w.Evil],
+			["Seed: ", w.Seed],
+			["Created: ", new Date(w.Created).toLocaleString()],
+			["Hardmode: ", w.Hardmode ? "Yes" : "No"],
+			["Defeated: ", downed.length > 0 ? downed.join(", ") : "None"],
+		]
+	}
+
+	for (const [k, v] of rows) {
+		var item = document.createElement("div")
+		item.classList.add("c-card__item")
+		item.innerText = k + v
+		d.append(item)
+	}
+}
+
+function renderEvents(events) {
+	var d = document.getElementById("event-log")
+	while (d.lastElementChild) {
+		d.removeChild(d.lastElementChild)
+	}
+
+	if (!events || events.length == 0) {
+		var empty = document.createElement("div")
+		empty.classList.add("c-card__item")
+		empty.innerText = "No events"
+		d.append(empty)
+		return
+	}
+
+	for (const e of events.slice().reverse()) {
+		var item = document.createElement("div")
+		var badge = document.createElement("span")
+		var msg = document.createElement("span")
+
+		item.classList.add("c-card__item")
+		badge.classList.add("c-badge")
+		badge.classList.add(e.Kind == "integrity" ? "c-badge--warning" : "c-badge--info")
+		badge.innerText = e.Kind
+		msg.innerText = " " + new Date(e.Time).toLocaleString() + ": " + e.Message
+
+		item.append(badge, msg)
+		d.append(item)
+	}
+}
+
 function getElementInsideContainer(pID, chID) {
 	var elm = document.getElementById(chID);
 	var parent = elm ? elm.parentNode : {};
@@ -30,6 +90,26 @@ var serverStatus   = DOMLoaded
 var serverSettle   = DOMLoaded
 var serverPassword = DOMLoaded
 var serverRestart  = DOMLoaded
+var backupList     = DOMLoaded
+var backupCreate   = DOMLoaded
+var backupRestore  = DOMLoaded
+var worldList      = DOMLoaded
+var worldCreate    = DOMLoaded
+var worldSelect    = DOMLoaded
+var worldArchive   = DOMLoaded
+var worldDelete    = DOMLoaded
+var rotationHistory = DOMLoaded
+var rotationNow    = DOMLoaded
+var worldRecover   = DOMLoaded
+var worldProgression = DOMLoaded
+var reportsList    = DOMLoaded
+var reportsClaim   = DOMLoaded
+var reportsResolve = DOMLoaded
+var reportsKick    = DOMLoaded
+var reportsBan     = DOMLoaded
+var namesIllegal   = DOMLoaded
+var namesAdd       = DOMLoaded
+var namesRemove    = DOMLoaded
 var verifyMessage  = DOMLoaded
 var getRequester   = DOMLoaded
 
@@ -163,6 +243,11 @@ document.addEventListener('DOMContentLoaded', () => {
 	scopes.set("server", new Map())
 	scopes.set("player", new Map())
 	scopes.set("ajax", new Map())
+	scopes.set("backup", new Map())
+	scopes.set("world", new Map())
+	scopes.set("rotation", new Map())
+	scopes.set("reports", new Map())
+	scopes.set("names", new Map())
 
 	ajaxFullstatus = new TerraControlAPI("ajax", "fullstatus")
 	playerKick     = new TerraControlAPI("player", "kick")
@@ -176,6 +261,26 @@ document.addEventListener('DOMContentLoaded', () => {
 	serverSettle   = new TerraControlAPI("server", "settle")
 	serverRestart  = new TerraControlAPI("server", "restart")
 	serverPassword = new TerraControlAPI("server", "password")
+	backupList     = new TerraControlAPI("backup", "list")
+	backupCreate   = new TerraControlAPI("backup", "create")
+	backupRestore  = new TerraControlAPI("backup", "restore")
+	worldList      = new TerraControlAPI("world", "list")
+	worldCreate    = new TerraControlAPI("world", "create")
+	worldSelect    = new TerraControlAPI("world", "select")
+	worldArchive   = new TerraControlAPI("world", "archive")
+	worldDelete    = new TerraControlAPI("world", "delete")
+	rotationHistory = new TerraControlAPI("rotation", "history")
+	rotationNow    = new TerraControlAPI("rotation", "now")
+	worldRecover   = new TerraControlAPI("world", "recover")
+	worldProgression = new TerraControlAPI("world", "progression")
+	reportsList    = new TerraControlAPI("reports", "list")
+	reportsClaim   = new TerraControlAPI("reports", "claim")
+	reportsResolve = new TerraControlAPI("reports", "resolve")
+	reportsKick    = new TerraControlAPI("reports", "kick")
+	reportsBan     = new TerraControlAPI("reports", "ban")
+	namesIllegal   = new TerraControlAPI("names", "illegal")
+	namesAdd       = new TerraControlAPI("names", "add")
+	namesRemove    = new TerraControlAPI("names", "remove")
 
 	// serverSay
 	serverSay.onprecall = function() {
@@ -338,6 +443,14 @@ document.addEventListener('DOMContentLoaded', () => {
 						"Players: " + value
 					break;
 
+				case "World":
+					renderWorld(value)
+					break;
+
+				case "Events":
+					renderEvents(value)
+					break;
+
 				case "Loglevel":
 					break;
 					
@@ -372,12 +485,348 @@ document.addEventListener('DOMContentLoaded', () => {
 		}
 	}
 
+	// backupList
+	backupList.onsuccess = function(xhttp) {
+		var blist = document.getElementById("backup-list")
+
+		while (blist.lastElementChild.id != "backup-header") {
+			blist.removeChild(blist.lastElementChild)
+		}
+
+		for (const b of JSON.parse(xhttp.response)) {
+			var bdiv = document.createElement("div")
+			var label = document.createElement("span")
+			var dl = document.createElement("a")
+			var restore = document.createElement("button")
+
+			bdiv.classList.add("c-card__item")
+			bdiv.classList.add("c-input-group")
+
+			label.innerText = b.ID + " (" + b.Reason + ")"
+			if (b.Upload) {
+				var state = document.createElement("span")
+				state.classList.add("c-badge")
+				state.classList.add(b.Upload.State == "uploaded" ?
+					"c-badge--success" : "c-badge--warning")
+				state.innerText = b.Upload.State
+				if (b.Upload.Error) {
+					state.title = b.Upload.Error
+				}
+				label.append(" ", state)
+			}
+
+			dl.classList.add("c-button")
+			dl.classList.add("c-button--brand")
+			dl.href = APIBASE + "backup/download/" + b.ID
+			dl.innerText = "Download"
+
+			restore.classList.add("c-button")
+			restore.classList.add("c-button--warning")
+			restore.setAttribute("type", "button")
+			restore.value = b.ID
+			restore.innerText = "Restore"
+			restore.addEventListener('click', function() {
+				if (confirm("Restore backup " + this.value + "?")) {
+					backupRestore.call(this.value)
+				}
+			})
+
+			bdiv.append(label, dl, restore)
+			blist.append(bdiv)
+		}
+	}
+
+	backupCreate.oncomplete = function() {
+		backupList.call()
+	}
+
+	backupRestore.oncomplete = function() {
+		backupList.call()
+	}
+
+	// worldList
+	worldList.onsuccess = function(xhttp) {
+		var wlist = document.getElementById("world-list")
+
+		while (wlist.lastElementChild) {
+			wlist.removeChild(wlist.lastElementChild)
+		}
+
+		for (const w of JSON.parse(xhttp.response)) {
+			var wdiv = document.createElement("div")
+			var label = document.createElement("span")
+
+			wdiv.classList.add("c-card__item")
+			wdiv.classList.add("c-input-group")
+
+			label.innerText = w.File
+			if (w.Info) {
+				label.innerText += " - " + w.Info.Name + ", " + w.Info.Size +
+					", " + w.Info.Difficulty + ", " + w.Info.Evil
+			} else if (w.Pending) {
+				label.innerText += " - generated on next start"
+			} else if (w.Error) {
+				label.innerText += " - " + w.Error
+			}
+			wdiv.append(label)
+
+			if (w.Active) {
+				var active = document.createElement("span")
+				active.classList.add("c-badge")
+				active.classList.add("c-badge--success")
+				active.innerText = "Active"
+				wdiv.append(active)
+			} else {
+				for (const [text, cls, api] of [
+					["Select", "c-button--brand", worldSelect],
+					["Archive", "c-button--warning", worldArchive],
+					["Delete", "c-button--error", worldDelete]]) {
+					var btn = document.createElement("button")
+					btn.classList.add("c-button")
+					btn.classList.add(cls)
+					btn.setAttribute("type", "button")
+					btn.value = w.File
+					btn.innerText = text
+					btn.addEventListener('click', function() {
+						if (api !== worldDelete || confirm("Delete " + this.value + "?")) {
+							api.call(this.value)
+						}
+					})
+					wdiv.append(btn)
+				}
+			}
+
+			wlist.append(wdiv)
+		}
+	}
+
+	worldCreate.getdata = function() {
+		var q = new URLSearchParams()
+		for (const f of ["name", "size", "difficulty", "evil", "seed"]) {
+			q.set(f, document.getElementById("world-create-" + f).value)
+		}
+		return "?" + q.toString()
+	}
+
+	for (const api of [worldCreate, worldSelect, worldArchive, worldDelete]) {
+		api.oncomplete = function() {
+			worldList.call()
+		}
+	}
+
+	// rotationHistory
+	rotationHistory.onsuccess = function(xhttp) {
+		var data = JSON.parse(xhttp.response)
+		var rlist = document.getElementById("rotation-list")
+
+		while (rlist.lastElementChild) {
+			rlist.removeChild(rlist.lastElementChild)
+		}
+
+		var next = document.createElement("div")
+		next.classList.add("c-card__item")
+		next.innerText = "Next rotation: " + (data.Next.startsWith("0001") ?
+			"not scheduled" : new Date(data.Next).toLocaleString())
+		rlist.append(next)
+
+		for (const r of data.History.slice().reverse()) {
+			var item = document.createElement("div")
+			item.classList.add("c-card__item")
+			item.innerText = "#" + r.Number + " " + new Date(r.Time).toLocaleString() +
+				": " + (r.Previous || "?") + " -> " + (r.Name || r.World || "?")
+			if (r.Seed) {
+				item.innerText += " (seed " + r.Seed + ")"
+			}
+			if (r.Error) {
+				item.classList.add("serverlog-error")
+				item.innerText += " - " + r.Error
+			}
+			rlist.append(item)
+		}
+	}
+
+	// worldProgression
+	worldProgression.onsuccess = function(xhttp) {
+		var data = JSON.parse(xhttp.response)
+		var plist = document.getElementById("progression-list")
+
+		while (plist.lastElementChild) {
+			plist.removeChild(plist.lastElementChild)
+		}
+
+		var done = data.Milestones.filter(m => m.Reached).length
+		var summary = document.createElement("div")
+		summary.classList.add("c-card__item")
+		summary.innerText = done + " of " + data.Milestones.length + " milestones reached"
+		plist.append(summary)
+
+		for (const m of data.Milestones) {
+			var item = document.createElement("div")
+			var badge = document.createElement("span")
+			var text = document.createElement("span")
+
+			item.classList.add("c-card__item")
+			badge.classList.add("c-badge")
+			badge.classList.add(m.Reached ? "c-badge--success" : "c-badge--ghost")
+			badge.innerText = m.Reached ? "Done" : "Not yet"
+			text.innerText = " " + m.Name
+
+			if (m.Record) {
+				text.innerText += " - " + new Date(m.Record.Time).toLocaleString()
+				if (m.Record.Online && m.Record.Online.length > 0) {
+					text.innerText += " (" + m.Record.Online.join(", ") + ")"
+				}
+				if (!m.Record.Confirmed) {
+					text.innerText += " [not yet saved]"
+				}
+			}
+
+			item.append(badge, text)
+			plist.append(item)
+		}
+	}
+
+	// reportsList
+	reportsList.onsuccess = function(xhttp) {
+		var reports = JSON.parse(xhttp.response)
+		var rlist = document.getElementById("report-list")
+
+		while (rlist.lastElementChild) {
+			rlist.removeChild(rlist.lastElementChild)
+		}
+
+		if (reports.length == 0) {
+			var empty = document.createElement("div")
+			empty.classList.add("c-card__item")
+			empty.innerText = "No open reports"
+			rlist.append(empty)
+		}
+
+		for (const r of reports) {
+			var rdiv = document.createElement("div")
+			var badge = document.createElement("span")
+			var label = document.createElement("span")
+			var context = document.createElement("div")
+
+			rdiv.classList.add("c-card__item")
+			badge.classList.add("c-badge")
+			badge.classList.add(r.Status == "open" ? "c-badge--warning" : "c-badge--info")
+			badge.innerText = r.Status == "claimed" ? "Claimed by " + r.ClaimedBy : r.Status
+			label.innerText = " #" + r.ID + " " + new Date(r.Time).toLocaleString() + ": " +
+				r.Reporter + " reported " + r.Target + (r.IP ? " (" + r.IP + ")" : "") +
+				": " + r.Reason
+
+			for (const c of r.Context || []) {
+				var line = document.createElement("div")
+				line.innerText = new Date(c.Time).toLocaleTimeString() + " <" + c.Name + "> " + c.Message
+				context.append(line)
+			}
+
+			rdiv.append(badge, label, context)
+
+			for (const [text, cls, api] of [
+				["Claim", "c-button--brand", reportsClaim],
+				["Resolve", "c-button--success", reportsResolve],
+				["Kick", "c-button--warning", reportsKick],
+				["Ban", "c-button--error", reportsBan]]) {
+				var btn = document.createElement("button")
+				btn.classList.add("c-button")
+				btn.classList.add(cls)
+				btn.setAttribute("type", "button")
+				btn.value = r.ID
+				btn.innerText = text
+				btn.addEventListener('click', function() {
+					if (api !== reportsBan || confirm("Ban the player reported in #" + this.value + "?")) {
+						api.call(this.value)
+					}
+				})
+				rdiv.append(btn)
+			}
+
+			rlist.append(rdiv)
+		}
+	}
+
+	for (const api of [reportsClaim, reportsResolve, reportsKick, reportsBan]) {
+		api.oncomplete = function() {
+			reportsList.call()
+		}
+	}
+
+	// namesIllegal
+	namesIllegal.onsuccess = function(xhttp) {
+		var nlist = document.getElementById("illegal-name-list")
+
+		while (nlist.lastElementChild) {
+			nlist.removeChild(nlist.lastElementChild)
+		}
+
+		for (const n of JSON.parse(xhttp.response)) {
+			var ndiv = document.createElement("div")
+			var pattern = document.createElement("code")
+			var reason = document.createElement("span")
+			var remove = document.createElement("button")
+
+			ndiv.classList.add("c-card__item")
+			ndiv.classList.add("c-input-group")
+
+			pattern.innerText = n.Pattern
+			reason.innerText = " " + n.Reason
+
+			remove.classList.add("c-button")
+			remove.classList.add("c-button--error")
+			remove.setAttribute("type", "button")
+			remove.value = n.Pattern
+			remove.innerText = "Remove"
+			remove.addEventListener('click', function() {
+				if (confirm("Remove the illegal name pattern " + this.value + "?")) {
+					namesRemove.call("?" + new URLSearchParams({pattern: this.value}).toString())
+				}
+			})
+
+			ndiv.append(pattern, reason, remove)
+			nlist.append(ndiv)
+		}
+	}
+
+	namesAdd.getdata = function() {
+		var q = new URLSearchParams()
+		q.set("pattern", document.getElementById("illegal-name-pattern").value)
+		q.set("reason", document.getElementById("illegal-name-reason").value)
+		q.set("kick", document.getElementById("illegal-name-kick").checked)
+		return "?" + q.toString()
+	}
+
+	namesAdd.onsuccess = function(xhttp) {
+		var res = JSON.parse(xhttp.response)
+		document.getElementById("illegal-name-error").innerText = res.Matched.length == 0 ? "" :
+			(res.Kicked ? "Kicked: " : "Online with this name: ") + res.Matched.join(", ")
+		resetElement(document.getElementById("illegal-name-pattern"))
+		resetElement(document.getElementById("illegal-name-reason"))
+		namesIllegal.call()
+	}
+
+	namesAdd.onfailure = function(xhttp) {
+		document.getElementById("illegal-name-error").innerText = xhttp.responseText
+	}
+
+	namesRemove.oncomplete = function() {
+		namesIllegal.call()
+	}
+
 	// playerKick
 	playerKick.oncomplete = function() {
 		setTimeout(function() { ajaxFullstatus.call() }, 3000)
 	}
 
 	setInterval(function(){ ajaxFullstatus.call() }, 10 * 1000)
+	setTimeout(function(){ backupList.call() }, 0)
+	setTimeout(function(){ worldList.call() }, 0)
+	setTimeout(function(){ rotationHistory.call() }, 0)
+	setTimeout(function(){ worldProgression.call() }, 0)
+	setInterval(function(){ worldProgression.call() }, 60 * 1000)
+	setTimeout(function(){ reportsList.call() }, 0)
+	setTimeout(function(){ namesIllegal.call() }, 0)
 
 	if (DEBUG) {
 		console.log("DOM is ready, and javascript is loaded.")
@@ -39,6 +39,22 @@ function prepareChatItem(elm, text) {
 			btn.innerText = chatter
 			break;
 
+		case (prefix == "[EVENT] "):
+			var reKind = new RegExp("^\\(([^()]+)\\) ")
+			var kind = msg.match(reKind)
+			elm.classList.add("serverlog-info")
+			btn.classList.add("c-badge")
+			btn.classList.add("c-badge--success")
+			btn.innerText = kind ? kind[1] : "Event"
+			msg = msg.replace(reKind, "")
+
+			// New reports are pushed to the moderators as they come in
+			if (kind && kind[1] == "Report") {
+				btn.classList.replace("c-badge--success", "c-badge--warning")
+				reportsList.call()
+			}
+			break;
+
 		case (prefix == "[WARN] "):
 			elm.classList.add("serverlog-warn")
 			btn.classList.add("c-badge")
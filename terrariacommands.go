@@ -0,0 +1,471 @@
+package main
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+const (
+	maxSayLength      = 120
+	maxPlayerName     = 20
+	maxPasswordLength = 64
+	maxMOTDLength     = 256
+	commandTimeout    = 10 * time.Second
+)
+
+var (
+	errEmptyArgument   = errors.New("argument can not be empty")
+	errCommandTimedOut = errors.New("timed out waiting for a response from terraria")
+
+	respPassword   = regexp.MustCompile("^Password: (.*)$")
+	respNoPassword = regexp.MustCompile("^No password set\\.?$")
+	respMOTD       = regexp.MustCompile("^MOTD: (.*)$")
+	respTime       = regexp.MustCompile("^Time: ([0-9]{1,2}):([0-9]{2}) ?([AP]M)$")
+
+	// Chat is printed as "<name> message", so entries never start with "<"
+	respPlayer     = regexp.MustCompile("^([^<].{0,19}) \\(([0-9.]+):[0-9]{1,5}\\)$")
+	respPlayers    = regexp.MustCompile("^(No players connected|([0-9]+) players? connected)\\.$")
+	respMaxPlayers = regexp.MustCompile("^Player limit: ([0-9]+)$")
+	respPort       = regexp.MustCompile("^Port: ([0-9]+)$")
+	respSeed       = regexp.MustCompile("^World Seed: (.*)$")
+	respVersion    = regexp.MustCompile("^Terraria Server v(.*)$")
+)
+
+// TerrariaConsole is a typed interface to the console commands of a
+// TerrariaServer. Arguments are sanitized so that they can not break out of
+// the command they are sent with, and responses are parsed into Go values.
+type TerrariaConsole struct {
+	s *TerrariaServer
+}
+
+// consoleWaiter receives console output while a command waits for its
+// response. feed is given single lines, and respond is given multi-line
+// responses. Either returns true once the response is complete.
+type consoleWaiter struct {
+	feed    func(string) bool
+	respond func(*ConsoleResponse) bool
+	done    chan struct{}
+	once    sync.Once
+}
+
+// Console - Return the typed console of the server
+func (s *TerrariaServer) Console() GameConsole {
+	return &TerrariaConsole{s: s}
+}
+
+// Say - Broadcast a message. Messages that are too long for a single line are
+// split at word boundaries and sent in order.
+func (c *TerrariaConsole) Say(msg string) error {
+	msg = sanitizeConsole(msg)
+	if msg == "" {
+		return errEmptyArgument
+	}
+
+	for _, m := range splitMessage(msg, maxSayLength) {
+		c.s.EnqueueCommand("say " + m)
+	}
+	return nil
+}
+
+// Kick - Kick a player by name
+func (c *TerrariaConsole) Kick(name string) error {
+	name, err := sanitizeName(name)
+	if err != nil {
+		return err
+	}
+
+	c.s.EnqueueCommand("kick " + name)
+	return nil
+}
+
+// Ban - Ban a player by name
+func (c *TerrariaConsole) Ban(name string) error {
+	name, err := sanitizeName(name)
+	if err != nil {
+		return err
+	}
+
+	c.s.EnqueueCommand("ban " + name)
+	return nil
+}
+
+// Password - Return the current server password
+func (c *TerrariaConsole) Password() (string, error) {
+	return c.password("password")
+}
+
+// SetPassword - Set the server password, and return the password that
+// Terraria reports afterwards
+func (c *TerrariaConsole) SetPassword(p string) (string, error) {
+	p = sanitizeConsole(p)
+	switch {
+	case p == "":
+		return "", errEmptyArgument
+	case len(p) > maxPasswordLength || strings.ContainsRune(p, ' '):
+		return "", errors.New("password must be at most 64 characters with no spaces")
+	}
+
+	return c.password("password " + p)
+}
+
+func (c *TerrariaConsole) password(cmd string) (string, error) {
+	m, err := c.single(cmd, respPassword, respNoPassword)
+	if err != nil {
+		return "", err
+	}
+
+	if len(m) < 2 {
+		return "", nil
+	}
+	c.s.SetPassword(m[1])
+	return m[1], nil
+}
+
+// MOTD - Return the current message of the day
+func (c *TerrariaConsole) MOTD() (string, error) {
+	m, err := c.single("motd", respMOTD)
+	if err != nil {
+		return "", err
+	}
+
+	c.s.SetMOTD(m[1])
+	return m[1], nil
+}
+
+// SetMOTD - Set the message of the day, and return it as Terraria reports it
+func (c *TerrariaConsole) SetMOTD(msg string) (string, error) {
+	msg = sanitizeConsole(msg)
+	switch {
+	case msg == "":
+		return "", errEmptyArgument
+	case len(msg) > maxMOTDLength:
+		return "", errors.New("MOTD must be at most 256 characters")
+	}
+
+	c.s.EnqueueCommand("motd " + msg)
+	return c.MOTD()
+}
+
+// Time - Return the current in-game time
+func (c *TerrariaConsole) Time() (*GameTime, error) {
+	m, err := c.single("time", respTime)
+	if err != nil {
+		return nil, err
+	}
+
+	h, _ := strconv.Atoi(m[1])
+	min, _ := strconv.Atoi(m[2])
+	if h == 12 {
+		h = 0
+	}
+	if m[3] == "PM" {
+		h += 12
+	}
+	return &GameTime{Hour: h, Minute: min}, nil
+}
+
+// Dawn - Set the time to dawn
+func (c *TerrariaConsole) Dawn() error {
+	c.s.EnqueueCommand("dawn")
+	return nil
+}
+
+// Noon - Set the time to noon
+func (c *TerrariaConsole) Noon() error {
+	c.s.EnqueueCommand("noon")
+	return nil
+}
+
+// Dusk - Set the time to dusk
+func (c *TerrariaConsole) Dusk() error {
+	c.s.EnqueueCommand("dusk")
+	return nil
+}
+
+// Midnight - Set the time to midnight
+func (c *TerrariaConsole) Midnight() error {
+	c.s.EnqueueCommand("midnight")
+	return nil
+}
+
+// Settle - Settle all of the liquids in the world
+func (c *TerrariaConsole) Settle() error {
+	c.s.EnqueueCommand("settle")
+	return nil
+}
+
+// Save - Save the world and wait for the save to be confirmed
+func (c *TerrariaConsole) Save() error {
+	return c.s.SaveWorld(saveTimeout)
+}
+
+// Exit - Save the world and stop the server
+func (c *TerrariaConsole) Exit() (*StopReport, error) {
+	return c.s.Shutdown(false)
+}
+
+// ExitNoSave - Stop the server without saving the world
+func (c *TerrariaConsole) ExitNoSave() (*StopReport, error) {
+	return c.s.Shutdown(true)
+}
+
+// Playing - Return the players that Terraria reports as connected
+func (c *TerrariaConsole) Playing() ([]*PlayerData, error) {
+	r, err := c.response("playing", responsePlaying)
+	if err != nil {
+		return nil, err
+	}
+
+	if r.Count != len(r.Players) {
+		LogWarning(c.s, sprintf("Terraria reported %d players but listed %d",
+			r.Count, len(r.Players)))
+	}
+	return r.Players, nil
+}
+
+// Help - Return the console commands that Terraria lists, along with their
+// descriptions
+func (c *TerrariaConsole) Help() (map[string]string, error) {
+	r, err := c.response("help", responseHelp)
+	if err != nil {
+		return nil, err
+	}
+	return r.Commands, nil
+}
+
+// MaxPlayers - Return the player limit
+func (c *TerrariaConsole) MaxPlayers() (int, error) {
+	return c.number("maxplayers", respMaxPlayers)
+}
+
+// Port - Return the port that the server listens on
+func (c *TerrariaConsole) Port() (int, error) {
+	return c.number("port", respPort)
+}
+
+// Seed - Return the seed of the world
+func (c *TerrariaConsole) Seed() (string, error) {
+	m, err := c.single("seed", respSeed)
+	if err != nil {
+		return "", err
+	}
+
+	c.s.SetSeed(m[1])
+	return m[1], nil
+}
+
+// Version - Return the version of the server
+func (c *TerrariaConsole) Version() (string, error) {
+	m, err := c.single("version", respVersion)
+	if err != nil {
+		return "", err
+	}
+
+	c.s.SetVersion(m[1])
+	return m[1], nil
+}
+
+// Clear - Clear the console window
+func (c *TerrariaConsole) Clear() error {
+	c.s.EnqueueCommand("clear")
+	return nil
+}
+
+// single sends a command and returns the submatches of the first line of
+// output that matches one of the given expressions
+func (c *TerrariaConsole) single(cmd string, res ...*regexp.Regexp) ([]string, error) {
+	var m []string
+	w := c.s.await(func(l string) bool {
+		for _, re := range res {
+			if m = re.FindStringSubmatch(l); m != nil {
+				return true
+			}
+		}
+		return false
+	})
+
+	c.s.EnqueueCommand(cmd)
+	if err := c.s.waitFor(w, commandTimeout); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// response sends a command and returns the multi-line response of the given
+// kind that follows it
+func (c *TerrariaConsole) response(cmd, kind string) (*ConsoleResponse, error) {
+	var res *ConsoleResponse
+	w := c.s.awaitResponse(func(r *ConsoleResponse) bool {
+		if r.Command != kind {
+			return false
+		}
+		res = r
+		return true
+	})
+
+	c.s.EnqueueCommand(cmd)
+	if err := c.s.waitFor(w, commandTimeout); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// number sends a command and parses the number in its response
+func (c *TerrariaConsole) number(cmd string, re *regexp.Regexp) (int, error) {
+	m, err := c.single(cmd, re)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(m[1])
+}
+
+/***********/
+/* Waiters */
+/***********/
+
+// await registers a waiter for console output. It must be registered before
+// the command is sent so that no output is missed.
+func (s *TerrariaServer) await(feed func(string) bool) *consoleWaiter {
+	w := &consoleWaiter{feed: feed, done: make(chan struct{})}
+
+	s.waitmu.Lock()
+	s.waiters = append(s.waiters, w)
+	s.waitmu.Unlock()
+	return w
+}
+
+// awaitResponse registers a waiter for a multi-line response
+func (s *TerrariaServer) awaitResponse(respond func(*ConsoleResponse) bool) *consoleWaiter {
+	w := &consoleWaiter{respond: respond, done: make(chan struct{})}
+
+	s.waitmu.Lock()
+	s.waiters = append(s.waiters, w)
+	s.waitmu.Unlock()
+	return w
+}
+
+// waitFor blocks until the waiter has its response, or the timeout passes
+func (s *TerrariaServer) waitFor(w *consoleWaiter, timeout time.Duration) error {
+	defer s.removeWaiter(w)
+
+	select {
+	case <-w.done:
+		return nil
+	case <-time.After(timeout):
+		return errCommandTimedOut
+	}
+}
+
+func (s *TerrariaServer) removeWaiter(w *consoleWaiter) {
+	s.waitmu.Lock()
+	defer s.waitmu.Unlock()
+
+	for i, v := range s.waiters {
+		if v == w {
+			s.waiters = append(s.waiters[:i], s.waiters[i+1:]...)
+			return
+		}
+	}
+}
+
+// dispatchOutput hands a line of output to the waiters, oldest first. The
+// first waiter that accepts a line keeps it.
+func (s *TerrariaServer) dispatchOutput(l string) {
+	s.dispatch(func(w *consoleWaiter) bool {
+		return w.feed != nil && w.feed(l)
+	})
+}
+
+// dispatchResponse hands a multi-line response to the waiters in the same
+// way that dispatchOutput does for single lines
+func (s *TerrariaServer) dispatchResponse(r *ConsoleResponse) {
+	s.dispatch(func(w *consoleWaiter) bool {
+		return w.respond != nil && w.respond(r)
+	})
+}
+
+func (s *TerrariaServer) dispatch(accept func(*consoleWaiter) bool) {
+	s.waitmu.Lock()
+	defer s.waitmu.Unlock()
+
+	for i, w := range s.waiters {
+		select {
+		case <-w.done:
+			continue
+		default:
+		}
+
+		if accept(w) {
+			w.once.Do(func() { close(w.done) })
+			s.waiters = append(s.waiters[:i], s.waiters[i+1:]...)
+			return
+		}
+	}
+}
+
+/****************/
+/* Sanitization */
+/****************/
+
+// sanitizeConsole replaces line breaks and other control characters with
+// spaces, so that text can not inject additional console commands
+func sanitizeConsole(s string) string {
+	return strings.TrimSpace(strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || r == '\u2028' || r == '\u2029' {
+			return ' '
+		}
+		return r
+	}, s))
+}
+
+// sanitizeName cleans up a player name and checks that it is one that
+// Terraria allows
+func sanitizeName(name string) (string, error) {
+	name = sanitizeConsole(name)
+	switch {
+	case name == "":
+		return "", errEmptyArgument
+	case len([]rune(name)) > maxPlayerName:
+		return "", errors.New("player names are at most 20 characters")
+	}
+	return name, nil
+}
+
+// splitMessage breaks a message into pieces of at most max characters,
+// splitting at spaces where it can
+func splitMessage(msg string, max int) []string {
+	parts := make([]string, 0)
+	cur := ""
+
+	for _, word := range strings.Fields(msg) {
+		for len([]rune(word)) > max {
+			if cur != "" {
+				parts = append(parts, cur)
+				cur = ""
+			}
+			r := []rune(word)
+			parts = append(parts, string(r[:max]))
+			word = string(r[max:])
+		}
+
+		switch {
+		case cur == "":
+			cur = word
+		case len([]rune(cur))+1+len([]rune(word)) > max:
+			parts = append(parts, cur)
+			cur = word
+		default:
+			cur += " " + word
+		}
+	}
+
+	if cur != "" {
+		parts = append(parts, cur)
+	}
+	return parts
+}
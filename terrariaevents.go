@@ -1,120 +1,348 @@
 package main
 
-import "strings"
+import (
+	"strings"
+	"time"
+)
 
-func init() {
+const (
+	eventKindPlayerJoin  = "player-join"
+	eventKindPlayerLeave = "player-leave"
+	eventKindBoss        = "boss"
+	eventKindInvasion    = "invasion"
+	eventKindWorld       = "world"
+	eventKindDeath       = "death"
+
+	invasionApproaching = "approaching"
+	invasionArrived     = "arrived"
+	invasionDefeated    = "defeated"
+
+	playerReconcileInterval = 5 * time.Minute
+)
+
+// NewTerrariaEventRegistry - Return a registry with the events of a vanilla
+// Terraria server
+func NewTerrariaEventRegistry() *EventRegistry {
+	r := NewEventRegistry(defaultEventHandler)
 	ipReString := "[0-9]{1,3}\\.[0-9]{1,3}\\.[0-9]{1,3}\\.[0-9]{1,3}"
 
-	RegisterGameEventHandler("EventConnection",
-		"^("+ipReString+"):[0-9]{1,5} is connecting...$",
+	r.mustRegister("EventConnection",
+		"^("+ipReString+"):[0-9]{1,5} is connecting\\.\\.\\.$",
 		handleEventConnection)
-	RegisterGameEventHandler("EventPlayerJoin",
-		"^(.{1,20}) has joined.$",
+	r.mustRegister("EventPlayerJoin",
+		"^(.{1,20}) has joined\\.$",
 		handleEventPlayerJoin)
-	RegisterGameEventHandler("EventPlayerLeft",
-		"^(.{1,20}) has left.$",
+	r.mustRegister("EventPlayerLeft",
+		"^(.{1,20}) has left\\.$",
 		handleEventPlayerLeft)
-	RegisterGameEventHandler("EventPlayerInfo",
-		"^(.{1,20}) \\(("+ipReString+"):[0-9]{1,5}\\)$",
-		handleEventPlayerInfo)
-	RegisterGameEventHandler("EventPlayerChat",
+	// Chat is matched first, so that players can not fake other events by
+	// saying them
+	r.mustRegister("EventPlayerChat",
 		"^<(.{1,20})> (.*)$",
-		handleEventPlayerChat)
-	RegisterGameEventHandler("EventPlayerBoot",
+		handleEventPlayerChat, EventPriorityHigh)
+	r.mustRegister("EventPlayerBoot",
 		"^("+ipReString+"):[0-9]{1,5} was booted: (.*)$",
 		handleEventPlayerBoot)
-	RegisterGameEventHandler("EventPlayerBan",
+	r.mustRegister("EventPlayerBan",
 		"^("+ipReString+"):[0-9]{1,5} was banned: (.*)$",
 		handleEventPlayerBan)
-	RegisterGameEventHandler("EventServerTime",
-		"^Time: (.?:..)([AP]M)$",
+	r.mustRegister("EventServerTime",
+		"^Time: ([0-9]{1,2}:[0-9]{2}) ?([AP]M)$",
 		handleEventServerTime)
-	RegisterGameEventHandler("EventServerSeed",
+	r.mustRegister("EventServerSeed",
 		"^World Seed: (.*)$",
 		handleEventServerSeed)
-	RegisterGameEventHandler("EventServerMOTD",
+	r.mustRegister("EventServerMOTD",
 		"^MOTD: (.*)$",
 		handleEventServerMOTD)
-	RegisterGameEventHandler("EventServerPass",
+	r.mustRegister("EventServerPass",
 		"^Password: (.*)$",
 		handleEventServerPass)
-	RegisterGameEventHandler("EventServerVers",
+	r.mustRegister("EventServerVers",
 		"^Terraria Server v(.*)$",
 		handleEventServerVers)
-	RegisterGameEventHandler("EventNone",
-		".*",
-		defaultEventHandler)
+	r.mustRegister("EventWorldSave",
+		"^(Saving world data|Validating world save|Backing up world file)(?:: ([0-9]{1,3})%)?\\.*$",
+		handleEventWorldSave)
+
+	// Invasions come before bosses, as their defeat is announced the same way.
+	// Terraria words them as "A goblin army ...", "The Frost Legion ...",
+	// "Pirates ..." and "The pirates ...", so the article is optional.
+	invaders := "(?:(?:A|The) )?((?i:goblin army|frost legion|pirates|martians))"
+	r.mustRegister("EventInvasionApproach",
+		"^"+invaders+" (?:is|are) approaching from the (east|west)!$",
+		handleEventInvasion(invasionApproaching))
+	r.mustRegister("EventInvasionArrive",
+		"^"+invaders+" (?:has arrived|have arrived|is invading|are invading)!$",
+		handleEventInvasion(invasionArrived))
+	r.mustRegister("EventInvasionDefeat",
+		"^"+invaders+" (?:has|have) been defeated!$",
+		handleEventInvasion(invasionDefeated))
+	r.mustRegister("EventBossSummon",
+		"^(.{1,40}) (?:has|have) awoken!$",
+		handleEventBossSummon)
+	r.mustRegister("EventBossDefeat",
+		"^(.{1,40}) (?:has|have) been defeated!$",
+		handleEventBossDefeat)
+	r.mustRegister("EventWorld",
+		"^(The Blood Moon is rising\\.\\.\\.|A solar eclipse is happening!|"+
+			"The Pumpkin Moon is rising\\.\\.\\.|The Frost Moon is rising\\.\\.\\.|"+
+			"A meteorite has landed!|Slime is falling from the sky!|"+
+			"The ancient spirits of light and dark have been released\\.)$",
+		handleEventWorld)
+	r.mustRegister("EventPlayerKilled",
+		"^(.{1,20}?)(?:'s)? (?:"+strings.Join(deathsByKiller, "|")+") by (.+?)\\.?$",
+		handleEventPlayerKilled)
+	r.mustRegister("EventPlayerDied",
+		"^(.{1,20}?) ("+strings.Join(deathsByWorld, "|")+")\\.*$",
+		handleEventPlayerDied)
+	return r
 }
 
-func handleEventConnection(gs GameServer, e *GameEvent, in string,
-	oc chan string) {
-	m := e.Capture.FindStringSubmatch(in)
-	go func() { oc <- m[1] }()
+// The ways that Terraria describes a player being killed by something, which
+// is named after the phrase (ex: Bob was slain by a Zombie.)
+var deathsByKiller = []string{
+	"was slain", "was killed", "was eviscerated", "was murdered",
+	"face was torn off", "entrails were ripped out", "was destroyed",
+	"skull was crushed", "got massacred", "got impaled", "was torn in half",
+	"was decapitated", "let their arms get torn off",
+	"watched their innards become outards", "was brutally dissected",
+	"extremities were detached", "body was mangled",
+	"vital organs were ruptured", "was turned into a pile of flesh",
+	"got snapped in half", "was cut down the middle", "was chopped into pieces",
+	"plead for death was answered", "meat was ripped off the bone",
+	"flailing about was finally stopped", "had their head removed",
+	"was removed from .{1,40}",
 }
 
-func handleEventPlayerJoin(gs GameServer, e *GameEvent, in string,
-	oc chan string) {
-	SendCommand("playing", gs)
-	LogInfo(gs, in, gs.WSOutput())
+// The ways that Terraria describes a player dying without a killer, and the
+// cause that each is recorded as
+var deathsByWorld = []string{
+	"fell to their death", "didn't bounce", "forgot to breathe",
+	"is sleeping with the fishes", "drowned", "is shark food",
+	"got melted", "was incinerated", "tried to swim in lava",
+	"likes to play in magma", "was pricked", "was impaled by a spike",
+	"was inflicted with too much poison", "went up in flames",
+	"was burned to a crisp", "was electrocuted", "was petrified",
+	"was struck by lightning", "was consumed by the dark",
+	"faced the wrath of the ancient gods", "was crushed", "was slain",
+	"tried to escape", "was licked", "left a small crater",
+	"turned into a pile of ash",
 }
 
-func handleEventPlayerLeft(gs GameServer, e *GameEvent, in string,
-	oc chan string) {
-	name := strings.TrimSuffix(in, " has left.")
-	gs.RemovePlayer(name)
+var deathCauses = map[string]string{
+	"fell to their death":                 "Falling",
+	"didn't bounce":                       "Falling",
+	"left a small crater":                 "Falling",
+	"forgot to breathe":                   "Drowning",
+	"is sleeping with the fishes":         "Drowning",
+	"drowned":                             "Drowning",
+	"is shark food":                       "Drowning",
+	"got melted":                          "Lava",
+	"was incinerated":                     "Lava",
+	"tried to swim in lava":               "Lava",
+	"likes to play in magma":              "Lava",
+	"was pricked":                         "Spikes",
+	"was impaled by a spike":              "Spikes",
+	"was inflicted with too much poison":  "Poison",
+	"went up in flames":                   "Fire",
+	"was burned to a crisp":               "Fire",
+	"turned into a pile of ash":           "Fire",
+	"was electrocuted":                    "Electricity",
+	"was struck by lightning":             "Electricity",
+	"was petrified":                       "Petrified",
+	"was consumed by the dark":            "Darkness",
+	"faced the wrath of the ancient gods": "Ancient Gods",
+	"was crushed":                         "Crushed",
+	"tried to escape":                     "The Wall of Flesh",
+	"was licked":                          "The Wall of Flesh",
+	"was slain":                           "Unknown",
 }
 
-func handleEventPlayerInfo(gs GameServer, e *GameEvent, in string,
-	oc chan string) {
-	go func() { oc <- in }()
-	m := e.Capture.FindStringSubmatch(in)
-	plr := gs.NewPlayer(m[1], m[2])
-	if IsNameIllegal(plr.Name()) {
-		plr.Kick("Name is not allowed")
+// Names of the invasions, keyed by how Terraria refers to them, in lower case
+// and without an article
+var invasionNames = map[string]string{
+	"goblin army":  "Goblin Army",
+	"frost legion": "Frost Legion",
+	"pirates":      "Pirate Invasion",
+	"martians":     "Martian Madness",
+}
+
+// Names of world events, keyed by their announcement
+var worldEventNames = map[string]string{
+	"The Blood Moon is rising...":                               "Blood Moon",
+	"A solar eclipse is happening!":                             "Solar Eclipse",
+	"The Pumpkin Moon is rising...":                             "Pumpkin Moon",
+	"The Frost Moon is rising...":                               "Frost Moon",
+	"A meteorite has landed!":                                   "Meteorite",
+	"Slime is falling from the sky!":                            "Slime Rain",
+	"The ancient spirits of light and dark have been released.": "Hardmode",
+}
+
+func handleEventConnection(gs GameServer, e *GameEvent, in string, m []string) Event {
+	return &ConnectionAttempt{EventHeader: newEventHeader(in), IP: m[1]}
+}
+
+func handleEventPlayerJoin(gs GameServer, e *GameEvent, in string, m []string) Event {
+	gs.PlayerJoining(m[1])
+	SendCommand("playing", gs)
+	LogInfo(gs, in, gs.WSOutput())
+	return &PlayerJoined{EventHeader: newEventHeader(in), Name: m[1]}
+}
+
+func handleEventPlayerLeft(gs GameServer, e *GameEvent, in string, m []string) Event {
+	if !gs.RemovePlayer(m[1]) {
+		LogDebug(gs, m[1]+" left but was not being tracked")
 	}
+	LogInfo(gs, in, gs.WSOutput())
+	SendCommand("playing", gs)
+	return &PlayerLeft{EventHeader: newEventHeader(in), Name: m[1]}
 }
 
-func handleEventPlayerChat(gs GameServer, e *GameEvent, in string,
-	oc chan string) {
+func handleEventPlayerChat(gs GameServer, e *GameEvent, in string, m []string) Event {
 	LogChat(gs, in, gs.WSOutput())
+	return &Chat{EventHeader: newEventHeader(in), Name: m[1], Message: m[2]}
 }
 
-func handleEventPlayerBoot(gs GameServer, e *GameEvent, in string,
-	oc chan string) {
-	m := e.Capture.FindStringSubmatch(in)
+func handleEventPlayerBoot(gs GameServer, e *GameEvent, in string, m []string) Event {
 	LogInfo(gs, sprintf("Failed connection: %s [%s]", m[1], m[2]), gs.WSOutput())
+	return &Booted{EventHeader: newEventHeader(in), IP: m[1], Reason: m[2]}
 }
 
-func handleEventPlayerBan(gs GameServer, e *GameEvent, in string,
-	oc chan string) {
+func handleEventPlayerBan(gs GameServer, e *GameEvent, in string, m []string) Event {
 	LogInfo(gs, in, gs.WSOutput())
+	return &Banned{EventHeader: newEventHeader(in), IP: m[1], Reason: m[2]}
 }
 
-func handleEventServerTime(gs GameServer, e *GameEvent, in string,
-	oc chan string) {
+func handleEventServerTime(gs GameServer, e *GameEvent, in string, m []string) Event {
 	LogOutput(gs, in)
+	return &ServerInfo{EventHeader: newEventHeader(in), Key: "time", Value: m[1] + " " + m[2]}
 }
 
-func handleEventServerSeed(gs GameServer, e *GameEvent, in string,
-	oc chan string) {
-	m := e.Capture.FindStringSubmatch(in)
+func handleEventServerSeed(gs GameServer, e *GameEvent, in string, m []string) Event {
 	gs.SetSeed(m[1])
+	return &ServerInfo{EventHeader: newEventHeader(in), Key: "seed", Value: m[1]}
 }
 
-func handleEventServerMOTD(gs GameServer, e *GameEvent, in string,
-	oc chan string) {
-	m := e.Capture.FindStringSubmatch(in)
+func handleEventServerMOTD(gs GameServer, e *GameEvent, in string, m []string) Event {
 	gs.SetMOTD(m[1])
+	return &ServerInfo{EventHeader: newEventHeader(in), Key: "motd", Value: m[1]}
 }
 
-func handleEventServerPass(gs GameServer, e *GameEvent, in string,
-	oc chan string) {
-	m := e.Capture.FindStringSubmatch(in)
+func handleEventServerPass(gs GameServer, e *GameEvent, in string, m []string) Event {
 	gs.SetPassword(m[1])
+	return &ServerInfo{EventHeader: newEventHeader(in), Key: "password", Value: m[1]}
 }
 
-func handleEventServerVers(gs GameServer, e *GameEvent, in string,
-	oc chan string) {
-	m := e.Capture.FindStringSubmatch(in)
+func handleEventServerVers(gs GameServer, e *GameEvent, in string, m []string) Event {
 	gs.SetVersion(m[1])
+	gs.ConfirmWorldSave()
+	return &ServerInfo{EventHeader: newEventHeader(in), Key: "version", Value: m[1]}
+}
+
+func handleEventWorldSave(gs GameServer, e *GameEvent, in string, m []string) Event {
+	gs.WorldSaving(in)
+	return &WorldSaving{EventHeader: newEventHeader(in), Stage: m[1]}
+}
+
+func handleEventInvasion(stage string) gameEventHandler {
+	return func(gs GameServer, e *GameEvent, in string, m []string) Event {
+		ev := &Invasion{
+			EventHeader: newEventHeader(in),
+			Invasion:    invasionNames[strings.ToLower(m[1])],
+			Stage:       stage,
+		}
+		if stage == invasionApproaching {
+			ev.Direction = m[2]
+		}
+		return ev
+	}
+}
+
+func handleEventBossSummon(gs GameServer, e *GameEvent, in string, m []string) Event {
+	return &BossSummoned{EventHeader: newEventHeader(in), Boss: m[1]}
+}
+
+func handleEventBossDefeat(gs GameServer, e *GameEvent, in string, m []string) Event {
+	return &BossDefeated{EventHeader: newEventHeader(in), Boss: m[1]}
+}
+
+func handleEventWorld(gs GameServer, e *GameEvent, in string, m []string) Event {
+	return &WorldEvent{EventHeader: newEventHeader(in), Name: worldEventNames[m[1]]}
+}
+
+// logGameEvents logs the boss, invasion and world events of a GameServer to
+// the console and its event log until the subscription ends
+func logGameEvents(gs GameServer) *Subscription {
+	kinds := EventKinds("BossSummoned", "BossDefeated", "Invasion", "WorldEvent")
+	return gs.Bus().Handle("game-events", kinds, func(ev Event) {
+		switch ev.(type) {
+		case *BossSummoned, *BossDefeated:
+			LogEvent(gs, "Boss", ev.Raw(), gs.WSOutput())
+			gs.EventLog().Add(eventKindBoss, ev.Raw())
+		case *Invasion:
+			LogEvent(gs, "Invasion", ev.Raw(), gs.WSOutput())
+			gs.EventLog().Add(eventKindInvasion, ev.Raw())
+		case *WorldEvent:
+			LogEvent(gs, "World", ev.Raw(), gs.WSOutput())
+			gs.EventLog().Add(eventKindWorld, ev.Raw())
+		}
+	})
+}
+
+func handleEventPlayerKilled(gs GameServer, e *GameEvent, in string, m []string) Event {
+	return playerDeath(gs, e, in, m, strings.TrimPrefix(strings.TrimPrefix(m[2], "a "), "an "))
+}
+
+func handleEventPlayerDied(gs GameServer, e *GameEvent, in string, m []string) Event {
+	cause, ok := deathCauses[m[2]]
+	if !ok {
+		cause = m[2]
+	}
+	return playerDeath(gs, e, in, m, cause)
+}
+
+// playerDeath returns the death of the player named in m[1]. Terraria words
+// the deaths of town NPCs (ex: Andrew the Guide was slain by Zombie.) the same
+// way, so deaths of anyone that is not a known player are plain output.
+func playerDeath(gs GameServer, e *GameEvent, in string, m []string, cause string) Event {
+	if gs.Player(m[1]) == nil {
+		return defaultEventHandler(gs, e, in, m)
+	}
+
+	LogEvent(gs, "Death", in, gs.WSOutput())
+	return &PlayerDeath{EventHeader: newEventHeader(in), Name: m[1], Cause: cause}
+}
+
+// handleResponse processes a multi-line response once the parser has read all
+// of it
+func (s *TerrariaServer) handleResponse(r *ConsoleResponse) {
+	for _, l := range r.Lines {
+		LogOutput(s, l)
+	}
+
+	if !r.Complete {
+		LogDebug(s, sprintf("Response to %q was cut short", r.Command))
+	}
+
+	switch r.Command {
+	case responsePlaying:
+		s.bus.Publish(&PlayerList{
+			EventHeader: newEventHeader(strings.Join(r.Lines, "\n")),
+			Players:     r.Players,
+		})
+
+		// A partial list would make everyone missing from it look like
+		// they had left
+		switch {
+		case !r.Complete:
+		case r.Count != len(r.Players):
+			LogWarning(s, sprintf("Terraria reported %d players but listed %d, not reconciling",
+				r.Count, len(r.Players)))
+		default:
+			s.reconcilePlayers(r.Players)
+		}
+	}
+
+	s.dispatchResponse(r)
 }
@@ -0,0 +1,53 @@
+package main
+
+import "testing"
+
+func TestTerrariaEventWording(t *testing.T) {
+	r := NewTerrariaEventRegistry()
+
+	tests := []struct {
+		line     string
+		event    string
+		invasion string
+		stage    string
+	}{
+		{"A goblin army is approaching from the west!", "EventInvasionApproach", "Goblin Army", invasionApproaching},
+		{"A goblin army has arrived!", "EventInvasionArrive", "Goblin Army", invasionArrived},
+		{"A goblin army has been defeated!", "EventInvasionDefeat", "Goblin Army", invasionDefeated},
+		{"The Frost Legion is approaching from the east!", "EventInvasionApproach", "Frost Legion", invasionApproaching},
+		{"The Frost Legion has arrived!", "EventInvasionArrive", "Frost Legion", invasionArrived},
+		{"The Frost Legion has been defeated!", "EventInvasionDefeat", "Frost Legion", invasionDefeated},
+		{"Pirates are approaching from the east!", "EventInvasionApproach", "Pirate Invasion", invasionApproaching},
+		{"The pirates have arrived!", "EventInvasionArrive", "Pirate Invasion", invasionArrived},
+		{"The pirates have been defeated!", "EventInvasionDefeat", "Pirate Invasion", invasionDefeated},
+		{"Martians are invading!", "EventInvasionArrive", "Martian Madness", invasionArrived},
+		{"The martians have been defeated!", "EventInvasionDefeat", "Martian Madness", invasionDefeated},
+
+		{"Eye of Cthulhu has awoken!", "EventBossSummon", "", ""},
+		{"The Twins have awoken!", "EventBossSummon", "", ""},
+		{"Wall of Flesh has been defeated!", "EventBossDefeat", "", ""},
+		{"The Twins have been defeated!", "EventBossDefeat", "", ""},
+		{"The Blood Moon is rising...", "EventWorld", "", ""},
+		{"A solar eclipse is happening!", "EventWorld", "", ""},
+	}
+
+	for _, tt := range tests {
+		e, m := r.Match(tt.line)
+		if e.Name() != tt.event {
+			t.Errorf("%q matched %s, expected %s", tt.line, e.Name(), tt.event)
+			continue
+		}
+		if tt.invasion == "" {
+			continue
+		}
+
+		ev, ok := e.Handler(nil, e, tt.line, m).(*Invasion)
+		switch {
+		case !ok:
+			t.Errorf("%q was not read as an invasion", tt.line)
+		case ev.Invasion != tt.invasion || ev.Stage != tt.stage:
+			t.Errorf("%q was read as %s %s, expected %s %s", tt.line, ev.Invasion, ev.Stage,
+				tt.invasion, tt.stage)
+		}
+	}
+}
@@ -7,12 +7,21 @@ import (
 	"io"
 	"log"
 	"net"
+	"os"
 	"os/exec"
 	"runtime"
 	"strings"
+	"sync"
 	"time"
 )
 
+const (
+	stopTimeout = 30 * time.Second
+	saveTimeout = 60 * time.Second
+)
+
+var errNoSaveOutput = errors.New("terraria did not report saving the world")
+
 // TerrariaPlayer - Defines a player that has connected to the server at some point
 type TerrariaPlayer struct {
 	ip     net.IP
@@ -21,7 +30,7 @@ type TerrariaPlayer struct {
 }
 
 // SetIP - Sets or updates a players IP address
-func (p TerrariaPlayer) SetIP(ips string) {
+func (p *TerrariaPlayer) SetIP(ips string) {
 	p.ip = net.ParseIP(ips)
 }
 
@@ -35,16 +44,20 @@ func (p TerrariaPlayer) Name() string {
 	return p.name
 }
 
-// Kick - Kick a player
+// Kick - Kick a player, recording it in the moderation history
 func (p TerrariaPlayer) Kick(r string) {
-	SendCommand(sprintf("say Kicking player: \"%s\". %s.", p.Name(), r), p.server)
-	SendCommand("kick "+p.Name(), p.server)
+	p.server.Console().Say(sprintf("Kicking player: \"%s\". %s.", p.Name(), r))
+	if err := moderatePlayer(p.server, moderationKick, p.Name(), "", r, time.Time{}); err != nil {
+		LogError(p.server, "Unable to kick "+p.Name()+": "+err.Error())
+	}
 }
 
-// Ban - Ban a player
+// Ban - Ban a player, recording it in the moderation history
 func (p TerrariaPlayer) Ban(r string) {
-	SendCommand(sprintf("say Banning player: \"%s\". %s.", p.Name(), r), p.server)
-	SendCommand("ban "+p.Name(), p.server)
+	p.server.Console().Say(sprintf("Banning player: \"%s\". %s.", p.Name(), r))
+	if err := moderatePlayer(p.server, moderationBan, p.Name(), "", r, time.Time{}); err != nil {
+		LogError(p.server, "Unable to ban "+p.Name()+": "+err.Error())
+	}
 }
 
 // TerrariaServer - Terraria server definition
@@ -66,12 +79,18 @@ type TerrariaServer struct {
 	commandqueuemax int
 
 	// PlayerInfo
+	playermu sync.RWMutex // Guards players, which subscribers read
 	players  []*TerrariaPlayer
+	joining  map[string]bool // Joined, but not yet listed by "playing"
 	messages [][2]string
 
 	// Config
+	worldmu    sync.Mutex
 	worldfile  string
+	worldnew   *WorldOptions
+	worldnext  *worldSelection // Swapped in for worldfile on the next start
 	configfile string
+	banlist    string
 
 	// Game State
 	password string
@@ -80,23 +99,75 @@ type TerrariaServer struct {
 	motd     string
 	time     string
 
+	// World saving
+	savemu      sync.Mutex
+	saving      bool       // Terraria is writing the world and has not finished
+	savestarted bool       // Save output was seen since the last SaveWorld
+	savedone    chan error // Non-nil while SaveWorld is waiting for a confirmation
+
+	// Functions run before starting, and between stopping and starting
+	// during a restart
+	starthooks   []func() error
+	restarthooks []func()
+	playerhooks  []func(Player)
+
+	eventlog *EventLog
+	illegal  *IllegalNames
+	ledger   *ModerationLedger
+	bus      *EventBus
+	eventmu  sync.Mutex
+	events   *EventRegistry
+
+	// Commands waiting for their response
+	waitmu  sync.Mutex
+	waiters []*consoleWaiter
+	parser  *ConsoleParser
+
 	// Close goroutines
 	close chan struct{}
 	path  string
 }
 
+// worldSelection is a world that has been selected to be loaded once the
+// server next starts
+type worldSelection struct {
+	path string
+	opts *WorldOptions
+}
+
 // Start -
 func (s *TerrariaServer) Start() error {
 	var err error
 
-	world := "world.wld"
-	s.Cmd = exec.Command(s.path,
-		"-autocreate", "3",
-		"-world", world,
+	s.worldmu.Lock()
+	if s.worldnext != nil {
+		s.worldfile, s.worldnew = s.worldnext.path, s.worldnext.opts
+		s.worldnext = nil
+	}
+	s.worldmu.Unlock()
+
+	for _, f := range s.starthooks {
+		if err = f(); err != nil {
+			return err
+		}
+	}
+
+	args := []string{
+		"-world", s.WorldFile(),
+		"-banlist", s.banlist,
 		"-players", "8",
 		"-pass", "123123",
 		"-noupnp", "-secure",
-	)
+	}
+
+	if s.worldnew != nil {
+		LogInit(s, "Generating new world: "+s.worldnew.Name)
+		args = append(args, s.worldnew.Args()...)
+	} else {
+		args = append(args, "-autocreate", "3")
+	}
+
+	s.Cmd = exec.Command(s.path, args...)
 
 	LogDebug(s, "Getting Stdin Pipe")
 	if s.stdin, err = s.Cmd.StdinPipe(); err != nil {
@@ -114,6 +185,7 @@ func (s *TerrariaServer) Start() error {
 	s.motd = "default"
 
 	s.close = make(chan struct{})
+	s.parser = NewConsoleParser()
 	ready := make(chan struct{})
 
 	LogInit(s, "Starting supervisor goroutines")
@@ -129,6 +201,7 @@ func (s *TerrariaServer) Start() error {
 
 			case cmd := <-s.commandqueue:
 				time.Sleep(time.Second / 2)
+				s.parser.Expect(cmd)
 				b := prepareInput(cmd)
 				b.WriteTo(s.stdin)
 				LogDebug(s, "Ran: "+cmd)
@@ -144,7 +217,14 @@ func (s *TerrariaServer) Start() error {
 
 	<-ready
 
+	// Terraria has generated the world by the time it is ready
+	s.worldmu.Lock()
+	s.worldnew = nil
+	s.worldmu.Unlock()
+
 	LogInit(s, "TerrariaServer is online")
+	go superviseTerrariaPlayers(s, s.close)
+
 	// Output commands that we'll use to populate the objects DB
 	SendCommand("seed", s)
 	SendCommand("version", s)
@@ -153,29 +233,77 @@ func (s *TerrariaServer) Start() error {
 	return nil
 }
 
-// Stop -
+// Stop - Save the world, confirm that it was written and then exit
 func (s *TerrariaServer) Stop() error {
-	LogOutput(s, "Stopping Terraria server")
-	done := make(chan error)
+	_, err := s.Shutdown(false)
+	return err
+}
+
+// Shutdown - Stop the Terraria server and report how it was brought down. When
+// nosave is false the world is saved and the save confirmed before exiting,
+// otherwise the server is told to exit without saving. If Terraria has to be
+// killed while it is writing the world, the worlds .bak file is preserved.
+func (s *TerrariaServer) Shutdown(nosave bool) (*StopReport, error) {
+	started := time.Now()
+	report := &StopReport{Method: stopMethodSave}
 
-	SendCommand("exit", s)
+	if !s.IsUp() {
+		return nil, errors.New("terraria is not running")
+	}
+
+	if nosave {
+		LogWarning(s, "Stopping Terraria server without saving", s.WSOutput())
+		report.Method = stopMethodNoSave
+	} else {
+		LogOutput(s, "Stopping Terraria server")
+		if err := s.SaveWorld(saveTimeout); err != nil {
+			LogWarning(s, "Unable to confirm world save: "+err.Error(), s.WSOutput())
+			report.Error = err.Error()
+		} else {
+			report.Saved = true
+		}
+	}
+
+	done := make(chan error)
+	SendCommand(report.Method, s)
 	go func() { done <- s.Cmd.Wait() }()
 
 	LogDebug(s, "Waiting for Terraria to exit")
-	s.players = nil
+	var err error
 	select {
-	case <-time.After(30 * time.Second):
+	case <-time.After(stopTimeout):
 		s.Cmd.Process.Kill()
-		close(s.close)
-		return errors.New("terraria took too long to exit, killed")
-	case err := <-done:
-		LogInfo(s, "Terraria server has been stopped")
-		close(s.close)
-		if err != nil {
-			return err
+		<-done
+
+		report.Method = stopMethodKilled
+		err = errors.New("terraria took too long to exit, killed")
+		if s.isSaving() {
+			LogWarning(s, "Terraria was killed while saving the world", s.WSOutput())
+			if bak, berr := s.preserveWorldBackup(); berr != nil {
+				LogError(s, "Failed to preserve world backup: "+berr.Error(), s.WSOutput())
+			} else {
+				report.Backup = bak
+			}
 		}
-		return nil
+
+	case err = <-done:
+		LogInfo(s, "Terraria server has been stopped", s.WSOutput())
+	}
+
+	close(s.close)
+	s.playermu.Lock()
+	s.players = nil
+	s.playermu.Unlock()
+	s.setSaving(false)
+
+	report.Elapsed = time.Since(started)
+	if err != nil && report.Error == "" {
+		report.Error = err.Error()
 	}
+
+	LogInfo(s, sprintf("Stopped via %s (saved: %t) in %s", report.Method,
+		report.Saved, report.Elapsed.Round(time.Millisecond)), s.WSOutput())
+	return report, err
 }
 
 // Restart -
@@ -184,6 +312,10 @@ func (s *TerrariaServer) Restart() error {
 		return err
 	}
 
+	for _, f := range s.restarthooks {
+		f()
+	}
+
 	if err := s.Start(); err != nil {
 		return err
 	}
@@ -192,8 +324,31 @@ func (s *TerrariaServer) Restart() error {
 	return nil
 }
 
+// OnStart - Register a function to be run before the server starts. If the
+// function returns an error the server is not started.
+func (s *TerrariaServer) OnStart(f func() error) {
+	s.starthooks = append(s.starthooks, f)
+}
+
+// OnRestart - Register a function to be run while the server is stopped during
+// a restart
+func (s *TerrariaServer) OnRestart(f func()) {
+	s.restarthooks = append(s.restarthooks, f)
+}
+
+// OnNewPlayer - Register a function to be run when a player is first listed
+// as connected. It is run while the output of the server is being read, so it
+// should not block.
+func (s *TerrariaServer) OnNewPlayer(f func(Player)) {
+	s.playerhooks = append(s.playerhooks, f)
+}
+
 // IsUp -
 func (s *TerrariaServer) IsUp() bool {
+	if s.Cmd == nil {
+		return false
+	}
+
 	if s.Cmd.ProcessState != nil {
 		return false
 	}
@@ -205,6 +360,138 @@ func (s *TerrariaServer) IsUp() bool {
 	return false
 }
 
+/**************/
+/* WorldSaver */
+/**************/
+
+// WorldFile - Return the path to the world file that the server uses. A world
+// that has been selected only takes its place once the server starts.
+func (s *TerrariaServer) WorldFile() string {
+	s.worldmu.Lock()
+	defer s.worldmu.Unlock()
+	return s.worldfile
+}
+
+// SetWorld - Set the world that is loaded the next time the server starts. If
+// opts is not nil, Terraria generates the world using them.
+func (s *TerrariaServer) SetWorld(path string, opts *WorldOptions) {
+	s.worldmu.Lock()
+	defer s.worldmu.Unlock()
+	s.worldnext = &worldSelection{path: path, opts: opts}
+}
+
+// SelectedWorld - Return the path to the world that is loaded the next time
+// the server starts
+func (s *TerrariaServer) SelectedWorld() string {
+	s.worldmu.Lock()
+	defer s.worldmu.Unlock()
+
+	if s.worldnext != nil {
+		return s.worldnext.path
+	}
+	return s.worldfile
+}
+
+// PendingWorld - Return the options of a world that is generated on the next
+// start, or nil if the world already exists
+func (s *TerrariaServer) PendingWorld() *WorldOptions {
+	s.worldmu.Lock()
+	defer s.worldmu.Unlock()
+
+	if s.worldnext != nil {
+		return s.worldnext.opts
+	}
+	return s.worldnew
+}
+
+// SaveWorld - Save the world and wait until Terraria confirms that it has been
+// written. The world is saved, and then the version is requested. Terraria
+// handles console commands in order, so the version response marks the end of
+// the save.
+func (s *TerrariaServer) SaveWorld(timeout time.Duration) error {
+	done := make(chan error, 1)
+
+	s.savemu.Lock()
+	if s.savedone != nil {
+		s.savemu.Unlock()
+		return errors.New("a world save is already in progress")
+	}
+	s.savedone = done
+	s.savestarted = false
+	s.savemu.Unlock()
+
+	LogInfo(s, "Saving world", s.WSOutput())
+	SendCommand("save", s)
+	SendCommand("version", s)
+
+	select {
+	case err := <-done:
+		if err == nil {
+			LogInfo(s, "World save confirmed", s.WSOutput())
+		}
+		return err
+	case <-time.After(timeout):
+		s.savemu.Lock()
+		s.savedone = nil
+		s.savemu.Unlock()
+		return errors.New("timed out waiting for the world to save")
+	}
+}
+
+// WorldSaving - Record that Terraria has reported save progress
+func (s *TerrariaServer) WorldSaving(progress string) {
+	LogDebug(s, "World save progress: "+progress)
+	s.savemu.Lock()
+	s.saving = true
+	s.savestarted = true
+	s.savemu.Unlock()
+}
+
+// ConfirmWorldSave - Called once Terraria has responded to the command that
+// follows a save. Completes a pending SaveWorld.
+func (s *TerrariaServer) ConfirmWorldSave() {
+	s.savemu.Lock()
+	defer s.savemu.Unlock()
+
+	if s.savedone == nil {
+		return
+	}
+
+	if s.savestarted {
+		s.saving = false
+		s.savedone <- nil
+	} else {
+		s.savedone <- errNoSaveOutput
+	}
+	s.savedone = nil
+}
+
+func (s *TerrariaServer) isSaving() bool {
+	s.savemu.Lock()
+	defer s.savemu.Unlock()
+	return s.saving
+}
+
+func (s *TerrariaServer) setSaving(b bool) {
+	s.savemu.Lock()
+	s.saving = b
+	s.savemu.Unlock()
+}
+
+// preserveWorldBackup copies the worlds .bak file aside so that it survives the
+// next save, and returns the path of the copy
+func (s *TerrariaServer) preserveWorldBackup() (string, error) {
+	bak := s.WorldFile() + ".bak"
+	dst := sprintf("%s.killed-%s", bak, time.Now().Format("20060102-150405"))
+
+	if err := copyFile(bak, dst); err != nil {
+		return "", err
+	}
+
+	LogWarning(s, "Preserved world backup as "+dst, s.WSOutput())
+	return dst, nil
+}
+
 /**********/
 /* Loggable */
 /**********/
@@ -228,8 +515,10 @@ func (s *TerrariaServer) SetLoglevel(l int) {
 /* Commandable */
 /***************/
 
-// EnqueueCommand -
+// EnqueueCommand - Queue a raw console command. Line breaks are replaced so
+// that a command can never turn into several.
 func (s *TerrariaServer) EnqueueCommand(c string) {
+	c = sanitizeConsole(c)
 	if s.commandcount < s.commandqueuemax-1 {
 		s.commandqueue <- c + "\n"
 		s.commandcount = s.commandcount + 1
@@ -301,6 +590,98 @@ func (s *TerrariaServer) SetMOTD(m string) {
 	s.motd = m
 }
 
+/***************/
+/* EventLogger */
+/***************/
+
+// EventLog returns the log of notable events for this server
+func (s *TerrariaServer) EventLog() *EventLog {
+	return s.eventlog
+}
+
+/******************/
+/* EventPublisher */
+/******************/
+
+// Bus returns the bus that the events of this server are published on
+func (s *TerrariaServer) Bus() *EventBus {
+	return s.bus
+}
+
+/***************/
+/* EventParser */
+/***************/
+
+// Events returns the registry that output is matched against
+func (s *TerrariaServer) Events() *EventRegistry {
+	s.eventmu.Lock()
+	defer s.eventmu.Unlock()
+	return s.events
+}
+
+// SetEvents replaces the registry that output is matched against. It takes
+// effect from the next line of output.
+func (s *TerrariaServer) SetEvents(r *EventRegistry) {
+	s.eventmu.Lock()
+	s.events = r
+	s.eventmu.Unlock()
+}
+
+/******************/
+/* NameRestricter */
+/******************/
+
+// IllegalNames returns the rules that the names of players may not match
+func (s *TerrariaServer) IllegalNames() *IllegalNames {
+	return s.illegal
+}
+
+/*************/
+/* Moderated */
+/*************/
+
+// Ledger returns the moderation ledger of the server, or nil if there is none
+func (s *TerrariaServer) Ledger() *ModerationLedger {
+	return s.ledger
+}
+
+// SetLedger sets the ledger that moderation is recorded in
+func (s *TerrariaServer) SetLedger(l *ModerationLedger) {
+	s.ledger = l
+}
+
+// RemoveBan - Remove a player from the banlist of Terraria, returning false if
+// they were not on it. Terraria checks the banlist as players connect, so this
+// takes effect without a restart.
+func (s *TerrariaServer) RemoveBan(name string) (bool, error) {
+	b, err := os.ReadFile(s.banlist)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	// Each ban is the name of the player as a comment, followed by their IP
+	lines := strings.Split(strings.ReplaceAll(string(b), "\r\n", "\n"), "\n")
+	kept := make([]string, 0, len(lines))
+	found := false
+	for i := 0; i < len(lines); i++ {
+		if lines[i] == "//"+name {
+			found = true
+			i++
+			continue
+		}
+		kept = append(kept, lines[i])
+	}
+
+	if !found {
+		return false, nil
+	}
+
+	LogInfo(s, "Removing "+name+" from the banlist")
+	return true, os.WriteFile(s.banlist, []byte(strings.Join(kept, "\r\n")), 0644)
+}
+
 /***************/
 /* Websocketer */
 /***************/
@@ -314,31 +695,46 @@ func (s *TerrariaServer) WSOutput() chan []byte {
 /* Main */
 /********/
 
-// Player - Return a player object that matches the string given
+// Player - Return a player object that matches the string given. Players are
+// returned as copies, so that they can be read while NewPlayer updates them.
 func (s *TerrariaServer) Player(n string) Player {
+	s.playermu.RLock()
+	defer s.playermu.RUnlock()
+
 	for _, p := range s.players {
 		if p.Name() == n {
-			return p
+			c := *p
+			return &c
 		}
 	}
 
 	return nil
 }
 
-// Players - Returns the players that are currently in-game
+// Players - Returns copies of the players that are currently in-game
 func (s *TerrariaServer) Players() []Player {
+	s.playermu.RLock()
+	defer s.playermu.RUnlock()
+
 	v := make([]Player, 0)
 	for _, t := range s.players {
-		v = append(v, *t)
+		c := *t
+		v = append(v, &c)
 	}
 	return v
 }
 
 // NewPlayer - Add a player to the list of players if it isn't already present
 func (s *TerrariaServer) NewPlayer(n, ips string) Player {
-	if p := s.Player(n); p != nil {
-		p.SetIP(ips)
-		return p
+	s.playermu.Lock()
+	defer s.playermu.Unlock()
+
+	for _, p := range s.players {
+		if p.Name() == n {
+			p.SetIP(ips)
+			c := *p
+			return &c
+		}
 	}
 
 	plr := &TerrariaPlayer{name: n, server: s}
@@ -346,11 +742,15 @@ func (s *TerrariaServer) NewPlayer(n, ips string) Player {
 
 	plr.ip = net.ParseIP(ips)
 	LogInfo(s, "New player logged: "+plr.Name())
-	return plr
+	c := *plr
+	return &c
 }
 
 // RemovePlayer - Removes a player from the list of players
 func (s *TerrariaServer) RemovePlayer(n string) bool {
+	s.playermu.Lock()
+	defer s.playermu.Unlock()
+
 	for i, p := range s.players {
 		if p.Name() == n {
 			LogInfo(s, "Removing "+p.Name())
@@ -361,6 +761,66 @@ func (s *TerrariaServer) RemovePlayer(n string) bool {
 	return false
 }
 
+// PlayerJoining - Note that a player has joined, so that their appearance in
+// the next player list is not reported as a discrepancy
+func (s *TerrariaServer) PlayerJoining(n string) {
+	s.joining[n] = true
+}
+
+// reconcilePlayers compares the players that Terraria listed against the
+// players that are being tracked. Missing players are added, and players that
+// are no longer connected are dropped, which covers join and leave messages
+// that were missed or misread.
+func (s *TerrariaServer) reconcilePlayers(listed []*PlayerData) {
+	seen := make(map[string]bool)
+	for _, pd := range listed {
+		seen[pd.Name] = true
+		if s.Player(pd.Name) != nil {
+			s.NewPlayer(pd.Name, pd.IP)
+			continue
+		}
+
+		plr := s.NewPlayer(pd.Name, pd.IP)
+		if s.joining[pd.Name] {
+			delete(s.joining, pd.Name)
+		} else {
+			m := sprintf("%s is connected but was not being tracked", pd.Name)
+			LogWarning(s, m, s.WSOutput())
+			s.eventlog.Add(eventKindPlayerJoin, m)
+			s.bus.Publish(&PlayerJoined{EventHeader: newEventHeader(m), Name: pd.Name})
+		}
+
+		if r := s.illegal.Match(plr.Name()); r != nil {
+			plr.Kick(r.Reason)
+			continue
+		}
+
+		for _, f := range s.playerhooks {
+			f(plr)
+		}
+	}
+
+	for _, p := range s.Players() {
+		if seen[p.Name()] {
+			continue
+		}
+
+		m := sprintf("%s is no longer connected but was still being tracked", p.Name())
+		LogWarning(s, m, s.WSOutput())
+		s.eventlog.Add(eventKindPlayerLeave, m)
+		s.RemovePlayer(p.Name())
+		s.bus.Publish(&PlayerLeft{EventHeader: newEventHeader(m), Name: p.Name()})
+	}
+
+	// Joins that never showed up are stale by now
+	for n := range s.joining {
+		if !seen[n] {
+			LogDebug(s, n+" joined but was not listed as connected")
+			delete(s.joining, n)
+		}
+	}
+}
+
 // ChatMessages - Return the total number of message that are logged
 func (s *TerrariaServer) ChatMessages() [][2]string {
 	return s.messages
@@ -374,11 +834,19 @@ func (s *TerrariaServer) NewChatMessage(msg, name string) {
 // NewTerrariaServer -
 func NewTerrariaServer(out chan []byte, path string, args ...string) *TerrariaServer {
 	t := &TerrariaServer{
-		uuid:   "TerrariaServer",
-		path:   path,
-		output: out,
+		uuid:      "TerrariaServer",
+		path:      path,
+		output:    out,
+		worldfile: "world.wld",
+		banlist:   "banlist.txt",
+		joining:   make(map[string]bool),
+		events:    NewTerrariaEventRegistry(),
+		eventlog:  NewEventLog(defaultEventLogSize),
+		illegal:   NewIllegalNames(),
 	}
 
+	t.bus = NewEventBus(t)
+
 	// t.Cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
 	t.SetLoglevel(3)
 
@@ -399,18 +867,10 @@ func superviseTerrariaOut(s *TerrariaServer, ready chan struct{},
 	LogDebug(s, "Started Terraria supervisor")
 	scanner := bufio.NewScanner(s.stdout)
 
-	cch := make(chan string, 0) // Initial Connection
-	pch := make(chan string, 0) // Player Login
-	go superviseTerrariaConnects(s, cch, pch, closech)
+	go superviseTerrariaConnects(s, closech)
 
 	for scanner.Scan() {
-		// Strip the prefix that terraria outputs on a newline. Terraria sometimes
-		// throws extras, so just loop until theyre all gone.
-		out := scanner.Text()
-		for strings.HasPrefix(out, ":") {
-			out = strings.TrimPrefix(out, ":")
-			out = strings.TrimSpace(out)
-		}
+		out, responses, grouped := s.parser.Parse(scanner.Text())
 
 		select {
 		// Exit gracefully
@@ -418,16 +878,21 @@ func superviseTerrariaOut(s *TerrariaServer, ready chan struct{},
 			LogInfo(s, "Closed output supervision routine")
 			return
 
-		// Once we're ready, start processing logs.
+		// Once we're ready, start processing logs. Output that belongs to a
+		// multi-line response is handled once the whole response is read.
 		case <-ready:
-			e := GetEventFromString(out)
-			switch e.name {
-			case "EventConnection":
-				e.Handler(s, e, out, cch)
-			case "EventPlayerInfo":
-				e.Handler(s, e, out, pch)
-			default:
-				e.Handler(s, e, out, nil)
+			s.dispatchOutput(out)
+			for _, r := range responses {
+				s.handleResponse(r)
+			}
+
+			if grouped {
+				continue
+			}
+
+			e, m := s.Events().Match(out)
+			if ev := e.Handler(s, e, out, m); ev != nil {
+				s.bus.Publish(ev)
 			}
 
 		// Output as INIT until the server is ready
@@ -445,15 +910,35 @@ func superviseTerrariaOut(s *TerrariaServer, ready chan struct{},
 	}
 }
 
-// superviseTerrariaConnects processes the connection events channeled to it by
+// superviseTerrariaPlayers periodically asks Terraria for the players that are
+// connected, so that the tracked players are reconciled against them
+func superviseTerrariaPlayers(s *TerrariaServer, closech chan struct{}) {
+	t := time.NewTicker(playerReconcileInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-closech:
+			LogInfo(s, "Closed player reconciliation routine")
+			return
+
+		case <-t.C:
+			SendCommand("playing", s)
+		}
+	}
+}
+
+// superviseTerrariaConnects processes the connection events published by
 // superviseTerrariaOut and provides warnings upon specific events (such as when
 // a single IP address connects too many times, or numerous connections are made
 // but not fulfilled)
-func superviseTerrariaConnects(s *TerrariaServer, cch chan string,
-	pch chan string, closech chan struct{}) {
+func superviseTerrariaConnects(s *TerrariaServer, closech chan struct{}) {
 	newconnections := make(map[string]time.Time)
 	stale := make(map[string]int)
-	conRe := gameEventsMap["EventPlayerInfo"]
+
+	sub := s.bus.Subscribe("connections", 0,
+		EventKinds("ConnectionAttempt", "PlayerList"))
+	defer s.bus.Unsubscribe(sub)
 
 	for {
 		select {
@@ -479,32 +964,37 @@ func superviseTerrariaConnects(s *TerrariaServer, cch chan string,
 				delete(stale, ip)
 			}
 
-		case c := <-cch:
-			LogDebug(s, "Adding channeled connection to list")
-			if _, ok := newconnections[c]; ok {
-				LogWarning(s, "Extra connection found for IP: "+c)
-				if num, ok := stale[c]; ok {
-					stale[c] = num + 1
-				} else {
-					stale[c] = 1
-				}
+		case ev := <-sub.C:
+			switch ev := ev.(type) {
+			case *ConnectionAttempt:
+				c := ev.IP
+				LogDebug(s, "Adding channeled connection to list")
+				if _, ok := newconnections[c]; ok {
+					LogWarning(s, "Extra connection found for IP: "+c)
+					if num, ok := stale[c]; ok {
+						stale[c] = num + 1
+					} else {
+						stale[c] = 1
+					}
 
-			}
-			newconnections[c] = time.Now()
-
-		case plr := <-pch:
-			LogDebug(s, "Received player info: "+plr)
-			m := conRe.Capture.FindStringSubmatch(plr)
-			ip := m[2]
-			name := m[1]
-			if _, ok := newconnections[ip]; ok {
-				delete(newconnections, ip)
-				LogDebug(s, sprintf("Removed connection for IP: %s [%s]", ip, name))
-			}
+				}
+				newconnections[c] = time.Now()
+
+			case *PlayerList:
+				for _, plr := range ev.Players {
+					LogDebug(s, sprintf("Received player info: %s (%s)", plr.Name, plr.IP))
+					ip := plr.IP
+					name := plr.Name
+					if _, ok := newconnections[ip]; ok {
+						delete(newconnections, ip)
+						LogDebug(s, sprintf("Removed connection for IP: %s [%s]", ip, name))
+					}
 
-			if _, ok := stale[ip]; ok {
-				delete(stale, ip)
-				LogDebug(s, "Cleared stale connection count for IP: "+ip)
+					if _, ok := stale[ip]; ok {
+						delete(stale, ip)
+						LogDebug(s, "Cleared stale connection count for IP: "+ip)
+					}
+				}
 			}
 
 		case <-closech:
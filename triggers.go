@@ -0,0 +1,550 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+const (
+	defaultTriggerFile    = "triggers.json"
+	triggerReloadInterval = 5 * time.Second
+	triggerWebhookTimeout = 10 * time.Second
+	triggerHistorySize    = 100
+	triggerCooldown       = 10 * time.Second
+	eventKindTrigger      = "trigger"
+	triggerActionSay      = "say"
+	triggerActionCommand  = "command"
+	triggerActionKick     = "kick"
+	triggerActionWebhook  = "webhook"
+	triggerActionLog      = "log"
+	timeOfDayLayout       = "15:04"
+)
+
+// TriggerConfig configures user defined triggers. The triggers themselves are
+// kept in their own file so that they can be edited and reloaded while running.
+// In dry run mode triggers are matched and reported, but their actions are not
+// run.
+type TriggerConfig struct {
+	File   string `json:"file"`
+	DryRun bool   `json:"dryrun"`
+}
+
+// TriggerDefinition is a trigger as it is written in the triggers file. It
+// fires on output matching Match, or on events of the kind named by Event
+// (ex: PlayerJoined), or on output matching Match from that kind of event when
+// both are given. A trigger fires at most once per Cooldown, which defaults to
+// 10 seconds.
+type TriggerDefinition struct {
+	Name       string          `json:"name"`
+	Match      string          `json:"match,omitempty"`
+	Event      string          `json:"event,omitempty"`
+	MinPlayers int             `json:"min_players,omitempty"`
+	MaxPlayers int             `json:"max_players,omitempty"`
+	After      string          `json:"after,omitempty"`  // Time of day, ex: 22:00
+	Before     string          `json:"before,omitempty"` // Time of day, ex: 06:00
+	Cooldown   Duration        `json:"cooldown,omitempty"`
+	DryRun     bool            `json:"dryrun,omitempty"`
+	Actions    []TriggerAction `json:"actions"`
+}
+
+// TriggerAction is something that a trigger does when it fires. Text is a
+// template that is given a TriggerContext.
+type TriggerAction struct {
+	Type string `json:"type"`
+	Text string `json:"text,omitempty"`
+	URL  string `json:"url,omitempty"`
+}
+
+// TriggerContext is the data that action templates are executed with. Groups
+// holds the submatches of Match, and Named its named submatches. Player is the
+// player that the event was about, or the "player" submatch if there is one.
+type TriggerContext struct {
+	Trigger string
+	Line    string
+	Kind    string
+	Player  string
+	Players int
+	Groups  []string
+	Named   map[string]string
+	Time    time.Time
+}
+
+// TriggerFiring is a record of a trigger that fired, or would have fired in
+// dry run mode, along with what its actions did
+type TriggerFiring struct {
+	Time    time.Time
+	Trigger string
+	Line    string
+	DryRun  bool
+	Actions []string
+	Errors  []string `json:",omitempty"`
+}
+
+// trigger is a compiled TriggerDefinition
+type trigger struct {
+	def       TriggerDefinition
+	match     *regexp.Regexp
+	after     time.Time
+	before    time.Time
+	templates []*template.Template
+}
+
+// TriggerEngine runs user defined triggers against the events of a
+// GameServer. The triggers file is reloaded whenever it changes.
+type TriggerEngine struct {
+	gs     GameServer
+	config TriggerConfig
+	http   *http.Client
+
+	mu       sync.Mutex
+	triggers []*trigger
+	fired    map[string]time.Time
+	history  []*TriggerFiring
+	modified time.Time
+	close    chan struct{}
+}
+
+// NewTriggerEngine returns a TriggerEngine and loads its triggers. A missing
+// triggers file is not an error.
+func NewTriggerEngine(gs GameServer, c TriggerConfig) (*TriggerEngine, error) {
+	if c.File == "" {
+		c.File = defaultTriggerFile
+	}
+
+	t := &TriggerEngine{
+		gs:       gs,
+		config:   c,
+		http:     &http.Client{Timeout: triggerWebhookTimeout},
+		triggers: make([]*trigger, 0),
+		fired:    make(map[string]time.Time),
+		history:  make([]*TriggerFiring, 0),
+		close:    make(chan struct{}),
+	}
+
+	if err := t.Reload(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Start subscribes to the events of the GameServer and watches the triggers
+// file for changes until Stop is called
+func (t *TriggerEngine) Start() {
+	sub := t.gs.Bus().Handle("triggers", nil, t.handle)
+	defer t.gs.Bus().Unsubscribe(sub)
+
+	tick := time.NewTicker(triggerReloadInterval)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-t.close:
+			return
+		case <-tick.C:
+			fi, err := os.Stat(t.config.File)
+			if err != nil {
+				continue
+			}
+
+			t.mu.Lock()
+			changed := !fi.ModTime().Equal(t.modified)
+			t.mu.Unlock()
+
+			if changed {
+				if err := t.Reload(); err != nil {
+					LogError(t.gs, "Unable to reload triggers, keeping the previous ones: "+err.Error(),
+						t.gs.WSOutput())
+				}
+			}
+		}
+	}
+}
+
+// Stop ends the trigger engine
+func (t *TriggerEngine) Stop() {
+	close(t.close)
+}
+
+// Reload reads and compiles the triggers file. If any trigger is invalid the
+// current triggers are kept.
+func (t *TriggerEngine) Reload() error {
+	var modified time.Time
+	if fi, err := os.Stat(t.config.File); err == nil {
+		modified = fi.ModTime()
+	}
+
+	defs := make([]TriggerDefinition, 0)
+	if err := loadJSON(t.config.File, &defs); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	triggers := make([]*trigger, 0, len(defs))
+	names := make(map[string]bool)
+	for _, d := range defs {
+		if names[d.Name] {
+			return errors.New(sprintf("trigger %q is defined more than once", d.Name))
+		}
+		names[d.Name] = true
+
+		tr, err := compileTrigger(d)
+		if err != nil {
+			return errors.New(sprintf("trigger %q: %s", d.Name, err.Error()))
+		}
+		triggers = append(triggers, tr)
+	}
+
+	t.mu.Lock()
+	t.triggers = triggers
+	t.modified = modified
+	t.mu.Unlock()
+
+	LogInfo(t.gs, sprintf("Loaded %d triggers from %s", len(triggers), t.config.File))
+	return nil
+}
+
+// Triggers returns the definitions of the loaded triggers
+func (t *TriggerEngine) Triggers() []TriggerDefinition {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	defs := make([]TriggerDefinition, 0, len(t.triggers))
+	for _, tr := range t.triggers {
+		defs = append(defs, tr.def)
+	}
+	return defs
+}
+
+// History returns the most recent trigger firings, oldest first
+func (t *TriggerEngine) History() []*TriggerFiring {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]*TriggerFiring{}, t.history...)
+}
+
+// Test reports which triggers would fire for a line of console output,
+// without running any actions or starting any cooldowns
+func (t *TriggerEngine) Test(line string) []*TriggerFiring {
+	e, m := t.gs.Events().Match(line)
+	ev := e.Handler(dryRunServer{t.gs}, e, line, m)
+	if ev == nil {
+		ev = &ConsoleOutput{EventHeader: newEventHeader(line)}
+	}
+
+	t.mu.Lock()
+	triggers := append([]*trigger{}, t.triggers...)
+	t.mu.Unlock()
+
+	res := make([]*TriggerFiring, 0)
+	for _, tr := range triggers {
+		if ctx := t.matches(tr, ev); ctx != nil {
+			res = append(res, t.run(tr, ctx, true))
+		}
+	}
+	return res
+}
+
+// handle checks an event against every trigger
+func (t *TriggerEngine) handle(ev Event) {
+	t.mu.Lock()
+	triggers := append([]*trigger{}, t.triggers...)
+	t.mu.Unlock()
+
+	for _, tr := range triggers {
+		ctx := t.matches(tr, ev)
+		if ctx == nil || !t.cooled(tr) {
+			continue
+		}
+
+		f := t.run(tr, ctx, t.config.DryRun || tr.def.DryRun)
+		t.record(f)
+	}
+}
+
+// matches checks the event and conditions of a trigger, and returns the
+// context for its actions if they are all met
+func (t *TriggerEngine) matches(tr *trigger, ev Event) *TriggerContext {
+	if tr.def.Event != "" && tr.def.Event != ev.Kind() {
+		return nil
+	}
+
+	ctx := &TriggerContext{
+		Trigger: tr.def.Name,
+		Line:    ev.Raw(),
+		Kind:    ev.Kind(),
+		Players: len(t.gs.Players()),
+		Groups:  []string{ev.Raw()},
+		Named:   make(map[string]string),
+		Time:    ev.When(),
+	}
+
+	switch ev := ev.(type) {
+	case *PlayerJoined:
+		ctx.Player = ev.Name
+	case *PlayerLeft:
+		ctx.Player = ev.Name
+	case *Chat:
+		// Never match chat sent from the console, which includes the
+		// messages of say actions
+		if ev.Name == chatServerName {
+			return nil
+		}
+		ctx.Player = ev.Name
+	}
+
+	if tr.match != nil {
+		m := tr.match.FindStringSubmatch(ev.Raw())
+		if m == nil {
+			return nil
+		}
+
+		ctx.Groups = m
+		for i, n := range tr.match.SubexpNames() {
+			if n != "" {
+				ctx.Named[n] = m[i]
+			}
+		}
+		if p, ok := ctx.Named["player"]; ok {
+			ctx.Player = p
+		}
+	}
+
+	if tr.def.MinPlayers > 0 && ctx.Players < tr.def.MinPlayers {
+		return nil
+	}
+	if tr.def.MaxPlayers > 0 && ctx.Players > tr.def.MaxPlayers {
+		return nil
+	}
+	if !tr.inWindow(ctx.Time) {
+		return nil
+	}
+	return ctx
+}
+
+// cooled returns true and starts the cooldown of a trigger if it is not
+// currently cooling down
+func (t *TriggerEngine) cooled(tr *trigger) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if last, ok := t.fired[tr.def.Name]; ok && time.Since(last) < tr.def.Cooldown.Duration {
+		return false
+	}
+	t.fired[tr.def.Name] = time.Now()
+	return true
+}
+
+// run performs the actions of a trigger. In a dry run the actions are only
+// described.
+func (t *TriggerEngine) run(tr *trigger, ctx *TriggerContext, dryrun bool) *TriggerFiring {
+	f := &TriggerFiring{
+		Time:    time.Now(),
+		Trigger: tr.def.Name,
+		Line:    ctx.Line,
+		DryRun:  dryrun,
+		Actions: make([]string, 0),
+	}
+
+	for i, a := range tr.def.Actions {
+		var b bytes.Buffer
+		if err := tr.templates[i].Execute(&b, ctx); err != nil {
+			f.Errors = append(f.Errors, sprintf("%s: %s", a.Type, err.Error()))
+			continue
+		}
+		text := b.String()
+
+		desc := sprintf("%s: %s", a.Type, text)
+		switch a.Type {
+		case triggerActionKick:
+			desc = sprintf("kick %s: %s", ctx.Player, text)
+		case triggerActionWebhook:
+			desc = sprintf("webhook %s: %s", a.URL, text)
+		}
+		f.Actions = append(f.Actions, desc)
+
+		if dryrun {
+			continue
+		}
+
+		if err := t.action(a, text, ctx); err != nil {
+			f.Errors = append(f.Errors, sprintf("%s: %s", a.Type, err.Error()))
+		}
+	}
+
+	return f
+}
+
+// action runs a single action with its rendered text
+func (t *TriggerEngine) action(a TriggerAction, text string, ctx *TriggerContext) error {
+	c := t.gs.Console()
+	switch a.Type {
+	case triggerActionSay:
+		return c.Say(text)
+
+	case triggerActionCommand:
+		if sanitizeConsole(text) == "" {
+			return errEmptyArgument
+		}
+		t.gs.EnqueueCommand(text)
+		return nil
+
+	case triggerActionKick:
+		if ctx.Player == "" {
+			return errors.New("there is no player to kick")
+		}
+		if text != "" {
+			c.Say(text)
+		}
+		return moderatePlayer(t.gs, moderationKick, ctx.Player, "trigger "+ctx.Trigger, text, time.Time{})
+
+	case triggerActionWebhook:
+		body, err := json.Marshal(struct {
+			Trigger string
+			Message string
+			Line    string
+			Player  string
+			Time    time.Time
+		}{ctx.Trigger, text, ctx.Line, ctx.Player, ctx.Time})
+		if err != nil {
+			return err
+		}
+
+		res, err := t.http.Post(a.URL, "application/json", bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		res.Body.Close()
+		if res.StatusCode >= 300 {
+			return errors.New(sprintf("webhook returned %s", res.Status))
+		}
+		return nil
+
+	case triggerActionLog:
+		LogInfo(t.gs, text, t.gs.WSOutput())
+		t.gs.EventLog().Add(eventKindTrigger, text)
+		return nil
+	}
+
+	return errors.New("unknown action " + a.Type)
+}
+
+// record logs a firing and adds it to the history
+func (t *TriggerEngine) record(f *TriggerFiring) {
+	prefix := "Trigger"
+	if f.DryRun {
+		prefix = "Trigger (dry run)"
+	}
+
+	LogInfo(t.gs, sprintf("%s %s fired: %s", prefix, f.Trigger, strings.Join(f.Actions, "; ")))
+	for _, e := range f.Errors {
+		LogWarning(t.gs, sprintf("Trigger %s: %s", f.Trigger, e), t.gs.WSOutput())
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.history = append(t.history, f)
+	if len(t.history) > triggerHistorySize {
+		t.history = t.history[len(t.history)-triggerHistorySize:]
+	}
+}
+
+// compileTrigger checks a TriggerDefinition and compiles its expression and
+// templates
+func compileTrigger(d TriggerDefinition) (*trigger, error) {
+	if d.Cooldown.Duration <= 0 {
+		d.Cooldown.Duration = triggerCooldown
+	}
+
+	tr := &trigger{def: d, templates: make([]*template.Template, 0, len(d.Actions))}
+
+	switch {
+	case d.Name == "":
+		return nil, errors.New("triggers need a name")
+	case d.Match == "" && d.Event == "":
+		return nil, errors.New("a match or an event is required")
+	case len(d.Actions) == 0:
+		return nil, errors.New("at least one action is required")
+	case (d.After == "") != (d.Before == ""):
+		return nil, errors.New("after and before must be given together")
+	}
+
+	var err error
+	if d.Match != "" {
+		if tr.match, err = regexp.Compile(d.Match); err != nil {
+			return nil, err
+		}
+	}
+
+	if d.After != "" {
+		if tr.after, err = time.Parse(timeOfDayLayout, d.After); err != nil {
+			return nil, err
+		}
+		if tr.before, err = time.Parse(timeOfDayLayout, d.Before); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, a := range d.Actions {
+		switch a.Type {
+		case triggerActionSay, triggerActionCommand, triggerActionKick, triggerActionLog:
+		case triggerActionWebhook:
+			if !strings.HasPrefix(a.URL, "http://") && !strings.HasPrefix(a.URL, "https://") {
+				return nil, errors.New("webhooks need an http or https url")
+			}
+		default:
+			return nil, errors.New("unknown action " + a.Type)
+		}
+
+		tmpl, err := template.New(a.Type).Option("missingkey=zero").Parse(a.Text)
+		if err != nil {
+			return nil, err
+		}
+		tr.templates = append(tr.templates, tmpl)
+	}
+
+	return tr, nil
+}
+
+// inWindow returns true if the time of day is within the window of the
+// trigger. Windows may wrap past midnight, ex: 22:00 to 06:00.
+func (tr *trigger) inWindow(now time.Time) bool {
+	if tr.def.After == "" {
+		return true
+	}
+
+	min := now.Hour()*60 + now.Minute()
+	after := tr.after.Hour()*60 + tr.after.Minute()
+	before := tr.before.Hour()*60 + tr.before.Minute()
+
+	if after <= before {
+		return min >= after && min < before
+	}
+	return min >= after || min < before
+}
+
+// dryRunServer wraps a GameServer so that event handlers can be run against a
+// test line without changing the state of the server
+type dryRunServer struct {
+	GameServer
+}
+
+func (dryRunServer) WSOutput() chan []byte           { return nil }
+func (dryRunServer) EnqueueCommand(string)           {}
+func (dryRunServer) SetSeed(string)                  {}
+func (dryRunServer) SetMOTD(string)                  {}
+func (dryRunServer) SetPassword(string)              {}
+func (dryRunServer) SetVersion(string)               {}
+func (dryRunServer) ConfirmWorldSave()               {}
+func (dryRunServer) WorldSaving(string)              {}
+func (dryRunServer) PlayerJoining(string)            {}
+func (dryRunServer) RemovePlayer(string) bool        { return false }
+func (dryRunServer) NewPlayer(string, string) Player { return nil }
+func (dryRunServer) EventLog() *EventLog             { return NewEventLog(1) }
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultVoteQuorum   = 50
+	defaultVoteDuration = time.Minute
+	defaultVoteCooldown = 5 * time.Minute
+	minVoteKickVotes    = 2
+	eventKindVote       = "vote"
+
+	voteKick   = "kick"
+	voteDay    = "day"
+	voteSettle = "settle"
+)
+
+// VoteConfig configures player votes. Quorum is the percentage of the players
+// online that have to vote yes for a vote to pass, and kicks always need at
+// least two yes votes. Cooldown is how long after a vote ends before another
+// vote of the same kind can be started.
+type VoteConfig struct {
+	Quorum   float64  `json:"quorum"`
+	Duration Duration `json:"duration"`
+	Cooldown Duration `json:"cooldown"`
+}
+
+// Vote is a vote that is in progress
+type Vote struct {
+	Kind    string
+	Target  string
+	Starter string
+	Started time.Time
+	Votes   map[string]bool
+
+	timer *time.Timer
+}
+
+// describe returns what the vote is for, for announcements
+func (v *Vote) describe() string {
+	switch v.Kind {
+	case voteKick:
+		return "kick " + v.Target
+	case voteDay:
+		return "skip to day"
+	case voteSettle:
+		return "settle liquids"
+	}
+	return v.Kind
+}
+
+// tally returns the number of yes and no votes. Votes of players that are no
+// longer online should be dropped first.
+func (v *Vote) tally() (int, int) {
+	yes, no := 0, 0
+	for _, y := range v.Votes {
+		if y {
+			yes++
+		} else {
+			no++
+		}
+	}
+	return yes, no
+}
+
+// VoteManager runs votes that players start from chat. One vote runs at a
+// time, and votes that pass run through the typed console of the GameServer.
+type VoteManager struct {
+	gs     GameServer
+	chat   *ChatCommands
+	config VoteConfig
+
+	mu      sync.Mutex
+	current *Vote
+	ended   map[string]time.Time
+}
+
+// NewVoteManager returns a VoteManager and registers its chat commands
+func NewVoteManager(gs GameServer, cc *ChatCommands, c VoteConfig) (*VoteManager, error) {
+	if c.Quorum <= 0 || c.Quorum > 100 {
+		c.Quorum = defaultVoteQuorum
+	}
+	if c.Duration.Duration <= 0 {
+		c.Duration.Duration = defaultVoteDuration
+	}
+	if c.Cooldown.Duration <= 0 {
+		c.Cooldown.Duration = defaultVoteCooldown
+	}
+
+	vm := &VoteManager{gs: gs, chat: cc, config: c, ended: make(map[string]time.Time)}
+
+	commands := []*ChatCommand{
+		{
+			Name:  "votekick",
+			Usage: "<name>",
+			Help:  "Start a vote to kick a player",
+			Run: func(c *ChatContext) error {
+				if len(c.Args) == 0 {
+					return errChatUsage
+				}
+				return vm.Start(voteKick, strings.Join(c.Args, " "), c.Player)
+			},
+		},
+		{
+			Name: "voteday",
+			Help: "Start a vote to skip to day",
+			Run: func(c *ChatContext) error {
+				return vm.Start(voteDay, "", c.Player)
+			},
+		},
+		{
+			Name: "votesettle",
+			Help: "Start a vote to settle liquids",
+			Run: func(c *ChatContext) error {
+				return vm.Start(voteSettle, "", c.Player)
+			},
+		},
+		{
+			Name:    "yes",
+			Aliases: []string{"y"},
+			Help:    "Vote yes",
+			Run: func(c *ChatContext) error {
+				return vm.Cast(c.Player, true)
+			},
+		},
+		{
+			Name:    "no",
+			Aliases: []string{"n"},
+			Help:    "Vote no",
+			Run: func(c *ChatContext) error {
+				return vm.Cast(c.Player, false)
+			},
+		},
+	}
+
+	for _, cmd := range commands {
+		if err := cc.Register(cmd); err != nil {
+			return nil, err
+		}
+	}
+	return vm, nil
+}
+
+// Current returns a copy of the vote in progress, or nil
+func (vm *VoteManager) Current() *Vote {
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+
+	if vm.current == nil {
+		return nil
+	}
+
+	v := *vm.current
+	v.Votes = make(map[string]bool)
+	for k, y := range vm.current.Votes {
+		v.Votes[k] = y
+	}
+	return &v
+}
+
+// Start begins a vote, with the starter voting yes
+func (vm *VoteManager) Start(kind, target, starter string) error {
+	if kind == voteKick {
+		if vm.gs.Player(target) == nil {
+			return errors.New(target + " is not online")
+		}
+		if vm.chat.Level(target) >= PermissionModerator {
+			return errors.New(target + " can not be vote kicked")
+		}
+	}
+
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+
+	if vm.current != nil {
+		return errors.New("a vote to " + vm.current.describe() + " is already running")
+	}
+
+	if last, ok := vm.ended[kind]; ok {
+		if left := vm.config.Cooldown.Duration - time.Since(last); left > 0 {
+			return errors.New(sprintf("another vote like that can be started in %s",
+				left.Round(time.Second)))
+		}
+	}
+
+	v := &Vote{
+		Kind:    kind,
+		Target:  target,
+		Starter: starter,
+		Started: time.Now(),
+		Votes:   map[string]bool{starter: true},
+	}
+	v.timer = time.AfterFunc(vm.config.Duration.Duration, func() { vm.expire(v) })
+	vm.current = v
+
+	LogInfo(vm.gs, sprintf("%s started a vote to %s", starter, v.describe()), vm.gs.WSOutput())
+	vm.say(sprintf("%s started a vote to %s. Type %syes or %sno within %s.",
+		starter, v.describe(), vm.chat.Prefix(), vm.chat.Prefix(),
+		vm.config.Duration.Duration.Round(time.Second)))
+	vm.progress(v)
+	return nil
+}
+
+// Watch re-checks the current vote whenever a player leaves, until the
+// subscription ends
+func (vm *VoteManager) Watch() *Subscription {
+	return vm.gs.Bus().Handle("votes", EventKinds("PlayerLeft"), func(ev Event) {
+		vm.left(ev.(*PlayerLeft).Name)
+	})
+}
+
+// Cast records the vote of a player in the current vote
+func (vm *VoteManager) Cast(player string, yes bool) error {
+	if vm.gs.Player(player) == nil {
+		return errors.New("only players that are online can vote")
+	}
+
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+
+	v := vm.current
+	if v == nil {
+		return errors.New("there is no vote running")
+	}
+	if v.Kind == voteKick && player == v.Target {
+		return errors.New("you can not vote on your own kick")
+	}
+
+	v.Votes[player] = yes
+	vm.progress(v)
+	return nil
+}
+
+// left ends a vote to kick a player that has left, and otherwise updates the
+// current vote if the player had voted in it
+func (vm *VoteManager) left(player string) {
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+
+	v := vm.current
+	switch {
+	case v == nil:
+	case v.Kind == voteKick && player == v.Target:
+		vm.say(sprintf("%s left, so the vote to kick them has ended", player))
+		vm.finish(v, false)
+	default:
+		if _, voted := v.Votes[player]; voted {
+			vm.progress(v)
+		}
+	}
+}
+
+// progress announces the tally of a vote, and ends it if it has passed or can
+// no longer pass. Expects vm.mu to be held.
+func (vm *VoteManager) progress(v *Vote) {
+	vm.dropAbsent(v)
+	yes, no := v.tally()
+	needed := vm.needed(v)
+
+	switch {
+	case yes >= needed:
+		vm.finish(v, true)
+	case vm.voters(v)-no < needed:
+		vm.finish(v, false)
+	default:
+		vm.say(sprintf("Vote to %s: %d of %d needed (%d against)", v.describe(), yes, needed, no))
+	}
+}
+
+// dropAbsent removes the votes of players that are no longer online, since
+// the votes needed only count the players that are. Expects vm.mu to be held.
+func (vm *VoteManager) dropAbsent(v *Vote) {
+	for name := range v.Votes {
+		if vm.gs.Player(name) == nil {
+			delete(v.Votes, name)
+		}
+	}
+}
+
+// voters returns the number of players that can vote in a vote. Players can
+// not vote on their own kick.
+func (vm *VoteManager) voters(v *Vote) int {
+	n := len(vm.gs.Players())
+	if v.Kind == voteKick && vm.gs.Player(v.Target) != nil {
+		n--
+	}
+	return n
+}
+
+// needed returns the number of yes votes that a vote needs to pass. The
+// quorum is taken of every player online, including the target of a kick, so
+// that the starter can not kick someone alone on a small server.
+func (vm *VoteManager) needed(v *Vote) int {
+	n := int(math.Ceil(float64(len(vm.gs.Players())) * vm.config.Quorum / 100))
+	if n < 1 {
+		n = 1
+	}
+	if v.Kind == voteKick && n < minVoteKickVotes {
+		n = minVoteKickVotes
+	}
+	return n
+}
+
+// expire ends a vote that ran out of time
+func (vm *VoteManager) expire(v *Vote) {
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+
+	if vm.current != v {
+		return
+	}
+
+	vm.dropAbsent(v)
+	yes, _ := v.tally()
+	vm.say(sprintf("The vote to %s ran out of time with %d of %d votes",
+		v.describe(), yes, vm.needed(v)))
+	vm.finish(v, false)
+}
+
+// finish ends a vote, running its action if it passed. Expects vm.mu to be
+// held.
+func (vm *VoteManager) finish(v *Vote, passed bool) {
+	v.timer.Stop()
+	vm.current = nil
+	vm.ended[v.Kind] = time.Now()
+
+	yes, no := v.tally()
+	result := "failed"
+	if passed {
+		result = "passed"
+	}
+
+	msg := sprintf("Vote to %s started by %s %s (%d for, %d against)",
+		v.describe(), v.Starter, result, yes, no)
+	LogInfo(vm.gs, msg, vm.gs.WSOutput())
+	vm.gs.EventLog().Add(eventKindVote, msg)
+
+	if !passed {
+		vm.say(sprintf("The vote to %s failed", v.describe()))
+		return
+	}
+
+	vm.say(sprintf("The vote to %s passed!", v.describe()))
+
+	var err error
+	c := vm.gs.Console()
+	switch v.Kind {
+	case voteKick:
+		err = moderatePlayer(vm.gs, moderationKick, v.Target, "vote",
+			sprintf("vote started by %s passed", v.Starter), time.Time{})
+	case voteDay:
+		err = c.Dawn()
+	case voteSettle:
+		err = c.Settle()
+	}
+
+	if err != nil {
+		LogError(vm.gs, sprintf("Unable to %s after a vote: %s", v.describe(), err.Error()))
+	}
+}
+
+func (vm *VoteManager) say(msg string) {
+	if err := vm.gs.Console().Say(msg); err != nil {
+		LogWarning(vm.gs, "Unable to announce vote: "+err.Error())
+	}
+}
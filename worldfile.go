@@ -0,0 +1,565 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"os"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	worldMagic         = "relogic"
+	worldFileType      = 2
+	worldMinVersion    = 140
+	worldMaxNameLength = 1 << 12
+	worldTicksEpoch    = 621355968000000000 // .NET ticks at the unix epoch
+)
+
+var (
+	worldGameModes = []string{"Classic", "Expert", "Master", "Journey"}
+	worldInvasions = []string{"None", "Goblin Army", "Frost Legion", "Pirates", "Martian Madness"}
+	worldSizes     = map[int32]string{4200: "Small", 6400: "Medium", 8400: "Large"}
+
+	errWorldFormat = errors.New("not a terraria world file")
+
+	worldInfoMu    sync.Mutex
+	worldInfoCache = make(map[string]*WorldInfo)
+)
+
+// WorldInfo is the metadata stored in the header of a Terraria world file
+type WorldInfo struct {
+	Path     string
+	Modified time.Time
+
+	Version  int32
+	Revision uint32
+	Name     string
+	Seed     string
+	GUID     string
+	ID       int32
+	Created  time.Time
+
+	Width      int32
+	Height     int32
+	Size       string
+	GameMode   int32
+	Difficulty string
+	Evil       string
+	Secrets    []string
+
+	SpawnX       int32
+	SpawnY       int32
+	DungeonX     int32
+	DungeonY     int32
+	WorldSurface float64
+	RockLayer    float64
+
+	Hardmode bool
+	Invasion string
+	Downed   map[string]bool
+
+	// Used to locate and decode the remaining sections of the file
+	sections  []int32
+	important []bool
+}
+
+// ReadWorldInfo returns the header of the world file at path. Results are
+// cached until the file is modified.
+func ReadWorldInfo(path string) (*WorldInfo, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	worldInfoMu.Lock()
+	if wi, ok := worldInfoCache[path]; ok && wi.Modified.Equal(fi.ModTime()) {
+		worldInfoMu.Unlock()
+		return wi, nil
+	}
+	worldInfoMu.Unlock()
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	wi, err := ParseWorldHeader(f)
+	if err != nil {
+		return nil, err
+	}
+	wi.Path = path
+	wi.Modified = fi.ModTime()
+
+	worldInfoMu.Lock()
+	worldInfoCache[path] = wi
+	worldInfoMu.Unlock()
+	return wi, nil
+}
+
+// ParseWorldHeader reads the file metadata, section table and header section
+// of a Terraria world
+func ParseWorldHeader(rs io.ReadSeeker) (*WorldInfo, error) {
+	r := &worldReader{r: bufio.NewReader(rs)}
+	wi := &WorldInfo{Downed: make(map[string]bool)}
+
+	wi.Version = r.int32()
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	if wi.Version < worldMinVersion {
+		return nil, errors.New(sprintf("unsupported world version %d", wi.Version))
+	}
+
+	magic := r.uint64()
+	if string(binaryBytes(magic)[:7]) != worldMagic || magic>>56 != worldFileType {
+		return nil, errWorldFormat
+	}
+	wi.Revision = r.uint32()
+	r.uint64() // Favorite flags
+
+	n := r.int16()
+	if n < 2 || n > 64 {
+		return nil, errWorldFormat
+	}
+
+	wi.sections = make([]int32, n)
+	for i := range wi.sections {
+		wi.sections[i] = r.int32()
+	}
+
+	wi.important = r.bits(int(r.int16()))
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	if _, err := rs.Seek(int64(wi.sections[0]), io.SeekStart); err != nil {
+		return nil, err
+	}
+	r.r.Reset(rs)
+
+	wi.Name = r.string()
+	if wi.Version >= 179 {
+		if wi.Version == 179 {
+			wi.Seed = sprintf("%d", r.int32())
+		} else {
+			wi.Seed = r.string()
+		}
+		r.uint64() // World generator version
+	}
+
+	if wi.Version >= 181 {
+		g := r.bytes(16)
+		if len(g) == 16 {
+			wi.GUID = formatGUID(g)
+		}
+	}
+
+	wi.ID = r.int32()
+	r.int32s(4) // Left, right, top and bottom of the world in pixels
+	wi.Height = r.int32()
+	wi.Width = r.int32()
+
+	if wi.Version >= 209 {
+		wi.GameMode = r.int32()
+		secrets := []struct {
+			version int32
+			name    string
+		}{
+			{222, "Drunk World"},
+			{227, "For the Worthy"},
+			{238, "Celebrationmk10"},
+			{239, "The Constant"},
+			{241, "Not the Bees"},
+			{249, "Don't Dig Up"},
+			{266, "No Traps"},
+			{267, "Get Fixed Boi"},
+		}
+		for _, s := range secrets {
+			if wi.Version >= s.version && r.bool() {
+				wi.Secrets = append(wi.Secrets, s.name)
+			}
+		}
+	} else {
+		if r.bool() {
+			wi.GameMode = 1
+		}
+		if wi.Version >= 208 && r.bool() {
+			wi.GameMode = 2
+		}
+	}
+
+	if wi.Version >= 141 {
+		wi.Created = dotnetTime(r.int64())
+	}
+
+	r.bytes(1)   // Moon type
+	r.int32s(14) // Tree and cave backgrounds
+	r.int32s(3)  // Ice, jungle and hell backgrounds
+
+	wi.SpawnX = r.int32()
+	wi.SpawnY = r.int32()
+	wi.WorldSurface = r.float64()
+	wi.RockLayer = r.float64()
+
+	r.float64() // Time
+	r.bool()    // Day time
+	r.int32()   // Moon phase
+	r.bool()    // Blood moon
+	r.bool()    // Eclipse
+
+	wi.DungeonX = r.int32()
+	wi.DungeonY = r.int32()
+
+	wi.Evil = "Corruption"
+	if r.bool() {
+		wi.Evil = "Crimson"
+	}
+
+	for _, b := range []string{"Eye of Cthulhu", "Eater of Worlds / Brain of Cthulhu",
+		"Skeletron", "Queen Bee", "The Destroyer", "The Twins", "Skeletron Prime",
+		"Any Mechanical Boss", "Plantera", "Golem"} {
+		wi.Downed[b] = r.bool()
+	}
+
+	if wi.Version >= 118 {
+		wi.Downed["King Slime"] = r.bool()
+	}
+
+	r.bool() // Goblin tinkerer saved
+	r.bool() // Wizard saved
+	r.bool() // Mechanic saved
+	wi.Downed["Goblin Army"] = r.bool()
+	wi.Downed["Clown"] = r.bool()
+	wi.Downed["Frost Legion"] = r.bool()
+	wi.Downed["Pirates"] = r.bool()
+
+	r.bool()   // Shadow orb smashed
+	r.bool()   // Spawn meteor
+	r.bytes(1) // Shadow orb count
+	r.int32()  // Altar count
+	wi.Hardmode = r.bool()
+
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	wi.Size = worldSizes[wi.Width]
+	if wi.Size == "" {
+		wi.Size = "Custom"
+	}
+
+	wi.Difficulty = "Unknown"
+	if wi.GameMode >= 0 && int(wi.GameMode) < len(worldGameModes) {
+		wi.Difficulty = worldGameModes[wi.GameMode]
+	}
+
+	parseWorldProgress(r, wi)
+	return wi, nil
+}
+
+// parseWorldProgress reads the invasion state and the flags for the bosses
+// that are stored further into the header. These follow a number of fields
+// whose layout has changed between releases, so the values are only kept when
+// they look sane.
+func parseWorldProgress(r *worldReader, wi *WorldInfo) {
+	if wi.Version >= 257 {
+		r.bool() // After party of doom
+	}
+
+	r.int32() // Invasion delay
+	r.int32() // Invasion size
+	invasion := r.int32()
+	r.float64() // Invasion X
+
+	if r.err != nil || invasion < 0 || int(invasion) >= len(worldInvasions) {
+		return
+	}
+	wi.Invasion = worldInvasions[invasion]
+
+	if wi.Version >= 118 {
+		r.float64() // Slime rain time
+	}
+	if wi.Version >= 113 {
+		r.bytes(1) // Sundial cooldown
+	}
+
+	r.bool()    // Raining
+	r.int32()   // Rain time
+	r.float32() // Max rain
+	r.int32s(3) // Hardmode ore tiers
+	r.bytes(8)  // Backgrounds
+	r.int32()   // Cloud background
+	r.int16()   // Number of clouds
+	r.float32() // Wind speed
+
+	anglers := r.int32()
+	if anglers < 0 || anglers > 255 {
+		return
+	}
+	for i := int32(0); i < anglers; i++ {
+		r.string()
+	}
+
+	r.bool()  // Angler saved
+	r.int32() // Angler quest
+	r.bool()  // Stylist saved
+	if wi.Version >= 129 {
+		r.bool() // Tax collector saved
+	}
+	if wi.Version >= 201 {
+		r.bool() // Golfer saved
+	}
+	r.int32() // Invasion size start
+	r.int32() // Cultist delay
+
+	kills := r.int16()
+	if kills < 0 || kills > 4096 {
+		return
+	}
+	r.int32s(int(kills))
+
+	r.bool() // Fast forward time
+	if r.err != nil {
+		return
+	}
+
+	flags := []string{"Duke Fishron", "Martian Madness", "Lunatic Cultist", "Moon Lord",
+		"Pumpking", "Mourning Wood", "Ice Queen", "Santa-NK1", "Everscream"}
+	if wi.Version >= 140 {
+		flags = append(flags, "Solar Pillar", "Vortex Pillar", "Nebula Pillar", "Stardust Pillar")
+	}
+
+	downed := make(map[string]bool)
+	for _, f := range flags {
+		downed[f] = r.bool()
+	}
+
+	if r.err == nil {
+		for k, v := range downed {
+			wi.Downed[k] = v
+		}
+	}
+}
+
+// worldReader reads the little endian values used by .NET's BinaryReader. The
+// first error is kept, and every read after it returns a zero value.
+type worldReader struct {
+	r   *bufio.Reader
+	err error
+}
+
+func (r *worldReader) bytes(n int) []byte {
+	if r.err != nil || n < 0 {
+		return nil
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r.r, b); err != nil {
+		r.err = err
+		return nil
+	}
+	return b
+}
+
+func (r *worldReader) bool() bool {
+	b := r.bytes(1)
+	return len(b) == 1 && b[0] != 0
+}
+
+func (r *worldReader) byte() byte {
+	b := r.bytes(1)
+	if len(b) != 1 {
+		return 0
+	}
+	return b[0]
+}
+
+func (r *worldReader) int16() int16 {
+	b := r.bytes(2)
+	if len(b) != 2 {
+		return 0
+	}
+	return int16(binary.LittleEndian.Uint16(b))
+}
+
+func (r *worldReader) int32() int32 {
+	return int32(r.uint32())
+}
+
+func (r *worldReader) uint32() uint32 {
+	b := r.bytes(4)
+	if len(b) != 4 {
+		return 0
+	}
+	return binary.LittleEndian.Uint32(b)
+}
+
+func (r *worldReader) int32s(n int) {
+	for i := 0; i < n; i++ {
+		r.int32()
+	}
+}
+
+func (r *worldReader) int64() int64 {
+	return int64(r.uint64())
+}
+
+func (r *worldReader) uint64() uint64 {
+	b := r.bytes(8)
+	if len(b) != 8 {
+		return 0
+	}
+	return binary.LittleEndian.Uint64(b)
+}
+
+func (r *worldReader) float32() float32 {
+	return math.Float32frombits(r.uint32())
+}
+
+func (r *worldReader) float64() float64 {
+	return math.Float64frombits(r.uint64())
+}
+
+// string reads a string prefixed with its 7-bit encoded length
+func (r *worldReader) string() string {
+	n, shift := 0, 0
+	for {
+		b := r.byte()
+		if r.err != nil {
+			return ""
+		}
+		n |= int(b&0x7f) << shift
+		if b&0x80 == 0 {
+			break
+		}
+		shift += 7
+		if shift > 28 {
+			r.err = errWorldFormat
+			return ""
+		}
+	}
+
+	if n > worldMaxNameLength {
+		r.err = errWorldFormat
+		return ""
+	}
+
+	b := r.bytes(n)
+	if !utf8.Valid(b) {
+		r.err = errWorldFormat
+		return ""
+	}
+	return string(b)
+}
+
+// bits reads a bit array of the given length, stored least significant bit
+// first
+func (r *worldReader) bits(n int) []bool {
+	if n < 0 {
+		r.err = errWorldFormat
+		return nil
+	}
+
+	v := make([]bool, n)
+	var b, mask byte = 0, 128
+	for i := range v {
+		if mask == 128 {
+			b = r.byte()
+			mask = 1
+		} else {
+			mask <<= 1
+		}
+		v[i] = b&mask != 0
+	}
+	return v
+}
+
+// dotnetTime converts the value of .NET's DateTime.ToBinary to a time.Time
+func dotnetTime(v int64) time.Time {
+	ticks := v & 0x3fffffffffffffff
+	if ticks == 0 {
+		return time.Time{}
+	}
+	ticks -= worldTicksEpoch
+	return time.Unix(ticks/1e7, (ticks%1e7)*100).UTC()
+}
+
+// formatGUID formats the bytes of a .NET Guid in its usual string form
+func formatGUID(b []byte) string {
+	return sprintf("%08x-%04x-%04x-%x-%x",
+		binary.LittleEndian.Uint32(b[0:4]),
+		binary.LittleEndian.Uint16(b[4:6]),
+		binary.LittleEndian.Uint16(b[6:8]),
+		b[8:10], b[10:16])
+}
+
+func binaryBytes(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, v)
+	return b
+}
+
+// ValidateWorldFile checks that the world at path looks intact. On top of the
+// checks made while parsing the header, the section table must be in order
+// and within the file, the dimensions must be sane, and the file must end with
+// the footer that Terraria writes last.
+func ValidateWorldFile(path string) (*WorldInfo, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	wi, err := ParseWorldHeader(f)
+	if err != nil {
+		return nil, err
+	}
+
+	last := int32(0)
+	for i, p := range wi.sections {
+		if p <= last || int64(p) >= fi.Size() {
+			return wi, errors.New(sprintf("section %d points outside of the file", i))
+		}
+		last = p
+	}
+
+	switch {
+	case wi.Width < 100 || wi.Width > 20000 || wi.Height < 100 || wi.Height > 10000:
+		return wi, errors.New(sprintf("world size %dx%d is not sane", wi.Width, wi.Height))
+	case wi.SpawnX < 0 || wi.SpawnX >= wi.Width || wi.SpawnY < 0 || wi.SpawnY >= wi.Height:
+		return wi, errors.New("spawn point is outside of the world")
+	}
+
+	footer := []byte{1}
+	for n := len(wi.Name); ; n >>= 7 {
+		if n < 0x80 {
+			footer = append(footer, byte(n))
+			break
+		}
+		footer = append(footer, byte(n)|0x80)
+	}
+	footer = append(footer, wi.Name...)
+	footer = binary.LittleEndian.AppendUint32(footer, uint32(wi.ID))
+
+	tail := make([]byte, len(footer))
+	if _, err := f.ReadAt(tail, fi.Size()-int64(len(footer))); err != nil {
+		return wi, errors.New("world file is truncated")
+	}
+
+	if string(tail) != string(footer) {
+		return wi, errors.New("world file footer is missing, the file may be truncated")
+	}
+
+	return wi, nil
+}
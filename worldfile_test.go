@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const worldFixture = "testdata/world.wld"
+
+var updateWorldFixture = flag.Bool("update-world", false, "rewrite "+worldFixture)
+
+// testWorld builds a small version 279 (1.4.4) world file, with a header that
+// has every field up to the boss flags and a stand in for each other section
+type testWorld struct {
+	version    int32
+	magic      string
+	badSection bool // Point the last section past the end of the file
+	width      int32
+	height     int32
+	spawnX     int32
+	footer     bool
+}
+
+func newTestWorld() *testWorld {
+	return &testWorld{version: 279, magic: "relogic\x02", width: 4200, height: 1200, spawnX: 2100, footer: true}
+}
+
+// worldWriter writes the little endian values that worldReader reads
+type worldWriter struct{ bytes.Buffer }
+
+func (w *worldWriter) put(vs ...interface{}) {
+	for _, v := range vs {
+		switch v := v.(type) {
+		case bool:
+			b := byte(0)
+			if v {
+				b = 1
+			}
+			w.WriteByte(b)
+		case string:
+			n := len(v)
+			for ; n >= 0x80; n >>= 7 {
+				w.WriteByte(byte(n) | 0x80)
+			}
+			w.WriteByte(byte(n))
+			w.WriteString(v)
+		case []byte:
+			w.Write(v)
+		default:
+			binary.Write(&w.Buffer, binary.LittleEndian, v)
+		}
+	}
+}
+
+func (tw *testWorld) bytes() []byte {
+	const sections = 11
+
+	var header worldWriter
+	header.put("Fixture World", "1864204392", uint64(1<<32|279))
+	header.put([]byte{0x33, 0x22, 0x11, 0x00, 0x55, 0x44, 0x77, 0x66, 0x88, 0x99, 0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff})
+	header.put(int32(1234), int32(0), tw.width*16, int32(0), tw.height*16, tw.height, tw.width)
+	header.put(int32(1)) // Expert
+	for i := 0; i < 8; i++ {
+		header.put(i == 1) // For the Worthy
+	}
+	created := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	header.put(int64(1<<62 | (created.UnixNano()/100 + worldTicksEpoch)))
+	header.put(byte(0), make([]byte, 17*4))
+	header.put(tw.spawnX, int32(300), float64(350), float64(500))
+	header.put(float64(13500), true, int32(0), false, false)
+	header.put(int32(1800), int32(320), true) // Dungeon, crimson
+
+	// Eye of Cthulhu, the evil boss, Skeletron, Queen Bee, the mechanical
+	// bosses, Plantera, Golem and King Slime
+	header.put(true, true, true, false, false, false, false, false, false, false, true)
+	header.put(true, true, false)         // Goblin tinkerer, wizard and mechanic saved
+	header.put(true, false, false, false) // Goblin Army, Clown, Frost Legion, Pirates
+	header.put(true, false, byte(0), int32(3), true)
+
+	header.put(false, int32(0), int32(120), int32(1), float64(2100)) // Goblin Army invading
+	header.put(float64(0), byte(0))
+	header.put(false, int32(0), float32(0), make([]byte, 3*4+8), int32(0), int16(20), float32(0.1))
+	header.put(int32(1), "Eve", false, int32(7), true, true, false)
+	header.put(int32(120), int32(0), int16(3), int32(5), int32(0), int32(9), false)
+	header.put(true, false, false, false, false, false, false, false, false) // Duke Fishron
+	header.put(false, false, false, false)
+
+	// Each section after the header is a few bytes of padding
+	first := 4 + 8 + 4 + 8 + 2 + sections*4 + 2 + 2
+	offsets := make([]int32, sections)
+	offsets[0] = int32(first)
+	for i := 1; i < sections; i++ {
+		offsets[i] = offsets[i-1] + 8
+		if i == 1 {
+			offsets[i] = offsets[0] + int32(header.Len())
+		}
+	}
+	if tw.badSection {
+		offsets[sections-1] = 1 << 30
+	}
+
+	var w worldWriter
+	w.put(tw.version, []byte(tw.magic), uint32(5), uint64(0), int16(sections))
+	for _, o := range offsets {
+		w.put(o)
+	}
+	w.put(int16(16), []byte{0xff, 0x01})
+	w.put(header.Bytes())
+	w.put(make([]byte, 8*(sections-1)))
+	if tw.footer {
+		w.put(true, "Fixture World", int32(1234))
+	}
+	return w.Bytes()
+}
+
+// writeTestWorld writes a world to a temporary directory
+func writeTestWorld(t *testing.T, tw *testWorld) string {
+	p := filepath.Join(t.TempDir(), "test.wld")
+	if err := os.WriteFile(p, tw.bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestWorldFixture(t *testing.T) {
+	b := newTestWorld().bytes()
+	if *updateWorldFixture {
+		if err := os.WriteFile(worldFixture, b, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fixture, err := os.ReadFile(worldFixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(fixture, b) {
+		t.Fatalf("%s is out of date, run the tests with -update-world", worldFixture)
+	}
+}
+
+func TestReadWorldInfo(t *testing.T) {
+	wi, err := ReadWorldInfo(worldFixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checks := []struct {
+		field     string
+		got, want interface{}
+	}{
+		{"Version", wi.Version, int32(279)},
+		{"Revision", wi.Revision, uint32(5)},
+		{"Name", wi.Name, "Fixture World"},
+		{"Seed", wi.Seed, "1864204392"},
+		{"GUID", wi.GUID, "00112233-4455-6677-8899-aabbccddeeff"},
+		{"ID", wi.ID, int32(1234)},
+		{"Size", wi.Size, "Small"},
+		{"Height", wi.Height, int32(1200)},
+		{"Difficulty", wi.Difficulty, "Expert"},
+		{"Secrets", strings.Join(wi.Secrets, ","), "For the Worthy"},
+		{"Created", wi.Created, time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)},
+		{"Spawn", [2]int32{wi.SpawnX, wi.SpawnY}, [2]int32{2100, 300}},
+		{"Dungeon", [2]int32{wi.DungeonX, wi.DungeonY}, [2]int32{1800, 320}},
+		{"RockLayer", wi.RockLayer, float64(500)},
+		{"Evil", wi.Evil, "Crimson"},
+		{"Hardmode", wi.Hardmode, true},
+		{"Invasion", wi.Invasion, "Goblin Army"},
+	}
+	for _, c := range checks {
+		if c.got != c.want {
+			t.Errorf("%s is %v, expected %v", c.field, c.got, c.want)
+		}
+	}
+
+	downed := map[string]bool{
+		"Eye of Cthulhu":                     true,
+		"Eater of Worlds / Brain of Cthulhu": true,
+		"Skeletron":                          true,
+		"Queen Bee":                          false,
+		"Plantera":                           false,
+		"King Slime":                         true,
+		"Goblin Army":                        true,
+		"Pirates":                            false,
+		"Duke Fishron":                       true,
+		"Moon Lord":                          false,
+		"Stardust Pillar":                    false,
+	}
+	for boss, want := range downed {
+		if got, ok := wi.Downed[boss]; !ok || got != want {
+			t.Errorf("%s downed is %v (read: %v), expected %v", boss, got, ok, want)
+		}
+	}
+	if len(wi.Downed) != 28 {
+		t.Errorf("read %d downed flags, expected 28", len(wi.Downed))
+	}
+}
+
+func TestValidateWorldFile(t *testing.T) {
+	if _, err := ValidateWorldFile(worldFixture); err != nil {
+		t.Fatalf("the fixture is invalid: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		change func(*testWorld)
+		err    string
+	}{
+		{"old version", func(tw *testWorld) { tw.version = 100 }, "unsupported world version 100"},
+		{"not a world", func(tw *testWorld) { tw.magic = "xindang\x02" }, errWorldFormat.Error()},
+		{"map file", func(tw *testWorld) { tw.magic = "relogic\x01" }, errWorldFormat.Error()},
+		{"section table", func(tw *testWorld) { tw.badSection = true }, "section 10 points outside of the file"},
+		{"size", func(tw *testWorld) { tw.width = math.MaxInt16 * 2 }, "is not sane"},
+		{"spawn", func(tw *testWorld) { tw.spawnX = 5000 }, "spawn point is outside of the world"},
+		{"truncated", func(tw *testWorld) { tw.footer = false }, "footer is missing"},
+	}
+
+	for _, tt := range tests {
+		tw := newTestWorld()
+		tt.change(tw)
+
+		_, err := ValidateWorldFile(writeTestWorld(t, tw))
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: got error %v, expected %q", tt.name, err, tt.err)
+		}
+	}
+
+	// A file cut short inside of the header
+	b := newTestWorld().bytes()
+	p := filepath.Join(t.TempDir(), "short.wld")
+	if err := os.WriteFile(p, b[:200], 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ValidateWorldFile(p); err == nil || errors.Is(err, errWorldFormat) {
+		t.Errorf("a file cut short was read with error %v", err)
+	}
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	mapMaxWidth = 2048
+	mapMinScale = 2
+	mapMaxScale = 16
+)
+
+const (
+	mapPrioBackground = iota
+	mapPrioWall
+	mapPrioLiquid
+	mapPrioTile
+)
+
+var (
+	mapCacheMu sync.Mutex
+	mapCache   = make(map[string]*worldMap)
+
+	mapSky         = color.RGBA{132, 170, 248, 255}
+	mapUnderground = color.RGBA{88, 61, 46, 255}
+	mapCavern      = color.RGBA{74, 67, 60, 255}
+	mapUnderworld  = color.RGBA{50, 44, 38, 255}
+	mapTileDefault = color.RGBA{140, 120, 100, 255}
+	mapWallDefault = color.RGBA{64, 52, 44, 255}
+
+	mapLiquids = []color.RGBA{
+		{0, 0, 0, 0},
+		{9, 61, 191, 255},    // Water
+		{253, 32, 3, 255},    // Lava
+		{254, 194, 20, 255},  // Honey
+		{180, 150, 230, 255}, // Shimmer
+	}
+
+	mapTiles = map[int]color.RGBA{
+		0:   {151, 107, 75, 255},  // Dirt
+		1:   {128, 128, 128, 255}, // Stone
+		2:   {28, 216, 94, 255},   // Grass
+		5:   {151, 107, 75, 255},  // Trees
+		6:   {140, 101, 80, 255},  // Iron
+		7:   {150, 67, 22, 255},   // Copper
+		8:   {185, 164, 23, 255},  // Gold
+		9:   {185, 194, 195, 255}, // Silver
+		19:  {191, 142, 111, 255}, // Platforms
+		22:  {98, 95, 167, 255},   // Demonite
+		23:  {141, 137, 223, 255}, // Corrupt grass
+		25:  {109, 90, 128, 255},  // Ebonstone
+		30:  {170, 120, 84, 255},  // Wood
+		37:  {104, 86, 84, 255},   // Meteorite
+		38:  {144, 148, 144, 255}, // Gray brick
+		40:  {146, 81, 68, 255},   // Clay
+		41:  {66, 84, 109, 255},   // Blue dungeon brick
+		43:  {84, 100, 63, 255},   // Green dungeon brick
+		44:  {107, 68, 99, 255},   // Pink dungeon brick
+		45:  {185, 164, 23, 255},  // Gold brick
+		53:  {186, 168, 84, 255},  // Sand
+		57:  {68, 68, 76, 255},    // Ash
+		58:  {142, 66, 66, 255},   // Hellstone
+		59:  {92, 68, 73, 255},    // Mud
+		60:  {143, 215, 29, 255},  // Jungle grass
+		70:  {93, 127, 255, 255},  // Mushroom grass
+		75:  {26, 26, 26, 255},    // Obsidian brick
+		76:  {142, 66, 66, 255},   // Hellstone brick
+		107: {11, 80, 143, 255},   // Cobalt
+		108: {91, 169, 169, 255},  // Mythril
+		109: {78, 193, 227, 255},  // Hallowed grass
+		111: {231, 53, 56, 255},   // Adamantite
+		112: {103, 98, 122, 255},  // Ebonsand
+		116: {238, 225, 218, 255}, // Pearlsand
+		117: {181, 172, 190, 255}, // Pearlstone
+		123: {106, 107, 118, 255}, // Silt
+		147: {211, 236, 241, 255}, // Snow
+		161: {144, 195, 232, 255}, // Ice
+		163: {184, 145, 219, 255}, // Purple ice
+		164: {218, 207, 232, 255}, // Pink ice
+		199: {208, 80, 80, 255},   // Crimson grass
+		200: {216, 152, 144, 255}, // Red ice
+		203: {125, 55, 65, 255},   // Crimstone
+		211: {33, 135, 85, 255},   // Chlorophyte
+		225: {227, 125, 22, 255},  // Hive
+		226: {141, 56, 0, 255},    // Lihzahrd brick
+		229: {255, 156, 12, 255},  // Honey block
+		234: {53, 44, 41, 255},    // Crimsand
+		367: {168, 178, 204, 255}, // Marble
+		368: {50, 46, 104, 255},   // Granite
+		396: {183, 131, 76, 255},  // Sandstone
+		397: {212, 160, 104, 255}, // Hardened sand
+	}
+
+	mapWalls = map[int]color.RGBA{
+		1:  {52, 52, 52, 255},  // Stone
+		2:  {88, 61, 46, 255},  // Dirt
+		7:  {27, 31, 42, 255},  // Blue dungeon
+		8:  {31, 39, 26, 255},  // Green dungeon
+		9:  {41, 28, 36, 255},  // Pink dungeon
+		15: {61, 58, 78, 255},  // Ebonstone
+		16: {73, 51, 36, 255},  // Dirt
+		28: {50, 50, 60, 255},  // Hardened sand
+		40: {37, 52, 84, 255},  // Snow
+		54: {46, 78, 116, 255}, // Ice
+		87: {64, 38, 20, 255},  // Lihzahrd
+		94: {27, 31, 42, 255},  // Blue slab
+		95: {31, 39, 26, 255},  // Green slab
+		96: {41, 28, 36, 255},  // Pink slab
+	}
+
+	mapSpawnMarker   = color.RGBA{255, 255, 0, 255}
+	mapDungeonMarker = color.RGBA{160, 90, 255, 255}
+	mapMarkerOutline = color.RGBA{0, 0, 0, 255}
+)
+
+// worldMap is a rendered map of a world, along with the modification time of
+// the world file that it was rendered from
+type worldMap struct {
+	modified time.Time
+	scale    int
+	png      []byte
+}
+
+// WorldMap returns a PNG map of the world at path, downscaled so that each
+// pixel covers scale by scale tiles. A scale of zero picks one that keeps the
+// image at most mapMaxWidth pixels wide, and any scale is clamped to between
+// mapMinScale and mapMaxScale. Only the latest map of each world is cached,
+// until the world file changes.
+func WorldMap(path string, scale int) ([]byte, error) {
+	wi, err := ReadWorldInfo(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if scale <= 0 {
+		scale = int((wi.Width + mapMaxWidth - 1) / mapMaxWidth)
+	}
+	if scale < mapMinScale {
+		scale = mapMinScale
+	}
+	if scale > mapMaxScale {
+		scale = mapMaxScale
+	}
+
+	mapCacheMu.Lock()
+	if m, ok := mapCache[path]; ok && m.scale == scale && m.modified.Equal(wi.Modified) {
+		mapCacheMu.Unlock()
+		return m.png, nil
+	}
+	mapCacheMu.Unlock()
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	img, err := renderWorldMap(f, wi, scale)
+	if err != nil {
+		return nil, err
+	}
+
+	var b bytes.Buffer
+	if err := png.Encode(&b, img); err != nil {
+		return nil, err
+	}
+
+	mapCacheMu.Lock()
+	mapCache[path] = &worldMap{modified: wi.Modified, scale: scale, png: b.Bytes()}
+	mapCacheMu.Unlock()
+	return b.Bytes(), nil
+}
+
+// renderWorldMap decodes the tile section of a world and draws it. Each pixel
+// takes the colour of the most prominent thing in the tiles it covers, which
+// is a tile, then liquid, then a wall, then the background for its depth.
+func renderWorldMap(rs io.ReadSeeker, wi *WorldInfo, scale int) (*image.RGBA, error) {
+	if len(wi.sections) < 2 || wi.Width <= 0 || wi.Height <= 0 {
+		return nil, errWorldFormat
+	}
+
+	if _, err := rs.Seek(int64(wi.sections[1]), io.SeekStart); err != nil {
+		return nil, err
+	}
+	r := &worldReader{r: bufio.NewReaderSize(rs, 1<<16)}
+
+	w, h := int(wi.Width), int(wi.Height)
+	mw, mh := (w+scale-1)/scale, (h+scale-1)/scale
+	img := image.NewRGBA(image.Rect(0, 0, mw, mh))
+	prio := make([]uint8, mw*mh)
+
+	for y := 0; y < mh; y++ {
+		c := mapBackground(wi, y*scale)
+		for x := 0; x < mw; x++ {
+			img.SetRGBA(x, y, c)
+		}
+	}
+
+	for x := 0; x < w; x++ {
+		for y := 0; y < h; y++ {
+			c, p, run := decodeTile(r, wi)
+			if r.err != nil {
+				return nil, r.err
+			}
+
+			for end := y + run; ; y++ {
+				i := (y/scale)*mw + x/scale
+				if p > mapPrioBackground && p >= prio[i] {
+					prio[i] = p
+					img.SetRGBA(x/scale, y/scale, c)
+				}
+				if y >= end || y >= h-1 {
+					break
+				}
+			}
+		}
+	}
+
+	drawMarker(img, int(wi.SpawnX)/scale, int(wi.SpawnY)/scale, mapSpawnMarker)
+	drawMarker(img, int(wi.DungeonX)/scale, int(wi.DungeonY)/scale, mapDungeonMarker)
+	return img, nil
+}
+
+// decodeTile reads a single tile and returns its colour, its priority and the
+// number of identical tiles that follow it in the column
+func decodeTile(r *worldReader, wi *WorldInfo) (color.RGBA, uint8, int) {
+	var h2, h3 byte
+	h1 := r.byte()
+	if h1&1 != 0 {
+		h2 = r.byte()
+		if h2&1 != 0 {
+			h3 = r.byte()
+			if h3&1 != 0 {
+				r.byte() // Coatings
+			}
+		}
+	}
+
+	c, p := color.RGBA{}, uint8(mapPrioBackground)
+
+	if h1&2 != 0 {
+		t := int(r.byte())
+		if h1&32 != 0 {
+			t |= int(r.byte()) << 8
+		}
+
+		if t < len(wi.important) && wi.important[t] {
+			r.int16() // Frame X
+			r.int16() // Frame Y
+		}
+
+		if h3&8 != 0 {
+			r.byte() // Paint
+		}
+
+		c, p = mapTileColor(t), mapPrioTile
+	}
+
+	wall := 0
+	if h1&4 != 0 {
+		wall = int(r.byte())
+		if h3&16 != 0 {
+			r.byte() // Paint
+		}
+	}
+
+	if liquid := (h1 & 24) >> 3; liquid != 0 {
+		r.byte() // Amount
+		if h3&128 != 0 {
+			liquid = 4
+		}
+		if p < mapPrioLiquid {
+			c, p = mapLiquids[liquid], mapPrioLiquid
+		}
+	}
+
+	if h3&64 != 0 {
+		wall |= int(r.byte()) << 8
+	}
+
+	if wall != 0 && p < mapPrioWall {
+		c, p = mapWallColor(wall), mapPrioWall
+	}
+
+	run := 0
+	switch (h1 & 192) >> 6 {
+	case 1:
+		run = int(r.byte())
+	case 2:
+		run = int(uint16(r.int16()))
+	}
+
+	return c, p, run
+}
+
+// mapBackground returns the background colour for the given depth
+func mapBackground(wi *WorldInfo, y int) color.RGBA {
+	switch {
+	case float64(y) < wi.WorldSurface:
+		return mapSky
+	case float64(y) < wi.RockLayer:
+		return mapUnderground
+	case y < int(wi.Height)-200:
+		return mapCavern
+	default:
+		return mapUnderworld
+	}
+}
+
+func mapTileColor(t int) color.RGBA {
+	if c, ok := mapTiles[t]; ok {
+		return c
+	}
+	return mapTileDefault
+}
+
+func mapWallColor(w int) color.RGBA {
+	if c, ok := mapWalls[w]; ok {
+		return c
+	}
+	return mapWallDefault
+}
+
+// drawMarker draws an outlined square centred on the given point
+func drawMarker(img *image.RGBA, cx, cy int, c color.RGBA) {
+	for x := cx - 4; x <= cx+4; x++ {
+		for y := cy - 4; y <= cy+4; y++ {
+			if !(image.Point{x, y}).In(img.Bounds()) {
+				continue
+			}
+			if x == cx-4 || x == cx+4 || y == cy-4 || y == cy+4 {
+				img.SetRGBA(x, y, mapMarkerOutline)
+			} else {
+				img.SetRGBA(x, y, c)
+			}
+		}
+	}
+}
@@ -0,0 +1,433 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+const (
+	worldExtension     = ".wld"
+	worldStateFile     = "worlds.json"
+	worldMaxUploadSize = 512 << 20
+)
+
+var (
+	worldSizeArgs = map[string]string{"small": "1", "medium": "2", "large": "3"}
+	worldModeArgs = map[string]string{"classic": "0", "expert": "1", "master": "2", "journey": "3"}
+	worldEvils    = map[string]bool{"random": true, "corruption": true, "crimson": true}
+
+	worldFileRe = regexp.MustCompile("[^A-Za-z0-9_-]+")
+)
+
+// WorldConfig configures the directory that worlds are kept in, and where
+// archived worlds are moved to
+type WorldConfig struct {
+	Directory string `json:"directory"`
+	Archive   string `json:"archive"`
+}
+
+// WorldOptions are the settings Terraria uses to generate a new world
+type WorldOptions struct {
+	Name       string
+	Size       string
+	Difficulty string
+	Evil       string
+	Seed       string
+}
+
+// Validate - Check the options and fill in defaults for any that are empty
+func (o *WorldOptions) Validate() error {
+	o.Name = strings.TrimSpace(o.Name)
+	o.Seed = strings.TrimSpace(o.Seed)
+	o.Size = strings.ToLower(o.Size)
+	o.Difficulty = strings.ToLower(o.Difficulty)
+	o.Evil = strings.ToLower(o.Evil)
+
+	if o.Size == "" {
+		o.Size = "large"
+	}
+	if o.Difficulty == "" {
+		o.Difficulty = "classic"
+	}
+	if o.Evil == "" {
+		o.Evil = "random"
+	}
+
+	switch {
+	case o.Name == "" || len(o.Name) > 64:
+		return errors.New("world name must be between 1 and 64 characters")
+	case strings.IndexFunc(o.Name+o.Seed, unicode.IsControl) >= 0:
+		return errors.New("world name and seed can not contain control characters")
+	case worldSizeArgs[o.Size] == "":
+		return errors.New("unknown world size: " + o.Size)
+	case worldModeArgs[o.Difficulty] == "":
+		return errors.New("unknown difficulty: " + o.Difficulty)
+	case !worldEvils[o.Evil]:
+		return errors.New("unknown world evil: " + o.Evil)
+	}
+	return nil
+}
+
+// Args - Return the command line arguments that make Terraria generate a world
+// with these options. Terraria ignores switches it does not know, so the evil
+// is passed as -worldevil for the server builds that accept it.
+func (o *WorldOptions) Args() []string {
+	args := []string{
+		"-autocreate", worldSizeArgs[o.Size],
+		"-worldname", o.Name,
+		"-difficulty", worldModeArgs[o.Difficulty],
+	}
+
+	if o.Seed != "" {
+		args = append(args, "-seed", o.Seed)
+	}
+
+	if o.Evil != "random" {
+		args = append(args, "-worldevil", o.Evil)
+	}
+	return args
+}
+
+// WorldEntry describes a world file in the world directory
+type WorldEntry struct {
+	File     string
+	Active   bool
+	Pending  *WorldOptions `json:",omitempty"`
+	Size     int64
+	Modified time.Time
+	Info     *WorldInfo `json:",omitempty"`
+	Error    string     `json:",omitempty"`
+}
+
+// worldState is the part of the WorldManager that is saved between runs
+type worldState struct {
+	Active  string
+	Pending *WorldOptions `json:",omitempty"`
+}
+
+// WorldManager manages the library of worlds that a GameServer can load
+type WorldManager struct {
+	gs     GameServer
+	config WorldConfig
+	state  string
+
+	mu sync.Mutex
+}
+
+// NewWorldManager returns a WorldManager for the given GameServer. The world
+// that was active when TerraControl last ran is selected again.
+func NewWorldManager(gs GameServer, c WorldConfig, datadir string) *WorldManager {
+	m := &WorldManager{
+		gs:     gs,
+		config: c,
+		state:  filepath.Join(datadir, worldStateFile),
+	}
+
+	if err := os.MkdirAll(c.Directory, 0755); err != nil {
+		LogError(gs, "Unable to create world directory: "+err.Error())
+	}
+
+	st := &worldState{}
+	if err := loadJSON(m.state, st); err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			LogError(gs, "Unable to load world state: "+err.Error())
+		}
+		return m
+	}
+
+	if st.Active != "" {
+		p := filepath.Join(c.Directory, st.Active)
+		if _, err := os.Stat(p); err == nil {
+			st.Pending = nil
+		}
+		gs.SetWorld(p, st.Pending)
+		LogInit(gs, "Selected world "+st.Active)
+	}
+	return m
+}
+
+// Worlds - List the worlds in the world directory, along with the metadata
+// read from their headers
+func (m *WorldManager) Worlds() ([]*WorldEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	files, err := os.ReadDir(m.config.Directory)
+	if err != nil {
+		return nil, err
+	}
+
+	active := m.active()
+	worlds := make([]*WorldEntry, 0)
+	seen := false
+
+	for _, f := range files {
+		if f.IsDir() || filepath.Ext(f.Name()) != worldExtension {
+			continue
+		}
+
+		we := &WorldEntry{File: f.Name(), Active: f.Name() == active}
+		if fi, err := f.Info(); err == nil {
+			we.Size = fi.Size()
+			we.Modified = fi.ModTime()
+		}
+
+		if wi, err := ReadWorldInfo(filepath.Join(m.config.Directory, f.Name())); err != nil {
+			we.Error = err.Error()
+		} else {
+			we.Info = wi
+		}
+
+		if we.Active {
+			seen = true
+		}
+		worlds = append(worlds, we)
+	}
+
+	if p := m.gs.PendingWorld(); p != nil && !seen && active != "" {
+		worlds = append(worlds, &WorldEntry{File: active, Active: true, Pending: p})
+	}
+
+	sort.Slice(worlds, func(i, j int) bool { return worlds[i].File < worlds[j].File })
+	return worlds, nil
+}
+
+// Create - Select a new world that Terraria generates the next time it starts,
+// and return its file name
+func (m *WorldManager) Create(o WorldOptions) (string, error) {
+	if err := o.Validate(); err != nil {
+		return "", err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	base := strings.Trim(worldFileRe.ReplaceAllString(o.Name, "_"), "_")
+	if base == "" {
+		base = "world"
+	}
+
+	name := base + worldExtension
+	for i := 1; ; i++ {
+		if _, err := os.Stat(filepath.Join(m.config.Directory, name)); errors.Is(err, os.ErrNotExist) {
+			break
+		}
+		name = sprintf("%s_%d%s", base, i, worldExtension)
+	}
+
+	m.gs.SetWorld(filepath.Join(m.config.Directory, name), &o)
+	if err := m.save(); err != nil {
+		return "", err
+	}
+
+	LogInfo(m.gs, sprintf("World %s will be generated on the next start", name),
+		m.gs.WSOutput())
+	return name, nil
+}
+
+// Select - Make the given world the one that is loaded on the next start
+func (m *WorldManager) Select(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	p, err := m.path(name)
+	if err != nil {
+		return err
+	}
+
+	if _, err := ReadWorldInfo(p); err != nil {
+		return err
+	}
+
+	m.gs.SetWorld(p, nil)
+	if err := m.save(); err != nil {
+		return err
+	}
+
+	LogInfo(m.gs, sprintf("World %s will be loaded on the next start", name),
+		m.gs.WSOutput())
+	return nil
+}
+
+// Upload - Add a world to the world directory. The world is checked before it
+// is moved into place, and the active world can not be replaced while the
+// server is running.
+func (m *WorldManager) Upload(name string, r io.Reader) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	p, err := m.path(name)
+	if err != nil {
+		return err
+	}
+
+	if (name == m.active() && m.gs.IsUp()) || m.running(name) {
+		return errors.New("the active world can not be replaced while the server is running")
+	}
+
+	tmp, err := os.CreateTemp(m.config.Directory, ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	n, err := io.Copy(tmp, io.LimitReader(r, worldMaxUploadSize+1))
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	if n > worldMaxUploadSize {
+		return errors.New("world file is too large")
+	}
+
+	if _, err := ValidateWorldFile(tmp.Name()); err != nil {
+		return errors.New("invalid world file: " + err.Error())
+	}
+
+	if err := os.Rename(tmp.Name(), p); err != nil {
+		return err
+	}
+
+	LogInfo(m.gs, "Uploaded world "+name, m.gs.WSOutput())
+	return nil
+}
+
+// Delete - Remove a world and its .bak from the world directory
+func (m *WorldManager) Delete(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	p, err := m.path(name)
+	if err != nil {
+		return err
+	}
+
+	if name == m.active() || m.running(name) {
+		return errors.New("the active world can not be deleted")
+	}
+
+	if err := os.Remove(p); err != nil {
+		return err
+	}
+
+	if err := os.Remove(p + ".bak"); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	LogInfo(m.gs, "Deleted world "+name, m.gs.WSOutput())
+	return nil
+}
+
+// Archive - Move a world and its .bak into the archive directory, and return
+// the path it was moved to. The active world can only be archived while the
+// server is stopped.
+func (m *WorldManager) Archive(name string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	p, err := m.path(name)
+	if err != nil {
+		return "", err
+	}
+
+	if (name == m.active() && m.gs.IsUp()) || m.running(name) {
+		return "", errors.New("the active world can not be archived while the server is running")
+	}
+
+	if err := os.MkdirAll(m.config.Archive, 0755); err != nil {
+		return "", err
+	}
+
+	dst := filepath.Join(m.config.Archive, sprintf("%s-%s%s",
+		strings.TrimSuffix(name, worldExtension),
+		time.Now().Format(backupTimeFormat), worldExtension))
+
+	if err := os.Rename(p, dst); err != nil {
+		return "", err
+	}
+
+	if err := os.Rename(p+".bak", dst+".bak"); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return "", err
+	}
+
+	LogInfo(m.gs, sprintf("Archived world %s to %s", name, dst), m.gs.WSOutput())
+	return dst, nil
+}
+
+// Active - Return the file name of the world that is loaded on start
+func (m *WorldManager) Active() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.active()
+}
+
+// Reinstate - Make the world at path the selected world again, moving it back
+// from the archive first if archived is set. It undoes Archive and Create
+// when a rotation fails.
+func (m *WorldManager) Reinstate(path, archived string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if archived != "" {
+		if err := os.Rename(archived, path); err != nil {
+			return err
+		}
+		if err := os.Rename(archived+".bak", path+".bak"); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+
+	m.gs.SetWorld(path, nil)
+	LogInfo(m.gs, "Reinstated world "+filepath.Base(path), m.gs.WSOutput())
+	return m.save()
+}
+
+// active returns the file name of the world that is loaded on the next start
+// if it is in the world directory. Expects m.mu to be held.
+func (m *WorldManager) active() string {
+	return m.local(m.gs.SelectedWorld())
+}
+
+// running returns true if the server is up with the named world loaded, which
+// differs from the active world once another world has been selected
+func (m *WorldManager) running(name string) bool {
+	return m.gs.IsUp() && name == m.local(m.gs.WorldFile())
+}
+
+// local returns the file name of a world if it is in the world directory, or
+// an empty string
+func (m *WorldManager) local(p string) string {
+	if filepath.Clean(filepath.Dir(p)) != filepath.Clean(m.config.Directory) {
+		return ""
+	}
+	return filepath.Base(p)
+}
+
+// path returns the path of a world in the world directory, and rejects names
+// that would point outside of it
+func (m *WorldManager) path(name string) (string, error) {
+	if name == "" || name != filepath.Base(name) || filepath.Ext(name) != worldExtension ||
+		strings.HasPrefix(name, ".") {
+		return "", errors.New("invalid world file name: " + name)
+	}
+	return filepath.Join(m.config.Directory, name), nil
+}
+
+// save writes the active world to the state file. Expects m.mu to be held.
+func (m *WorldManager) save() error {
+	return saveJSON(m.state, &worldState{
+		Active:  m.active(),
+		Pending: m.gs.PendingWorld(),
+	})
+}